@@ -27,25 +27,9 @@ const (
 	binSignature       = "go65"
 	sourceMapSignature = "sm65"
 	versionMajor       = 0
-	versionMinor       = 1
+	versionMinor       = 4
 )
 
-var modeName = []string{
-	"IMM",
-	"IMP",
-	"REL",
-	"ZPG",
-	"ZPX",
-	"ZPY",
-	"ABS",
-	"ABX",
-	"ABY",
-	"IND",
-	"IDX",
-	"IDY",
-	"ACC",
-}
-
 var modeFormat = []string{
 	"#$%s",    // IMM
 	"%s",      // IMP
@@ -70,35 +54,38 @@ type pseudoOpData struct {
 const hiBitTerm = 1 << 16
 
 var pseudoOps = map[string]pseudoOpData{
-	".ar":      {fn: (*assembler).parseArch},
-	".arch":    {fn: (*assembler).parseArch},
-	"arch":     {fn: (*assembler).parseArch},
-	".bin":     {fn: (*assembler).parseBinaryInclude},
-	".binary":  {fn: (*assembler).parseBinaryInclude},
-	".eq":      {fn: (*assembler).parseEquate},
-	".equ":     {fn: (*assembler).parseEquate},
-	"equ":      {fn: (*assembler).parseEquate},
-	"=":        {fn: (*assembler).parseEquate},
-	".or":      {fn: (*assembler).parseOrigin},
-	".org":     {fn: (*assembler).parseOrigin},
-	"org":      {fn: (*assembler).parseOrigin},
-	".db":      {fn: (*assembler).parseData, param: 1},
-	".byte":    {fn: (*assembler).parseData, param: 1},
-	".dw":      {fn: (*assembler).parseData, param: 2},
-	".word":    {fn: (*assembler).parseData, param: 2},
-	".dd":      {fn: (*assembler).parseData, param: 4},
-	".dword":   {fn: (*assembler).parseData, param: 4},
-	".dh":      {fn: (*assembler).parseHexString},
-	".hex":     {fn: (*assembler).parseHexString},
-	"hex":      {fn: (*assembler).parseHexString},
-	".ds":      {fn: (*assembler).parseData, param: 1 | hiBitTerm},
-	".tstring": {fn: (*assembler).parseData, param: 1 | hiBitTerm},
-	".al":      {fn: (*assembler).parseAlign},
-	".align":   {fn: (*assembler).parseAlign},
-	".pad":     {fn: (*assembler).parsePadding},
-	".ex":      {fn: (*assembler).parseExport},
-	".export":  {fn: (*assembler).parseExport},
-	"exp":      {fn: (*assembler).parseExport},
+	".ar":       {fn: (*assembler).parseArch},
+	".arch":     {fn: (*assembler).parseArch},
+	"arch":      {fn: (*assembler).parseArch},
+	".bin":      {fn: (*assembler).parseBinaryInclude},
+	".binary":   {fn: (*assembler).parseBinaryInclude},
+	".eq":       {fn: (*assembler).parseEquate},
+	".equ":      {fn: (*assembler).parseEquate},
+	"equ":       {fn: (*assembler).parseEquate},
+	"=":         {fn: (*assembler).parseEquate},
+	".or":       {fn: (*assembler).parseOrigin},
+	".org":      {fn: (*assembler).parseOrigin},
+	"org":       {fn: (*assembler).parseOrigin},
+	".db":       {fn: (*assembler).parseData, param: 1},
+	".byte":     {fn: (*assembler).parseData, param: 1},
+	".dw":       {fn: (*assembler).parseData, param: 2},
+	".word":     {fn: (*assembler).parseData, param: 2},
+	".dd":       {fn: (*assembler).parseData, param: 4},
+	".dword":    {fn: (*assembler).parseData, param: 4},
+	".dh":       {fn: (*assembler).parseHexString},
+	".hex":      {fn: (*assembler).parseHexString},
+	"hex":       {fn: (*assembler).parseHexString},
+	".ds":       {fn: (*assembler).parseData, param: 1 | hiBitTerm},
+	".tstring":  {fn: (*assembler).parseData, param: 1 | hiBitTerm},
+	".al":       {fn: (*assembler).parseAlign},
+	".align":    {fn: (*assembler).parseAlign},
+	".pad":      {fn: (*assembler).parsePadding},
+	".fillbyte": {fn: (*assembler).parseFillByte},
+	".format":   {fn: (*assembler).parseFormat},
+	".checksum": {fn: (*assembler).parseChecksum},
+	".ex":       {fn: (*assembler).parseExport},
+	".export":   {fn: (*assembler).parseExport},
+	"exp":       {fn: (*assembler).parseExport},
 }
 
 func init() {
@@ -124,16 +111,49 @@ type instruction struct {
 	opcode    fstring          // opcode string
 	inst      *cpu.Instruction // selected instruction data for the opcode
 	operand   operand          // parameter data for the instruction
+	long      bool             // branch rewritten to use an absolute jump
 }
 
 func (i *instruction) address() int {
 	return i.addr
 }
 
+// Return the number of bytes of machine code generated by the instruction.
+// An instruction with an invalid addressing mode is estimated from the size
+// of its operand.
+func (i *instruction) length() int {
+	switch {
+	case i.inst == nil:
+		return 1 + i.operand.size()
+	case i.long && i.inst.Opcode == opcodeBRA:
+		return 3
+	case i.long:
+		return 5
+	default:
+		return int(i.inst.Length)
+	}
+}
+
+// Return the machine code for a branch instruction that has been rewritten
+// to reach a distant target. Conditional branches become the inverted branch
+// skipping over a JMP to the target, while BRA becomes a JMP.
+func (i *instruction) longBranchCode() []byte {
+	target := i.operand.getValue()
+	jmp := []byte{opcodeJMP, byte(target), byte(target >> 8)}
+	if i.inst.Opcode == opcodeBRA {
+		return jmp
+	}
+
+	// Conditional branch opcodes differ from their inverses only in bit 5.
+	return append([]byte{i.inst.Opcode ^ 0x20, 0x03}, jmp...)
+}
+
 // Format a byte code string for an instruction.
 func (i *instruction) codeString() string {
 	sz := i.inst.Length - 1
 	switch {
+	case i.long:
+		return byteString(i.longBranchCode())
 	case i.inst.Mode == cpu.REL:
 		offset, _ := relOffset(i.operand.getValue(), i.addr+int(i.inst.Length))
 		return byteString([]byte{i.inst.Opcode, offset})
@@ -237,6 +257,7 @@ type alignment struct {
 	addr  int
 	align int
 	pad   int
+	fill  byte
 }
 
 func (a *alignment) address() int {
@@ -256,6 +277,18 @@ func (p *padding) address() int {
 	return p.addr
 }
 
+// A checksum segment contains a single byte holding the checksum of a
+// range of generated code.
+type checksum struct {
+	addr      int
+	startExpr *expr
+	endExpr   *expr
+}
+
+func (c *checksum) address() int {
+	return c.addr
+}
+
 // An export segment contains an exported address.
 type export struct {
 	addr int
@@ -285,23 +318,44 @@ type assembler struct {
 	arch        cpu.Architecture    // requested architecture
 	instSet     *cpu.InstructionSet // instructions on current arch
 	origin      int                 // requested origin
+	fill        byte                // byte filling gaps between segments
+	format      string              // requested output file format
 	pc          int                 // the program counter
 	code        []byte              // generated machine code
-	r           io.Reader           // the reader passed to Assemble
+	inputs      []input             // the top-level source files
 	scopeLabel  fstring             // label currently in scope
 	constants   map[string]*expr    // constant -> expression
 	labels      map[string]int      // label -> segment index
 	exports     []Export            // exported addresses
 	sourceLines []SourceLine        // source code line mappings
 	files       []string            // processed files
+	fileStack   []int               // indexes of files being parsed
+	paths       []string            // include file search paths
 	segments    []segment           // segment of machine code
 	unevaluated []uneval            // expressions requiring evaluation
 	out         io.Writer           // output used for verbose output
 	verbose     bool                // verbose output
+	longBranch  bool                // rewrite out-of-range branches
+	strict      bool                // recognize only dotted pseudo-ops
+	extLabels   bool                // allow extended label characters
+	ignoreCase  bool                // case-insensitive labels and constants
+	allErrors   bool                // continue assembly after errors
+	exportAll   bool                // export every global label
+	deferred    []uneval            // all expressions deferred during parsing
+	resolved    []string            // labels resolved to constants
+	comments    map[lineKey]string  // trailing comments by source line
+	lastFile    int                 // index of the last top-level source file
+	lastRow     int                 // number of lines in the last top-level file
 	exprParser  exprParser          // used to parse math expressions
 	errors      []asmerror          // errors encountered during assembly
 }
 
+// A lineKey identifies a line of a source code file.
+type lineKey struct {
+	fileIndex int
+	row       int
+}
+
 // An Export describes an exported address.
 type Export struct {
 	Label   string
@@ -311,8 +365,54 @@ type Export struct {
 // Assembly contains the assembled machine code and other data associated with
 // the machine code.
 type Assembly struct {
-	Code   []byte   // Assembled machine code
-	Errors []string // Errors encountered during assembly
+	Code        []byte       // Assembled machine code
+	Errors      []string     // Errors encountered during assembly
+	Diagnostics []Diagnostic // Source locations of the errors
+	Stats       Stats        // Statistics gathered during assembly
+	Format      string       // Output file format requested by .FORMAT
+	origin      uint16       // address of the first byte of code
+	segments    []Segment    // populated regions of the code
+}
+
+// A Diagnostic describes an error encountered during assembly and the
+// source code location that caused it.
+type Diagnostic struct {
+	File   string // Name of the source file
+	Line   int    // Line number, starting at 1
+	Column int    // Column number, starting at 1
+	Msg    string // Error message
+}
+
+// String returns the diagnostic in the "file:line:col: message" format
+// understood by most editors.
+func (d Diagnostic) String() string {
+	return fmt.Sprintf("%s:%d:%d: %s", d.File, d.Line, d.Column, d.Msg)
+}
+
+// Stats contains statistics describing a successful assembly.
+type Stats struct {
+	Bytes        int    // Total number of bytes of machine code
+	Instructions int    // Number of instructions assembled
+	Labels       int    // Number of address labels defined
+	Start        uint16 // Address of the first byte of machine code
+	End          uint16 // Address of the last byte of machine code
+}
+
+// A Segment is a contiguous region of assembled machine code.
+type Segment struct {
+	Addr  uint16 // Address of the first byte in the segment
+	Bytes []byte // Machine code contained in the segment
+}
+
+// Segments returns the contiguous regions of memory populated by the
+// assembly. Filler bytes inserted by alignment and padding pseudo-ops are
+// not considered populated, so they separate one segment from the next. An assembly read
+// from a binary file consists of a single segment at address 0.
+func (a *Assembly) Segments() []Segment {
+	if a.segments == nil && len(a.Code) > 0 {
+		return []Segment{{Addr: a.origin, Bytes: a.Code}}
+	}
+	return a.segments
 }
 
 // ReadFrom reads machine code from a binary input source.
@@ -337,82 +437,182 @@ type Option uint
 
 // Options for the Assemble function.
 const (
-	Verbose Option = 1 << iota // verbose output during assembly
+	Verbose         Option = 1 << iota // verbose output during assembly
+	LongBranches                       // rewrite out-of-range branches as jumps
+	MapSymbols                         // store all labels and constants in the source map
+	MapComments                        // store source code comments in the source map
+	StrictPseudoOps                    // recognize only pseudo-ops with a leading dot
+	ExtendedLabels                     // allow '?' and '!' in labels
+	AllErrors                          // report all errors instead of stopping at the first
+	ExportAll                          // export every global label
+	IgnoreCase                         // treat labels and constants as case-insensitive
+)
+
+// Opcodes used when rewriting out-of-range branches.
+const (
+	opcodeBRA = 0x80
+	opcodeJMP = 0x4c
 )
 
 const defaultOrigin = 0x1000
 
+// The name of the predefined constant identifying the active architecture.
+// Its value is 0 for NMOS and 1 for CMOS.
+const archSymbol = "__CPU__"
+
+// A FileResult describes the output of a file assembled by
+// AssembleFileResult.
+type FileResult struct {
+	Assembly  *Assembly  // Assembled machine code
+	SourceMap *SourceMap // Source map describing the machine code
+	BinPath   string     // Path of the binary output file
+	MapPath   string     // Path of the source map output file
+}
+
 // AssembleFile reads a file containing 6502 assembly code, assembles it,
-// and produces a binary output file and a source map file.
-func AssembleFile(path string, options Option, out io.Writer) error {
-	inFile, err := os.Open(path)
-	if err != nil {
-		return err
+// and produces a binary output file and a source map file. Files included
+// by the assembly code are searched for in the optional include paths.
+func AssembleFile(path string, options Option, out io.Writer, includePaths ...string) error {
+	_, err := AssembleFileResult(path, options, out, includePaths...)
+	return err
+}
+
+// AssembleFileResult behaves like AssembleFile, but it also returns the
+// assembled machine code and source map along with the paths of the files
+// it wrote. If assembly fails, the result's Assembly contains the errors
+// that were encountered.
+func AssembleFileResult(path string, options Option, out io.Writer, includePaths ...string) (*FileResult, error) {
+	return AssembleFileTo(path, "", options, out, includePaths...)
+}
+
+// AssembleFileTo behaves like AssembleFileResult, but it writes the binary
+// and source map files to outPath with the .bin and .map extensions. Any
+// extension already present on outPath is replaced. If outPath is empty,
+// the output files are written alongside the input file.
+func AssembleFileTo(path, outPath string, options Option, out io.Writer, includePaths ...string) (*FileResult, error) {
+	return AssembleFiles([]string{path}, outPath, options, out, includePaths...)
+}
+
+// AssembleFiles behaves like AssembleFileTo, but it assembles several
+// top-level source files in sequence into a single binary and source map.
+// Labels and constants defined in any of the files are visible in all of
+// them. Only the first file may set the origin. If outPath is empty, the
+// output files are written alongside the first input file.
+func AssembleFiles(paths []string, outPath string, options Option, out io.Writer, includePaths ...string) (*FileResult, error) {
+	if len(paths) == 0 {
+		return nil, errors.New("no input files")
+	}
+
+	inputs := make([]input, 0, len(paths))
+	for _, path := range paths {
+		inFile, err := os.Open(path)
+		if err != nil {
+			return nil, err
+		}
+		defer inFile.Close()
+		inputs = append(inputs, input{inFile, path})
 	}
-	defer inFile.Close()
 
-	assembly, sourceMap, err := Assemble(inFile, path, defaultOrigin, out, options)
+	path := paths[0]
+	assembly, sourceMap, err := assembleInputs(inputs, defaultOrigin, out, options, includePaths...)
+	result := &FileResult{Assembly: assembly, SourceMap: sourceMap}
 	if err != nil {
 		for _, e := range assembly.Errors {
 			fmt.Fprintln(out, e)
 		}
-		return err
+		return result, err
 	}
 
-	ext := filepath.Ext(path)
-	prefix := path[:len(path)-len(ext)]
+	if outPath == "" {
+		outPath = path
+	}
+	ext := filepath.Ext(outPath)
+	prefix := outPath[:len(outPath)-len(ext)]
 	binPath := prefix + ".bin"
 	binFile, err := os.OpenFile(binPath, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0600)
 	if err != nil {
-		return err
+		return result, err
 	}
 	defer binFile.Close()
 
 	_, err = assembly.WriteTo(binFile)
 	if err != nil {
-		return err
+		return result, err
 	}
+	result.BinPath = binPath
 
 	mapPath := prefix + ".map"
 	mapFile, err := os.OpenFile(mapPath, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0600)
 	if err != nil {
-		return err
+		return result, err
 	}
 	defer mapFile.Close()
 
 	_, err = sourceMap.WriteTo(mapFile)
 	if err != nil {
-		return err
+		return result, err
 	}
+	result.MapPath = mapPath
 
 	fmt.Fprintf(out, "Assembled '%s' to produce '%s' and '%s'.\n",
 		filepath.Base(path),
 		filepath.Base(binPath),
 		filepath.Base(mapPath))
-	return nil
+
+	stats := assembly.Stats
+	fmt.Fprintf(out, "%d bytes at $%04X..$%04X, %d instructions, %d labels.\n",
+		stats.Bytes, stats.Start, stats.End, stats.Instructions, stats.Labels)
+	return result, nil
+}
+
+// An input is a top-level source file read by the assembler.
+type input struct {
+	r        io.Reader
+	filename string
 }
 
 // Assemble reads data from the provided stream and attempts to assemble it
-// into 6502 byte code.
-func Assemble(r io.Reader, filename string, origin uint16, out io.Writer, options Option) (*Assembly, *SourceMap, error) {
+// into 6502 byte code. Files included by the assembly code are searched for
+// in the optional include paths.
+func Assemble(r io.Reader, filename string, origin uint16, out io.Writer, options Option, includePaths ...string) (*Assembly, *SourceMap, error) {
+	return assembleInputs([]input{{r, filename}}, origin, out, options, includePaths...)
+}
+
+// Assemble one or more top-level source files in sequence, as if they were
+// a single file. Labels and constants defined in one file are visible in
+// all of the others.
+func assembleInputs(inputs []input, origin uint16, out io.Writer, options Option, includePaths ...string) (*Assembly, *SourceMap, error) {
 	if out == nil {
 		out = os.Stdout
 	}
 
 	a := &assembler{
-		arch:      cpu.NMOS,
-		instSet:   cpu.GetInstructionSet(cpu.NMOS),
-		origin:    int(origin),
-		pc:        -1,
-		r:         r,
-		constants: make(map[string]*expr),
-		labels:    make(map[string]int),
-		files:     []string{filename},
-		exports:   make([]Export, 0),
-		segments:  make([]segment, 0, 32),
-		out:       out,
-		verbose:   (options & Verbose) != 0,
-	}
+		arch:       cpu.NMOS,
+		instSet:    cpu.GetInstructionSet(cpu.NMOS),
+		origin:     int(origin),
+		format:     "raw",
+		pc:         -1,
+		inputs:     inputs,
+		constants:  make(map[string]*expr),
+		labels:     make(map[string]int),
+		paths:      includePaths,
+		exports:    make([]Export, 0),
+		segments:   make([]segment, 0, 32),
+		out:        out,
+		verbose:    (options & Verbose) != 0,
+		longBranch: (options & LongBranches) != 0,
+		strict:     (options & StrictPseudoOps) != 0,
+		extLabels:  (options & ExtendedLabels) != 0,
+		allErrors:  (options & AllErrors) != 0,
+		exportAll:  (options & ExportAll) != 0,
+		ignoreCase: (options & IgnoreCase) != 0,
+	}
+	a.exprParser.extLabels = a.extLabels
+	a.exprParser.ignoreCase = a.ignoreCase
+	if (options & MapComments) != 0 {
+		a.comments = make(map[lineKey]string)
+	}
+	a.setArch(cpu.NMOS)
 
 	// Assembly consists of the following steps
 	steps := []func(a *assembler) error{
@@ -422,56 +622,206 @@ func Assemble(r io.Reader, filename string, origin uint16, out io.Writer, option
 		(*assembler).resolveLabels,                // Resolve labels to addresses
 		(*assembler).evaluateExpressions,          // Do another evaluation pass with resolved labels
 		(*assembler).handleUnevaluatedExpressions, // Cause error if there are unevaluated expressions
+		(*assembler).lengthenBranches,             // Rewrite out-of-range branches if requested
 		(*assembler).generateCode,                 // Generate the machine code
+		(*assembler).computeChecksums,             // Fill in checksum bytes
 	}
 
 	// Execute assembler steps, breaking if an error is encountered
-	// in any one of them.
+	// in any one of them. When all errors are requested, every step runs
+	// so that as many independent errors as possible are collected.
 	var err error
 	for _, step := range steps {
-		err = step(a)
-		if err != nil {
-			break
+		if serr := step(a); serr != nil && err == nil {
+			err = serr
 		}
-		if len(a.errors) > 0 {
+		if err == nil && len(a.errors) > 0 {
 			err = errParse
+		}
+		if err != nil && !a.allErrors {
 			break
 		}
 	}
 
 	errors := make([]string, 0, len(a.errors))
+	diags := make([]Diagnostic, 0, len(a.errors))
 	for _, e := range a.errors {
 		filename := a.files[e.line.fileIndex]
 		s := fmt.Sprintf("Syntax error in '%s' line %d, col %d: %s", filename, e.line.row, e.line.column+1, e.msg)
 		errors = append(errors, s)
+		diags = append(diags, Diagnostic{filename, e.line.row, e.line.column + 1, e.msg})
 	}
 
 	assembly := &Assembly{
-		Code:   a.code,
-		Errors: errors,
+		Code:        a.code,
+		Errors:      errors,
+		Diagnostics: diags,
+		Format:      a.format,
+		origin:      uint16(a.origin),
+	}
+	if err == nil {
+		assembly.segments = a.populatedSegments()
+		assembly.Stats = a.stats()
 	}
 
 	sourceMap := &SourceMap{
-		Origin:  uint16(a.origin),
-		Size:    uint32(len(a.code)),
-		CRC:     crc32.ChecksumIEEE(a.code),
-		Files:   a.files,
-		Lines:   a.sourceLines,
-		Exports: sortExports(a.exports),
+		Origin:   uint16(a.origin),
+		Size:     uint32(len(a.code)),
+		CRC:      crc32.ChecksumIEEE(a.code),
+		Files:    a.files,
+		Lines:    a.sourceLines,
+		Exports:  sortExports(a.exports),
+		Symbols:  []Export{},
+		Comments: []Comment{},
+		Data:     []DataRange{},
+	}
+	if err == nil {
+		sourceMap.Data = a.dataRanges()
+	}
+	if err == nil && (options&MapSymbols) != 0 {
+		sourceMap.Symbols = a.symbols()
+	}
+	if err == nil && a.comments != nil {
+		sourceMap.Comments = a.sourceComments()
 	}
 
 	return assembly, sourceMap, err
 }
 
+// Return the trailing comments of all source lines that generated
+// instructions, sorted by address.
+func (a *assembler) sourceComments() []Comment {
+	comments := []Comment{}
+	seen := make(map[lineKey]bool)
+	for _, l := range a.sourceLines {
+		key := lineKey{l.FileIndex, l.Line}
+		if c, ok := a.comments[key]; ok && !seen[key] {
+			comments = append(comments, Comment{Address: uint16(l.Address), Text: c})
+			seen[key] = true
+		}
+	}
+	return sortComments(comments)
+}
+
+// Return the address ranges holding data rather than instructions, sorted
+// by address. Adjacent ranges with the same unit size are combined.
+func (a *assembler) dataRanges() []DataRange {
+	ranges := []DataRange{}
+	add := func(addr, size, unit int) {
+		if size == 0 {
+			return
+		}
+		if n := len(ranges); n > 0 {
+			last := &ranges[n-1]
+			if last.Unit == unit && int(last.Address)+int(last.Size) == addr {
+				last.Size += uint16(size)
+				return
+			}
+		}
+		ranges = append(ranges, DataRange{Address: uint16(addr), Size: uint16(size), Unit: unit})
+	}
+
+	for _, s := range a.segments {
+		switch ss := s.(type) {
+		case *data:
+			unit := ss.unit
+			for _, e := range ss.exprs {
+				if e.isString {
+					unit = 1
+					break
+				}
+			}
+			add(ss.addr, ss.bytes(), unit)
+		case *bytedata:
+			add(ss.addr, len(ss.b), 1)
+		case *alignment:
+			add(ss.addr, ss.pad, 1)
+		case *padding:
+			add(ss.addr, ss.pad, 1)
+		case *checksum:
+			add(ss.addr, 1, 1)
+		}
+	}
+	return ranges
+}
+
+// Return statistics describing the generated code.
+func (a *assembler) stats() Stats {
+	s := Stats{
+		Bytes:  len(a.code),
+		Labels: len(a.labels),
+		Start:  uint16(a.origin),
+		End:    uint16(a.origin),
+	}
+	if len(a.code) > 0 {
+		s.End = uint16(a.origin + len(a.code) - 1)
+	}
+	for _, seg := range a.segments {
+		if _, ok := seg.(*instruction); ok {
+			s.Instructions++
+		}
+	}
+	return s
+}
+
+// Return a sorted table of all labels and constants with evaluated values.
+// Local labels are named after their scope label, as in "SCOPE.local".
+func (a *assembler) symbols() []Export {
+	symbols := make([]Export, 0, len(a.constants))
+	for name, e := range a.constants {
+		if !e.evaluated {
+			continue
+		}
+		symbols = append(symbols, Export{
+			Label:   strings.TrimPrefix(name, "~"),
+			Address: uint16(e.value),
+		})
+	}
+	return sortExports(symbols)
+}
+
+// Return the contiguous regions of generated code, split wherever an
+// alignment or padding pseudo-op inserted filler bytes.
+func (a *assembler) populatedSegments() []Segment {
+	var segments []Segment
+	start := a.origin
+	add := func(end int) {
+		if end > start {
+			b := a.code[start-a.origin : end-a.origin]
+			segments = append(segments, Segment{Addr: uint16(start), Bytes: b})
+		}
+	}
+
+	for _, s := range a.segments {
+		var addr, pad int
+		switch ss := s.(type) {
+		case *alignment:
+			addr, pad = ss.addr, ss.pad
+		case *padding:
+			addr, pad = ss.addr, ss.pad
+		}
+		if pad > 0 {
+			add(addr)
+			start = addr + pad
+		}
+	}
+	add(a.origin + len(a.code))
+	return segments
+}
+
 // Read the assembly code and perform the initial parsing. Build up
 // machine code segments, the constants table, the label table, and a
 // list of unevaluated expression trees.
 func (a *assembler) parse() error {
 	a.logSection("Parsing assembly code")
 
-	err := a.parseFile(bufio.NewScanner(a.r), 0)
-	if err != nil {
-		return err
+	for _, in := range a.inputs {
+		a.lastFile = len(a.files)
+		a.files = append(a.files, in.filename)
+		err := a.parseFile(bufio.NewScanner(in.r), a.lastFile)
+		if err != nil {
+			return err
+		}
 	}
 
 	// Add an empty byte-data segment to the end of the file, just so the
@@ -487,22 +837,35 @@ func (a *assembler) parse() error {
 // passed to the assembler, or it may be called in response to including
 // a file.
 func (a *assembler) parseFile(scanner *bufio.Scanner, fileIndex int) error {
+	a.fileStack = append(a.fileStack, fileIndex)
+	defer func() { a.fileStack = a.fileStack[:len(a.fileStack)-1] }()
+
 	row := 1
 	for scanner.Scan() {
 		text := scanner.Text()
 		line := newFstring(fileIndex, row, text)
+		if a.comments != nil {
+			if c := line.trailingComment(); c != "" {
+				a.comments[lineKey{fileIndex, row}] = c
+			}
+		}
 		err := a.parseLine(line.stripTrailingComment())
-		if err != nil {
+		if err != nil && !a.allErrors {
 			return err
 		}
 		row++
 	}
+	if fileIndex == a.lastFile {
+		a.lastRow = row - 1
+	}
 	return nil
 }
 
 // Add an expression to the "unevaluated" list.
 func (a *assembler) pushUnevaluated(e *expr) {
-	a.unevaluated = append(a.unevaluated, uneval{expr: e, segno: len(a.segments)})
+	u := uneval{expr: e, segno: len(a.segments)}
+	a.unevaluated = append(a.unevaluated, u)
+	a.deferred = append(a.deferred, u)
 }
 
 // Return the address assigned to the requested segment.
@@ -516,6 +879,13 @@ func (a *assembler) segaddr(segno int) int {
 // Evaluate all unevaluated expression trees using constants and labels.
 func (a *assembler) evaluateExpressions() error {
 	a.logSection("Evaluating expressions")
+	a.evaluatePending()
+	return nil
+}
+
+// Evaluate as many unevaluated expressions as possible, repeating until no
+// further progress is made.
+func (a *assembler) evaluatePending() {
 	for {
 		var unevaluated []uneval
 		for _, u := range a.unevaluated {
@@ -531,13 +901,13 @@ func (a *assembler) evaluateExpressions() error {
 		}
 		a.unevaluated = unevaluated
 	}
-	return nil
 }
 
 // Determine addresses of all code segments.
 func (a *assembler) assignAddresses() error {
 	a.logSection("Assigning addresses")
 	a.pc = a.origin
+	a.sourceLines = a.sourceLines[:0]
 	for _, s := range a.segments {
 		switch ss := s.(type) {
 		case *instruction:
@@ -545,7 +915,11 @@ func (a *assembler) assignAddresses() error {
 			ss.inst = a.findMatchingInstruction(ss.opcode, ss.operand)
 			if ss.inst == nil {
 				a.addError(ss.opcode, "invalid addressing mode for opcode '%s'", ss.opcode.str)
-				return errParse
+				if !a.allErrors {
+					return errParse
+				}
+				a.pc += ss.length()
+				continue
 			}
 
 			l := SourceLine{
@@ -556,9 +930,9 @@ func (a *assembler) assignAddresses() error {
 			a.sourceLines = append(a.sourceLines, l)
 
 			a.log("%04X  %s Len:%d Mode:%s Opcode:%02X",
-				ss.addr, ss.opcode.str, ss.inst.Length,
-				modeName[ss.inst.Mode], ss.inst.Opcode)
-			a.pc += int(ss.inst.Length)
+				ss.addr, ss.opcode.str, ss.length(),
+				ss.inst.Mode, ss.inst.Opcode)
+			a.pc += ss.length()
 
 		case *data:
 			ss.addr = a.pc
@@ -584,11 +958,15 @@ func (a *assembler) assignAddresses() error {
 				a.evaluateExpressions()
 				if !ss.valExpr.evaluated {
 					a.addError(ss.valExpr.line, "padding value expression could not be evaluated")
-					return errParse
+					if !a.allErrors {
+						return errParse
+					}
 				}
 				if !ss.lenExpr.evaluated {
 					a.addError(ss.lenExpr.line, "padding length expression could not be evaluated")
-					return errParse
+					if !a.allErrors {
+						return errParse
+					}
 				}
 			}
 			ss.value = byte(ss.valExpr.value)
@@ -596,10 +974,26 @@ func (a *assembler) assignAddresses() error {
 			a.log("%04X  .PAD Len:%d Val:%d", ss.addr, ss.pad, ss.value)
 			a.pc += ss.pad
 
+		case *checksum:
+			ss.addr = a.pc
+			a.log("%04X  .CHECKSUM", ss.addr)
+			a.pc++
+
 		case *export:
 			ss.addr = a.pc
 		}
 	}
+
+	// Map the end address to the last line of the file, so that source
+	// listings can reach any lines following the last instruction.
+	if a.lastRow > 0 {
+		l := SourceLine{
+			Address:   a.pc,
+			FileIndex: a.lastFile,
+			Line:      a.lastRow,
+		}
+		a.sourceLines = append(a.sourceLines, l)
+	}
 	return nil
 }
 
@@ -614,6 +1008,7 @@ func (a *assembler) resolveLabels() error {
 		if addr != -1 {
 			a.log("%-15s Seg:%-3d Addr:$%04X", label, segno, addr)
 			a.constants[label] = &expr{op: opNumber, value: addr, evaluated: true}
+			a.resolved = append(a.resolved, label)
 		}
 	}
 	return nil
@@ -630,20 +1025,80 @@ func (a *assembler) handleUnevaluatedExpressions() error {
 	return nil
 }
 
+// Rewrite branch instructions whose targets are out of range as an inverted
+// branch over an absolute jump. Because lengthening one branch may push other
+// branches out of range, addresses are reassigned and expressions are
+// reevaluated until every branch fits.
+func (a *assembler) lengthenBranches() error {
+	if !a.longBranch || len(a.errors) > 0 {
+		return nil
+	}
+
+	for {
+		changed := false
+		for _, s := range a.segments {
+			ss, ok := s.(*instruction)
+			if !ok || ss.inst == nil || ss.inst.Mode != cpu.REL || ss.long {
+				continue
+			}
+			if _, err := relOffset(ss.operand.getValue(), ss.addr+int(ss.inst.Length)); err != nil {
+				a.log("%04X  %s lengthened", ss.addr, ss.opcode.str)
+				ss.long = true
+				changed = true
+			}
+		}
+		if !changed {
+			return nil
+		}
+
+		// Discard all label addresses and values derived from them.
+		for _, label := range a.resolved {
+			delete(a.constants, label)
+		}
+		a.resolved = nil
+		a.unevaluated = append([]uneval(nil), a.deferred...)
+		for _, u := range a.unevaluated {
+			u.expr.reset()
+		}
+
+		steps := []func(a *assembler) error{
+			(*assembler).assignAddresses,
+			(*assembler).resolveLabels,
+			(*assembler).evaluateExpressions,
+			(*assembler).handleUnevaluatedExpressions,
+		}
+		for _, step := range steps {
+			if err := step(a); err != nil {
+				return err
+			}
+		}
+	}
+}
+
 // Generate machine code.
 func (a *assembler) generateCode() error {
 	a.logSection("Generating code")
 	for _, s := range a.segments {
 		switch ss := s.(type) {
 		case *instruction:
+			if ss.inst == nil {
+				a.code = append(a.code, make([]byte, ss.length())...)
+				continue
+			}
+			if ss.long {
+				a.code = append(a.code, ss.longBranchCode()...)
+				a.log("%04X-   %-14s    %s   %s", ss.addr, ss.codeString(), ss.opcode.str, ss.operandString())
+				continue
+			}
+
 			a.code = append(a.code, ss.inst.Opcode)
 			switch {
 			case ss.inst.Length == 1:
 				a.log("%04X-   %-8s    %s", ss.addr, ss.codeString(), ss.opcode.str)
 			case ss.inst.Mode == cpu.REL:
 				offset, err := relOffset(ss.operand.getValue(), ss.addr+int(ss.inst.Length))
-				if err != nil {
-					a.addError(ss.opcode, "branch offset out of bounds")
+				if err != nil && ss.operand.expr.evaluated {
+					a.addBranchError(ss)
 				}
 				a.code = append(a.code, offset)
 				a.log("%04X-   %-8s    %s   %s", ss.addr, ss.codeString(), ss.opcode.str, ss.operandString())
@@ -679,6 +1134,9 @@ func (a *assembler) generateCode() error {
 
 		case *alignment:
 			pad := make([]byte, ss.pad)
+			for i := range pad {
+				pad[i] = ss.fill
+			}
 			a.code = append(a.code, pad...)
 			a.logBytes(ss.addr, pad)
 
@@ -690,6 +1148,10 @@ func (a *assembler) generateCode() error {
 			a.code = append(a.code, pad...)
 			a.logBytes(ss.addr, pad)
 
+		case *checksum:
+			// The checksum is computed once all code has been generated.
+			a.code = append(a.code, 0)
+
 		case *export:
 			if ss.expr.op != opIdentifier || !ss.expr.address {
 				a.addError(ss.expr.line, "export is not an address label")
@@ -701,6 +1163,60 @@ func (a *assembler) generateCode() error {
 			a.exports = append(a.exports, export)
 		}
 	}
+
+	if a.exportAll {
+		a.exportLabels()
+	}
+	return nil
+}
+
+// Export every global label that hasn't already been exported. Local labels
+// are stored with a leading '~' and aren't exported.
+func (a *assembler) exportLabels() {
+	exported := make(map[string]bool, len(a.exports))
+	for _, e := range a.exports {
+		exported[e.Label] = true
+	}
+	for label, segno := range a.labels {
+		if strings.HasPrefix(label, "~") || exported[label] {
+			continue
+		}
+		a.exports = append(a.exports, Export{
+			Label:   label,
+			Address: uint16(a.segaddr(segno)),
+		})
+	}
+}
+
+// Compute the values of all checksum segments. Each checksum is the 8-bit
+// sum (modulo 256) of all generated bytes from the start address to the end
+// address, inclusive. Checksums are computed in source order, so a checksum
+// byte within the range of an earlier checksum is counted as zero.
+func (a *assembler) computeChecksums() error {
+	// Code generated after an error may not be reliable.
+	if len(a.errors) > 0 {
+		return nil
+	}
+
+	for _, s := range a.segments {
+		ss, ok := s.(*checksum)
+		if !ok {
+			continue
+		}
+
+		start, end := ss.startExpr.value, ss.endExpr.value
+		if start > end || start < a.origin || end >= a.origin+len(a.code) {
+			a.addError(ss.startExpr.line, "checksum range $%04X..$%04X is outside the assembled code", start, end)
+			continue
+		}
+
+		var sum byte
+		for _, b := range a.code[start-a.origin : end-a.origin+1] {
+			sum += b
+		}
+		a.code[ss.addr-a.origin] = sum
+		a.log("%04X  .CHECKSUM $%04X..$%04X = $%02X", ss.addr, start, end, sum)
+	}
 	return nil
 }
 
@@ -725,13 +1241,24 @@ func (a *assembler) parseUnlabeledLine(line fstring) error {
 
 	// Is the next word a pseudo-op, rather than an opcode?
 	word, line := line.consumeWhile(wordChar)
-	if op, ok := pseudoOps[strings.ToLower(word.str)]; ok {
+	if op, ok := a.lookupPseudoOp(word); ok {
 		return op.fn(a, line.consumeWhitespace(), fstring{}, op.param)
 	}
 
 	return a.parseInstruction(word, line)
 }
 
+// Look up the pseudo-op matching a word. In strict mode, only pseudo-ops
+// starting with a dot (and the '=' equate) are recognized, so that bare
+// words like ORG or HEX are always treated as labels or opcodes.
+func (a *assembler) lookupPseudoOp(word fstring) (pseudoOpData, bool) {
+	if a.strict && !word.startsWithChar('.') && word.str != "=" {
+		return pseudoOpData{}, false
+	}
+	op, ok := pseudoOps[strings.ToLower(word.str)]
+	return op, ok
+}
+
 // Parse a line of assembly code that starts with a label.
 func (a *assembler) parseLabeledLine(line fstring) error {
 	a.logLine(line, "labeled_line")
@@ -744,7 +1271,7 @@ func (a *assembler) parseLabeledLine(line fstring) error {
 
 	// Is the next word a pseudo-op, rather than an opcode?
 	word, line := line.consumeWhile(wordChar)
-	if op, ok := pseudoOps[strings.ToLower(word.str)]; ok {
+	if op, ok := a.lookupPseudoOp(word); ok {
 		return op.fn(a, line.consumeWhitespace(), label, op.param)
 	}
 
@@ -784,15 +1311,26 @@ func (a *assembler) storeLabel(label fstring) error {
 	return nil
 }
 
+func (a *assembler) labelStartChar(c byte) bool {
+	return labelStartChar(c) || (a.extLabels && extendedLabelChar(c))
+}
+
+func (a *assembler) labelChar(c byte) bool {
+	return labelChar(c) || (a.extLabels && extendedLabelChar(c))
+}
+
 // Parse a label string at the beginning of a line of assembly code.
 func (a *assembler) parseLabel(line fstring) (label fstring, remain fstring, err error) {
-	if !line.startsWith(labelStartChar) {
+	if !line.startsWith(a.labelStartChar) {
 		s, _ := line.consumeUntil(whitespace)
 		a.addError(line, "invalid label '%s'", s.str)
 		return fstring{}, line, errParse
 	}
 
-	label, line = line.consumeWhile(labelChar)
+	label, line = line.consumeWhile(a.labelChar)
+	if a.ignoreCase {
+		label.str = strings.ToUpper(label.str)
+	}
 
 	// Skip colon after label.
 	if line.startsWithChar(':') {
@@ -816,19 +1354,32 @@ func (a *assembler) parseArch(line, label fstring, param any) error {
 
 	switch {
 	case arch == "6502" || arch == "nmos":
-		a.arch = cpu.NMOS
+		a.setArch(cpu.NMOS)
 	case arch == "65c02" || arch == "cmos":
-		a.arch = cpu.CMOS
+		a.setArch(cpu.CMOS)
 	default:
 		a.addError(line, "invalid architecture '%s'", archl.str)
 		return errParse
 	}
-
-	a.instSet = cpu.GetInstructionSet(a.arch)
 	return nil
 }
 
-// Parse an ".EQU" constant definition.
+// Select the active architecture and update the predefined architecture
+// constant to match it.
+func (a *assembler) setArch(arch cpu.Architecture) {
+	a.arch = arch
+	a.instSet = cpu.GetInstructionSet(arch)
+
+	a.exprParser.arch = 0
+	if arch == cpu.CMOS {
+		a.exprParser.arch = 1
+	}
+}
+
+// Parse an ".EQU" constant definition. An equate that refers to the current
+// address ($ or *) takes the address of the code or data that follows it,
+// so an equate at the top of the file may define addresses relative to the
+// origin.
 func (a *assembler) parseEquate(line, label fstring, param any) error {
 	if label.str == "" {
 		a.addError(line, "equate declaration must begin with a label")
@@ -878,8 +1429,22 @@ func (a *assembler) parseOrigin(line, label fstring, param any) error {
 		return errParse
 	}
 
+	// The origin must be known before addresses are assigned, so it may
+	// only refer to constants defined before it. Evaluate any of those
+	// constants that depend on each other first.
+	a.evaluatePending()
 	if !e.eval(-1, a.constants, a.labels) {
-		a.addError(e.identifier, "unable to evaluate expression")
+		u := e.unresolvedIdentifier()
+		switch {
+		case e.refersToHere(a.constants, make(map[*expr]bool)):
+			a.addError(line, "origin expression can't depend on the current address")
+		case u == nil:
+			a.addError(line, "unable to evaluate origin expression")
+		case a.constants[u.identifierKey()] == nil:
+			a.addError(u.identifier, "origin references '%s', which must be defined before the origin directive", u.identifier.str)
+		default:
+			a.addError(u.identifier, "origin references '%s', which depends on identifiers defined after the origin directive", u.identifier.str)
+		}
 		return errParse
 	}
 
@@ -890,6 +1455,35 @@ func (a *assembler) parseOrigin(line, label fstring, param any) error {
 	return nil
 }
 
+// Parse a ".FILLBYTE" definition, which sets the byte used to fill the
+// gaps left between populated segments by subsequent alignment pseudo-ops.
+func (a *assembler) parseFillByte(line, label fstring, param any) error {
+	a.logLine(line, "fillbyte=")
+
+	e, _, err := a.exprParser.parse(line, a.scopeLabel, allowParentheses)
+	if err != nil {
+		a.addExprErrors()
+		return errParse
+	}
+
+	// The fill byte is needed when code is generated for the gaps that
+	// follow, so it may only refer to constants defined before it.
+	a.evaluatePending()
+	if !e.eval(-1, a.constants, a.labels) {
+		a.addError(line, "fill byte must refer only to constants defined before it")
+		return errParse
+	}
+	if e.value < -128 || e.value > 0xff {
+		a.addError(line, "fill byte value out of range")
+		return errParse
+	}
+
+	a.logLine(line, "val=$%02X", byte(e.value))
+
+	a.fill = byte(e.value)
+	return nil
+}
+
 // Parse a data pseudo-op.
 func (a *assembler) parseData(line, label fstring, param any) error {
 	a.logLine(line, "bytes=")
@@ -902,24 +1496,28 @@ func (a *assembler) parseData(line, label fstring, param any) error {
 
 	remain := line
 	for !remain.isEmpty() {
-		var expr fstring
-		expr, remain = remain.consumeUntilUnquotedChar(',')
+		var item fstring
+		item, remain = remain.consumeUntilUnnestedChar(',')
 
 		if !remain.isEmpty() {
 			remain = remain.consume(1).consumeWhitespace()
 		}
 
-		e, _, err := a.exprParser.parse(expr, a.scopeLabel, allowParentheses|allowStrings)
+		var exprs []*expr
+		var err error
+		switch {
+		case item.findUnquoted("dup", true) >= 0:
+			exprs, err = a.parseDataDup(item)
+		case item.findUnquoted("..", false) >= 0:
+			exprs, err = a.parseDataRange(item)
+		default:
+			exprs, err = a.parseDataExpr(item)
+		}
 		if err != nil {
-			a.addExprErrors()
 			return err
 		}
 
-		if !e.eval(-1, a.constants, a.labels) {
-			a.pushUnevaluated(e)
-		}
-
-		seg.exprs = append(seg.exprs, e)
+		seg.exprs = append(seg.exprs, exprs...)
 	}
 
 	if !label.isEmpty() {
@@ -933,6 +1531,115 @@ func (a *assembler) parseData(line, label fstring, param any) error {
 	return nil
 }
 
+// Parse a single data expression.
+func (a *assembler) parseDataExpr(str fstring) ([]*expr, error) {
+	e, _, err := a.exprParser.parse(str, a.scopeLabel, allowParentheses|allowStrings)
+	if err != nil {
+		a.addExprErrors()
+		return nil, err
+	}
+
+	if !e.eval(-1, a.constants, a.labels) {
+		a.pushUnevaluated(e)
+	}
+
+	return []*expr{e}, nil
+}
+
+// Parse a data repetition of the form "<count> DUP <expr>", which repeats
+// the expression count times. The count must be evaluable when the line is
+// parsed, but the repeated expression may contain forward references.
+func (a *assembler) parseDataDup(str fstring) ([]*expr, error) {
+	i := str.findUnquoted("dup", true)
+	countStr := str.trunc(i)
+	valueStr := str.consume(i + 3).consumeWhitespace()
+
+	count, err := a.parseDataConstant(countStr, "repeat count")
+	if err != nil {
+		return nil, err
+	}
+	if count < 0 || count > 0x10000 {
+		a.addError(countStr, "repeat count out of range")
+		return nil, errParse
+	}
+
+	value, err := a.parseDataExpr(valueStr)
+	if err != nil {
+		return nil, err
+	}
+	if value[0].isString {
+		a.addError(valueStr, "strings may not be repeated")
+		return nil, errParse
+	}
+
+	exprs := make([]*expr, count)
+	for i := range exprs {
+		exprs[i] = value[0]
+	}
+	return exprs, nil
+}
+
+// Parse a data range of the form "<first>..<last>", which produces one
+// value for each integer from first to last. Both endpoints are inclusive
+// and must be evaluable when the line is parsed. The values ascend by 1 if
+// last >= first and descend by 1 otherwise.
+func (a *assembler) parseDataRange(str fstring) ([]*expr, error) {
+	i := str.findUnquoted("..", false)
+	firstStr := str.trunc(i)
+	lastStr := str.consume(i + 2).consumeWhitespace()
+
+	first, err := a.parseDataConstant(firstStr, "range start")
+	if err != nil {
+		return nil, err
+	}
+	last, err := a.parseDataConstant(lastStr, "range end")
+	if err != nil {
+		return nil, err
+	}
+
+	step := 1
+	if last < first {
+		step = -1
+	}
+	if (last-first)*step >= 0x10000 {
+		a.addError(str, "range too large")
+		return nil, errParse
+	}
+
+	var exprs []*expr
+	for v := first; ; v += step {
+		bytes := 1
+		if v < -128 || v > 0xff {
+			bytes = 2
+		}
+		exprs = append(exprs, &expr{
+			line:      str,
+			op:        opNumber,
+			value:     v,
+			bytes:     bytes,
+			evaluated: true,
+		})
+		if v == last {
+			break
+		}
+	}
+	return exprs, nil
+}
+
+// Parse and evaluate an expression whose value must be known at parse time.
+func (a *assembler) parseDataConstant(str fstring, desc string) (int, error) {
+	e, _, err := a.exprParser.parse(str, a.scopeLabel, allowParentheses)
+	if err != nil {
+		a.addExprErrors()
+		return 0, err
+	}
+	if !e.eval(-1, a.constants, a.labels) {
+		a.addError(str, fmt.Sprintf("unable to evaluate %s", desc))
+		return 0, errParse
+	}
+	return e.value, nil
+}
+
 // Parse a hex-string pseudo-op.
 func (a *assembler) parseHexString(line, label fstring, param any) error {
 	a.logLine(line, "hexstring=")
@@ -982,7 +1689,7 @@ func (a *assembler) parseAlign(line, label fstring, param any) error {
 		return errParse
 	}
 
-	seg := &alignment{addr: -1, align: int(v)}
+	seg := &alignment{addr: -1, align: int(v), fill: a.fill}
 
 	a.segments = append(a.segments, seg)
 	return nil
@@ -1042,6 +1749,66 @@ func (a *assembler) parsePadding(line, label fstring, param any) error {
 	return nil
 }
 
+// Parse a format pseudo-op, which selects the output file format. Only raw
+// binary output is currently supported.
+func (a *assembler) parseFormat(line, label fstring, param any) error {
+	formatl, _ := line.consumeWhile(labelChar)
+	format := strings.ToLower(formatl.str)
+
+	switch format {
+	case "raw":
+		a.format = format
+	case "ihex", "srec":
+		a.addError(line, "unsupported output format '%s'", formatl.str)
+		return errParse
+	default:
+		a.addError(line, "invalid output format '%s'", formatl.str)
+		return errParse
+	}
+	return nil
+}
+
+// Parse a checksum pseudo-op
+func (a *assembler) parseChecksum(line, label fstring, param any) error {
+	a.logLine(line, "checksum=")
+
+	s, remain := line.consumeUntilChar(',')
+	if remain.isEmpty() {
+		a.addError(s, "invalid checksum range")
+		return errParse
+	}
+
+	startExpr, _, err := a.exprParser.parse(s, a.scopeLabel, allowParentheses)
+	if err != nil {
+		a.addExprErrors()
+		return err
+	}
+	if !startExpr.eval(-1, a.constants, a.labels) {
+		a.pushUnevaluated(startExpr)
+	}
+
+	s = remain.consume(1).consumeWhitespace()
+	endExpr, _, err := a.exprParser.parse(s, a.scopeLabel, allowParentheses)
+	if err != nil {
+		a.addExprErrors()
+		return err
+	}
+	if !endExpr.eval(-1, a.constants, a.labels) {
+		a.pushUnevaluated(endExpr)
+	}
+
+	if !label.isEmpty() {
+		err := a.storeLabel(label)
+		if err != nil {
+			return err
+		}
+	}
+
+	seg := &checksum{addr: -1, startExpr: startExpr, endExpr: endExpr}
+	a.segments = append(a.segments, seg)
+	return nil
+}
+
 // Parse an export pseudo-op
 func (a *assembler) parseExport(line, label fstring, param any) error {
 	a.logLine(line, "export=")
@@ -1081,19 +1848,73 @@ func (a *assembler) parseInclude(line, label fstring, param any) error {
 		return errParse
 	}
 
-	file, err := os.Open(filename.str)
+	file, path, err := a.openInclude(filename)
 	if err != nil {
-		a.addError(filename, "unable to open '%s'", filename.str)
 		return err
 	}
 	defer file.Close()
 
+	if chain := a.includeChain(file); chain != nil {
+		chain = append(chain, path)
+		a.addError(filename, "circular include of '%s' (%s)", filename.str, strings.Join(chain, " -> "))
+		return errParse
+	}
+
 	fileIndex := len(a.files)
-	a.files = append(a.files, filename.str)
+	a.files = append(a.files, path)
 
 	return a.parseFile(bufio.NewScanner(file), fileIndex)
 }
 
+// If the file is already being parsed, return the chain of files that
+// includes it, starting with the file itself. Otherwise return nil.
+func (a *assembler) includeChain(file *os.File) []string {
+	fi, err := file.Stat()
+	if err != nil {
+		return nil
+	}
+	for i, fileIndex := range a.fileStack {
+		if fi2, err := os.Stat(a.files[fileIndex]); err == nil && os.SameFile(fi, fi2) {
+			var chain []string
+			for _, j := range a.fileStack[i:] {
+				chain = append(chain, a.files[j])
+			}
+			return chain
+		}
+	}
+	return nil
+}
+
+// Open an included file. A relative filename is resolved against the
+// directory of the file containing the include pseudo-op and then against
+// each of the include paths. Return the open file and the path used to open
+// it.
+func (a *assembler) openInclude(filename fstring) (*os.File, string, error) {
+	path := filename.str
+	if !filepath.IsAbs(path) {
+		path = filepath.Join(filepath.Dir(a.files[filename.fileIndex]), path)
+	}
+
+	tried := []string{path}
+	file, err := os.Open(path)
+	if err == nil {
+		return file, path, nil
+	}
+
+	if !filepath.IsAbs(filename.str) {
+		for _, dir := range a.paths {
+			path := filepath.Join(dir, filename.str)
+			tried = append(tried, path)
+			if file, err = os.Open(path); err == nil {
+				return file, path, nil
+			}
+		}
+	}
+
+	a.addError(filename, "unable to open '%s' (tried %s)", filename.str, strings.Join(tried, ", "))
+	return nil, "", err
+}
+
 // Parse a binary include pseudo-op
 func (a *assembler) parseBinaryInclude(line, label fstring, param any) error {
 	a.logLine(line, "binary_include")
@@ -1104,9 +1925,8 @@ func (a *assembler) parseBinaryInclude(line, label fstring, param any) error {
 		return errParse
 	}
 
-	file, err := os.Open(filename.str)
+	file, _, err := a.openInclude(filename)
 	if err != nil {
-		a.addError(filename, "unable to open '%s'", filename.str)
 		return err
 	}
 	defer file.Close()
@@ -1197,7 +2017,7 @@ func (a *assembler) parseOperand(line fstring) (o operand, remain fstring, err e
 			return
 		}
 
-	case line.startsWithChar('A') && (line.startsWithString("A:") || line.startsWithString("ABS:")):
+	case line.startsWithStringFold("A:") || line.startsWithStringFold("ABS:"):
 		o.forceAbsolute = true
 		_, line = line.consumeUntilChar(':')
 		line = line.consume(1)
@@ -1222,7 +2042,7 @@ func (a *assembler) parseOperand(line fstring) (o operand, remain fstring, err e
 	}
 
 	a.logLine(remain, "expr=%s", o.expr)
-	a.logLine(remain, "mode=%s", modeName[o.modeGuess])
+	a.logLine(remain, "mode=%s", o.modeGuess)
 	switch o.expr.evaluated {
 	case true:
 		a.logLine(remain, "val=$%X", o.getValue())
@@ -1317,6 +2137,18 @@ func relOffset(addr1, addr2 int) (byte, error) {
 	}
 }
 
+// Add an error describing a branch instruction whose target is out of
+// range, including the distance to the target and the limit it exceeds.
+func (a *assembler) addBranchError(i *instruction) {
+	diff := i.operand.getValue() - (i.addr + int(i.inst.Length))
+	limit := 127
+	if diff < 0 {
+		limit = -128
+	}
+	target := strings.TrimSpace(i.operand.expr.line.str)
+	a.addError(i.operand.expr.line, "branch to '%s' is %+d bytes, exceeds %+d", target, diff, limit)
+}
+
 // Given an opcode and operand data, select the best 6502
 // instruction match. Prefer the instruction with the shortest
 // total length.
@@ -1366,12 +2198,12 @@ func (a *assembler) findMatchingInstruction(opcode fstring, operand operand) *cp
 // an indirect addressing mode substring is reached. Return
 // the candidate addressing mode and expression substring.
 func (l fstring) consumeIndirect() (mode cpu.Mode, expr fstring, remain fstring, err error) {
-	expr, remain = l.consumeUntil(func(c byte) bool { return c == ',' || c == ')' })
+	expr, remain = l.consumeUntilUnnested(func(c byte) bool { return c == ',' || c == ')' })
 
 	switch {
-	case remain.startsWithString(",X)") || remain.startsWithString(",x)"):
+	case remain.startsWithStringFold(",X)"):
 		mode, remain = cpu.IDX, remain.consume(3)
-	case remain.startsWithString("),Y") || remain.startsWithString("),y"):
+	case remain.startsWithStringFold("),Y"):
 		mode, remain = cpu.IDY, remain.consume(3)
 	case remain.startsWithChar(')'):
 		mode, remain = cpu.IND, remain.consume(1)
@@ -1391,12 +2223,12 @@ func (l fstring) consumeIndirect() (mode cpu.Mode, expr fstring, remain fstring,
 // addressing mode substring is reached. Guess the addressing mode,
 // and return the expression substring.
 func (l fstring) consumeAbsolute() (mode cpu.Mode, expr fstring, remain fstring, err error) {
-	expr, remain = l.consumeUntilChar(',')
+	expr, remain = l.consumeUntilUnnestedChar(',')
 
 	switch {
-	case remain.startsWithString(",X") || remain.startsWithString(",x"):
+	case remain.startsWithStringFold(",X"):
 		mode, remain = cpu.ABX, remain.consume(2)
-	case remain.startsWithString(",Y") || remain.startsWithString(",y"):
+	case remain.startsWithStringFold(",Y"):
 		mode, remain = cpu.ABY, remain.consume(2)
 	default:
 		mode = cpu.ABS
@@ -7,6 +7,7 @@ package asm
 import (
 	"bytes"
 	"os"
+	"path/filepath"
 	"strings"
 	"testing"
 )
@@ -193,6 +194,64 @@ func TestDataBytes(t *testing.T) {
 	checkASM(t, asm, "4142006666CDAB02060AFF7F5555")
 }
 
+func TestDataAddressBytes(t *testing.T) {
+	asm := `
+	.OR $1000
+LO	.DB <ROUTINE1, <ROUTINE2, <ROUTINE3
+HI	.DB >ROUTINE1, >ROUTINE2, >ROUTINE3
+	.DB <BACK, >BACK
+BACK	RTS
+	.DB <(BACK+$100), >(BACK+$100)
+ROUTINE1	RTS
+	.DB 255 DUP 0
+ROUTINE2	LDA LO,X
+ROUTINE3	RTS`
+
+	checkASM(t, asm, "0B0B0E101111081060081160"+
+		strings.Repeat("00", 255)+"BD001060")
+
+	// Lengthening a branch moves the label after the address table has
+	// already been evaluated once.
+	asm = `
+	BEQ FAR
+	.DB <FAR, >FAR
+	.DB 200 DUP 0
+FAR	RTS`
+
+	r := bytes.NewReader([]byte(asm))
+	assembly, _, err := Assemble(r, "test", 0x1000, os.Stdout, LongBranches)
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected := []byte{0xd0, 0x03, 0x4c, 0xcf, 0x10, 0xcf, 0x10}
+	if !bytes.Equal(assembly.Code[:len(expected)], expected) {
+		t.Errorf("expected %X, got %X", expected, assembly.Code[:len(expected)])
+	}
+}
+
+func TestDataRanges(t *testing.T) {
+	asm := `
+	.DB 0..3
+	.DB 3..1, $FF
+N	.EQ 2
+	.DB N..N+1
+	.DW $0100..$0101`
+
+	checkASM(t, asm, "00010203030201FF020300010101")
+}
+
+func TestDataDup(t *testing.T) {
+	asm := `
+	.DB 3 DUP $FF
+	.DB 1, 2 dup X, 4
+	.DW 2 DUP $1234
+X	.EQ $A5`
+
+	checkASM(t, asm, "FFFFFF01A5A50434123412")
+
+	checkASMError(t, ".DB Y DUP 0\nY .EQ 1", "parse error")
+}
+
 func TestDataWords(t *testing.T) {
 	asm := `
 	.DW "AB", $00
@@ -262,6 +321,92 @@ func TestAlign(t *testing.T) {
 	checkASM(t, asm, "FF00FF0000000000FFFF")
 }
 
+func TestFillByte(t *testing.T) {
+	asm := `
+FILL	.EQ $EA
+	.DB $01
+	.FILLBYTE $FF
+	.ALIGN 4
+	.DB $02
+	.FILLBYTE FILL
+	.ALIGN 4
+	.DB $03`
+
+	checkASM(t, asm, "01FFFFFF02EAEAEA03")
+
+	checkASMError(t, ".FILLBYTE $100", "parse error")
+	checkASMError(t, ".FILLBYTE LATER\nLATER .EQ 1", "parse error")
+}
+
+func TestChecksum(t *testing.T) {
+	asm := `
+START	.DB 1, 2, $FF
+END	.DB $10
+	.CHECKSUM START, END`
+
+	checkASM(t, asm, "0102FF1012")
+
+	checkASMError(t, ".CHECKSUM $1000, $2000", "parse error")
+}
+
+func TestFormat(t *testing.T) {
+	checkASM(t, "\t.FORMAT raw\n\tNOP", "EA")
+
+	assembly, _, err := Assemble(strings.NewReader("\tNOP"), "test", 0x1000, os.Stdout, 0)
+	if err != nil || assembly.Format != "raw" {
+		t.Errorf("expected default raw format, got '%s' (%v)", assembly.Format, err)
+	}
+
+	for _, f := range []string{"ihex", "SREC", "elf"} {
+		assembly, _, err := Assemble(strings.NewReader("\t.FORMAT "+f), "test", 0x1000, os.Stdout, 0)
+		if err == nil {
+			t.Errorf("expected error on format %s", f)
+			continue
+		}
+		exp := "unsupported output format '" + f + "'"
+		if f == "elf" {
+			exp = "invalid output format 'elf'"
+		}
+		if len(assembly.Diagnostics) != 1 || assembly.Diagnostics[0].Msg != exp {
+			t.Errorf("expected '%s', got %v", exp, assembly.Errors)
+		}
+	}
+}
+
+func TestSegments(t *testing.T) {
+	asm := `
+	.DB 1, 2, 3
+	.ALIGN 8
+	.DB 4
+	.ALIGN 2
+	.DB 5
+	.PAD $FF, 3
+	.DB 6`
+
+	r := bytes.NewReader([]byte(asm))
+	assembly, _, err := Assemble(r, "test", 0x1000, os.Stdout, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	expected := []Segment{
+		{Addr: 0x1000, Bytes: []byte{1, 2, 3}},
+		{Addr: 0x1008, Bytes: []byte{4}},
+		{Addr: 0x100a, Bytes: []byte{5}},
+		{Addr: 0x100e, Bytes: []byte{6}},
+	}
+	segments := assembly.Segments()
+	if len(segments) != len(expected) {
+		t.Fatalf("expected %d segments, got %d", len(expected), len(segments))
+	}
+	for i, s := range segments {
+		if s.Addr != expected[i].Addr || !bytes.Equal(s.Bytes, expected[i].Bytes) {
+			t.Errorf("segment %d: expected $%04X %v, got $%04X %v",
+				i, expected[i].Addr, expected[i].Bytes, s.Addr, s.Bytes)
+		}
+	}
+}
+
 func TestHereExpression1(t *testing.T) {
 	asm := `
 	.OR $0600
@@ -290,6 +435,108 @@ X	.EQ	$ - 1`
 	checkASM(t, asm, "2C0206")
 }
 
+func TestHereExpression4(t *testing.T) {
+	asm := `
+	.OR $0600
+	LDA *+1
+	.DW 2**, 3*2`
+
+	checkASM(t, asm, "AD0106060C0600")
+}
+
+func TestHereEquates(t *testing.T) {
+	asm := `
+BUFFER	= * + $100
+	.OR $0600
+	LDA BUFFER
+TABLE	.EQU $
+	.DB <TABLE, >TABLE
+END	= *`
+
+	checkASM(t, asm, "AD00070306")
+
+	asm = `
+BUFFER	= *
+	.OR $0600
+	LDA END
+END	= *`
+
+	checkASM(t, asm, "AD0306")
+}
+
+func TestBranchExpressions(t *testing.T) {
+	asm := `
+	.OR $1000
+L	BEQ *+4
+	NOP
+	NOP
+	BNE L+2
+	BCC $+2
+	BPL *
+	BMI L-1+1
+	BVS *-2`
+
+	checkASM(t, asm, "F002EAEAD0FC900010FE30F470FC")
+}
+
+func TestFunctions(t *testing.T) {
+	asm := `
+	.OR $1234
+X	LDA #lo(X)
+	LDX #HI(X)
+	LDY #min(5, max(2, 3))
+	.DB abs(-4), lo(X+1), bank($012345)
+	LDA max(X, $1000),Y
+	LDA (min($10, $20)),Y`
+
+	checkASM(t, asm, "A934A212A003043501B93412B110")
+}
+
+func TestFunctionErrors(t *testing.T) {
+	checkASMError(t, "\tLDA #lo()", "parse error")
+	checkASMError(t, "\tLDA #lo(1, 2)", "parse error")
+	checkASMError(t, "\tLDA #min(1)", "parse error")
+	checkASMError(t, "\tLDA #min(1, 2", "parse error")
+}
+
+func TestOriginConstants(t *testing.T) {
+	asm := `
+SIZE	.EQ BASE+$100
+BASE	.EQ $2000
+	.ORG SIZE
+START	JMP START`
+
+	r := bytes.NewReader([]byte(asm))
+	_, sourceMap, err := Assemble(r, "test", 0x1000, os.Stdout, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if sourceMap.Origin != 0x2100 {
+		t.Errorf("expected origin $2100, got $%04X", sourceMap.Origin)
+	}
+
+	tests := []struct {
+		asm string
+		msg string
+	}{
+		{"\t.ORG BASE\nBASE\t.EQ $2000", "'BASE', which must be defined before"},
+		{"SIZE\t.EQ BASE+1\n\t.ORG SIZE\nBASE\t.EQ $2000", "'SIZE', which depends on identifiers"},
+		{"BASE\t= * + 1\n\t.ORG BASE\n\tNOP", "can't depend on the current address"},
+		{"\t.ORG *\n\tNOP", "can't depend on the current address"},
+	}
+	for _, test := range tests {
+		r := bytes.NewReader([]byte(test.asm))
+		a, _, err := Assemble(r, "test", 0x1000, os.Stdout, 0)
+		if err == nil {
+			t.Errorf("expected error on %q, didn't get one", test.asm)
+			continue
+		}
+		if len(a.Errors) != 1 || !strings.Contains(a.Errors[0], test.msg) {
+			t.Errorf("expected error containing %q, got %v", test.msg, a.Errors)
+		}
+	}
+}
+
 var asm65c02 = `	PHX
 	PHY
 	PLX
@@ -319,6 +566,748 @@ var asm65c02 = `	PHX
 	LDA ($01)
 	STA ($01)`
 
+func TestMixedCase(t *testing.T) {
+	asm := `
+	.org $1000
+Start	lda #0x12
+	Ldx $FF,y
+	sta abs:$01
+	lda (0B1010),Y
+	.Db "Hello", 'a'
+	jmp Start`
+
+	checkASM(t, asm, "A912B6FF8D0100B10A48656C6C6F614C0010")
+}
+
+func TestIgnoreCase(t *testing.T) {
+	code := `
+	.org $1000
+Start	lda #Value
+loop	dex
+	bne .next
+.Next	jmp LOOP
+	jmp start
+value	.eq 'a'`
+
+	r := strings.NewReader(code)
+	assembly, _, err := Assemble(r, "test", 0x1000, os.Stdout, IgnoreCase)
+	if err != nil {
+		t.Fatal(err)
+	}
+	exp := []byte{0xa9, 0x61, 0xca, 0xd0, 0x00, 0x4c, 0x02, 0x10, 0x4c, 0x00, 0x10}
+	if !bytes.Equal(assembly.Code, exp) {
+		t.Errorf("code incorrect. exp: % X, got: % X", exp, assembly.Code)
+	}
+
+	// Without the option, labels are case-sensitive.
+	checkASMError(t, code, "parse error")
+}
+
+func TestBranchOutOfRange(t *testing.T) {
+	asm := `
+	BEQ FAR
+	.DB 140 DUP 0
+FAR	NOP`
+
+	r := bytes.NewReader([]byte(asm))
+	assembly, _, err := Assemble(r, "test", 0x1000, os.Stdout, 0)
+	if err == nil {
+		t.Fatal("expected branch error")
+	}
+	exp := "Syntax error in 'test' line 2, col 13: branch to 'FAR' is +140 bytes, exceeds +127"
+	if len(assembly.Errors) != 1 || assembly.Errors[0] != exp {
+		t.Errorf("expected '%s', got %v", exp, assembly.Errors)
+	}
+}
+
+func TestLongBranches(t *testing.T) {
+	asm := `
+	.ARCH 65C02
+START	BEQ FAR
+	BCC START
+	BRA FAR
+	.DB 140 DUP 0
+FAR	BNE START`
+
+	r := bytes.NewReader([]byte(asm))
+	assembly, _, err := Assemble(r, "test", 0x1000, os.Stdout, LongBranches)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	expected := []byte{
+		0xd0, 0x03, 0x4c, 0x96, 0x10, // BEQ FAR
+		0x90, 0xf9, // BCC START
+		0x4c, 0x96, 0x10, // BRA FAR
+	}
+	code := assembly.Code
+	if !bytes.Equal(code[:len(expected)], expected) {
+		t.Errorf("expected %X, got %X", expected, code[:len(expected)])
+	}
+	tail := []byte{0xf0, 0x03, 0x4c, 0x00, 0x10} // BNE START
+	if !bytes.Equal(code[len(code)-len(tail):], tail) {
+		t.Errorf("expected %X, got %X", tail, code[len(code)-len(tail):])
+	}
+}
+
+func TestStrictPseudoOps(t *testing.T) {
+	asm := `
+	.ORG $1000
+	.HEX 0102
+X	.EQ 3
+Y	= 4
+	.DB X, Y`
+
+	r := bytes.NewReader([]byte(asm))
+	assembly, _, err := Assemble(r, "test", 0x1000, os.Stdout, StrictPseudoOps)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(assembly.Code, []byte{0x01, 0x02, 0x03, 0x04}) {
+		t.Errorf("unexpected code % X", assembly.Code)
+	}
+
+	for _, line := range []string{"\tORG $1000", "\tHEX 0102", "X\tEQU 3", "\tEXP X\nX\tNOP"} {
+		if _, err = assemble(line); err != nil {
+			t.Errorf("unexpected error on '%s': %v", line, err)
+		}
+		r = bytes.NewReader([]byte(line))
+		_, _, err = Assemble(r, "test", 0x1000, os.Stdout, StrictPseudoOps)
+		if err == nil {
+			t.Errorf("expected error on '%s' in strict mode", line)
+		}
+	}
+}
+
+func TestExtendedLabels(t *testing.T) {
+	asm := `
+	.ORG $1000
+READY?	.EQ $10
+?loop	LDA READY?
+	BNE ?loop
+done!	JMP done!`
+
+	r := bytes.NewReader([]byte(asm))
+	assembly, _, err := Assemble(r, "test", 0x1000, os.Stdout, ExtendedLabels)
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected := []byte{0xa5, 0x10, 0xd0, 0xfc, 0x4c, 0x04, 0x10}
+	if !bytes.Equal(assembly.Code, expected) {
+		t.Errorf("unexpected code % X", assembly.Code)
+	}
+
+	if _, err := assemble(asm); err == nil {
+		t.Error("expected error without the ExtendedLabels option")
+	}
+}
+
+func TestIncludePaths(t *testing.T) {
+	dir := t.TempDir()
+	err := os.WriteFile(filepath.Join(dir, "inc_test.asm"), []byte("\tLDA #$01\n"), 0600)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	asm := `
+	.INCLUDE inc_test.asm
+	RTS`
+
+	r := bytes.NewReader([]byte(asm))
+	assembly, _, err := Assemble(r, "test", 0x1000, os.Stdout, 0, "missing", dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(assembly.Code, []byte{0xa9, 0x01, 0x60}) {
+		t.Errorf("unexpected code %X", assembly.Code)
+	}
+
+	r = bytes.NewReader([]byte("\t.INCLUDE nofile.asm"))
+	assembly, _, err = Assemble(r, "test", 0x1000, os.Stdout, 0, "missing")
+	if err == nil {
+		t.Fatal("expected include error")
+	}
+	exp := "Syntax error in 'test' line 1, col 18: unable to open 'nofile.asm' (tried nofile.asm, " +
+		filepath.Join("missing", "nofile.asm") + ")"
+	if len(assembly.Errors) != 1 || assembly.Errors[0] != exp {
+		t.Errorf("expected '%s', got %v", exp, assembly.Errors)
+	}
+}
+
+func TestRelativeIncludes(t *testing.T) {
+	dir := t.TempDir()
+	files := map[string]string{
+		"main.asm":      "\t.INCLUDE sub/a.asm\n\tRTS\n",
+		"sub/a.asm":     "\tLDA #$01\n\t.INCLUDE lib/b.asm\n",
+		"sub/lib/b.asm": "\tLDX #$02\n",
+	}
+	for name, contents := range files {
+		path := filepath.Join(dir, filepath.FromSlash(name))
+		if err := os.MkdirAll(filepath.Dir(path), 0700); err != nil {
+			t.Fatal(err)
+		}
+		if err := os.WriteFile(path, []byte(contents), 0600); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	mainPath := filepath.Join(dir, "main.asm")
+	file, err := os.Open(mainPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer file.Close()
+
+	assembly, sourceMap, err := Assemble(file, mainPath, 0x1000, os.Stdout, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(assembly.Code, []byte{0xa9, 0x01, 0xa2, 0x02, 0x60}) {
+		t.Errorf("unexpected code %X", assembly.Code)
+	}
+
+	expected := []string{
+		mainPath,
+		filepath.Join(dir, "sub", "a.asm"),
+		filepath.Join(dir, "sub", "lib", "b.asm"),
+	}
+	if len(sourceMap.Files) != len(expected) {
+		t.Fatalf("expected files %v, got %v", expected, sourceMap.Files)
+	}
+	for i := range expected {
+		if sourceMap.Files[i] != expected[i] {
+			t.Errorf("expected file %s, got %s", expected[i], sourceMap.Files[i])
+		}
+	}
+}
+
+func TestCircularInclude(t *testing.T) {
+	dir := t.TempDir()
+	files := map[string]string{
+		"self.asm": "\tNOP\n\t.INCLUDE self.asm\n",
+		"a.asm":    "\tNOP\n\t.INCLUDE b.asm\n",
+		"b.asm":    "\tNOP\n\t.INCLUDE a.asm\n",
+	}
+	for name, contents := range files {
+		if err := os.WriteFile(filepath.Join(dir, name), []byte(contents), 0600); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	a, b, self := filepath.Join(dir, "a.asm"), filepath.Join(dir, "b.asm"), filepath.Join(dir, "self.asm")
+	tests := []struct {
+		path string
+		exp  string
+	}{
+		{self, "Syntax error in '" + self + "' line 2, col 18: circular include of 'self.asm' (" +
+			self + " -> " + self + ")"},
+		{a, "Syntax error in '" + b + "' line 2, col 18: circular include of 'a.asm' (" +
+			a + " -> " + b + " -> " + a + ")"},
+	}
+	for _, test := range tests {
+		file, err := os.Open(test.path)
+		if err != nil {
+			t.Fatal(err)
+		}
+		assembly, _, err := Assemble(file, test.path, 0x1000, os.Stdout, 0)
+		file.Close()
+		if err == nil {
+			t.Errorf("%s: expected circular include error", test.path)
+			continue
+		}
+		if len(assembly.Errors) != 1 || assembly.Errors[0] != test.exp {
+			t.Errorf("expected '%s', got %v", test.exp, assembly.Errors)
+		}
+	}
+}
+
+func TestSymbols(t *testing.T) {
+	asm := `
+COUNT	.EQ $10
+START	LDX #COUNT
+.loop	DEX
+	BNE .loop
+	RTS`
+
+	r := bytes.NewReader([]byte(asm))
+	_, sourceMap, err := Assemble(r, "test", 0x1000, os.Stdout, MapSymbols)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	expected := []Export{
+		{Label: "COUNT", Address: 0x0010},
+		{Label: "START", Address: 0x1000},
+		{Label: "START.loop", Address: 0x1002},
+	}
+	if len(sourceMap.Symbols) != len(expected) {
+		t.Fatalf("expected symbols %v, got %v", expected, sourceMap.Symbols)
+	}
+	for i := range expected {
+		if sourceMap.Symbols[i] != expected[i] {
+			t.Errorf("expected symbol %v, got %v", expected[i], sourceMap.Symbols[i])
+		}
+	}
+
+	var b bytes.Buffer
+	if _, err := sourceMap.WriteTo(&b); err != nil {
+		t.Fatal(err)
+	}
+	var s2 SourceMap
+	if _, err := s2.ReadFrom(&b); err != nil {
+		t.Fatal(err)
+	}
+	if len(s2.Symbols) != len(expected) || s2.Symbols[2] != expected[2] {
+		t.Errorf("expected symbols %v, got %v", expected, s2.Symbols)
+	}
+}
+
+func TestExportAll(t *testing.T) {
+	asm := `
+COUNT	.EQ $10
+	.EX START
+START	LDX #COUNT
+.loop	DEX
+	BNE .loop
+DONE	RTS`
+
+	r := bytes.NewReader([]byte(asm))
+	_, sourceMap, err := Assemble(r, "test", 0x1000, os.Stdout, ExportAll)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	expected := []Export{
+		{Label: "START", Address: 0x1000},
+		{Label: "DONE", Address: 0x1005},
+	}
+	if len(sourceMap.Exports) != len(expected) {
+		t.Fatalf("expected exports %v, got %v", expected, sourceMap.Exports)
+	}
+	for i := range expected {
+		if sourceMap.Exports[i] != expected[i] {
+			t.Errorf("expected export %v, got %v", expected[i], sourceMap.Exports[i])
+		}
+	}
+}
+
+func TestSymbolFiles(t *testing.T) {
+	asm := `
+COUNT	.EQ $10
+START	LDX #COUNT
+.loop	DEX
+	BNE .loop
+	RTS`
+
+	r := bytes.NewReader([]byte(asm))
+	_, sourceMap, err := Assemble(r, "test", 0x1000, os.Stdout, MapSymbols)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var b bytes.Buffer
+	if _, err := sourceMap.WriteSymbolsVICE(&b); err != nil {
+		t.Fatal(err)
+	}
+	expected := "al C:0010 .COUNT\nal C:1000 .START\nal C:1002 .START_loop\n"
+	if b.String() != expected {
+		t.Errorf("unexpected VICE labels:\n%s", b.String())
+	}
+
+	b.Reset()
+	if _, err := sourceMap.WriteSymbolsNoCash(&b); err != nil {
+		t.Fatal(err)
+	}
+	expected = "00:0010 COUNT\n00:1000 START\n00:1002 START.loop\n"
+	if b.String() != expected {
+		t.Errorf("unexpected no$ symbols:\n%s", b.String())
+	}
+}
+
+func TestComments(t *testing.T) {
+	asm := `
+; whole-line comment
+START	LDA #';'	; load a semicolon
+	NOP
+	RTS ;done`
+
+	r := bytes.NewReader([]byte(asm))
+	_, sourceMap, err := Assemble(r, "test", 0x1000, os.Stdout, MapComments)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	expected := []Comment{
+		{Address: 0x1000, Text: "load a semicolon"},
+		{Address: 0x1003, Text: "done"},
+	}
+
+	var b bytes.Buffer
+	if _, err := sourceMap.WriteTo(&b); err != nil {
+		t.Fatal(err)
+	}
+	var s2 SourceMap
+	if _, err := s2.ReadFrom(&b); err != nil {
+		t.Fatal(err)
+	}
+
+	if len(s2.Comments) != len(expected) {
+		t.Fatalf("expected comments %v, got %v", expected, s2.Comments)
+	}
+	for i := range expected {
+		if s2.Comments[i] != expected[i] {
+			t.Errorf("expected comment %v, got %v", expected[i], s2.Comments[i])
+		}
+	}
+	if _, ok := s2.FindComment(0x1002); ok {
+		t.Error("unexpected comment at $1002")
+	}
+}
+
+func TestSourceMapData(t *testing.T) {
+	asm := `
+START	LDA TABLE
+	RTS
+TABLE	.DB 1,2,3
+	.DB 4
+WORDS	.DW $1234,START
+MSG	.DW "ab"
+	.HEX 0102
+	NOP`
+
+	r := bytes.NewReader([]byte(asm))
+	_, sourceMap, err := Assemble(r, "test", 0x1000, os.Stdout, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	expected := []DataRange{
+		{Address: 0x1004, Size: 4, Unit: 1},
+		{Address: 0x1008, Size: 4, Unit: 2},
+		{Address: 0x100c, Size: 4, Unit: 1},
+	}
+
+	var b bytes.Buffer
+	if _, err := sourceMap.WriteTo(&b); err != nil {
+		t.Fatal(err)
+	}
+	var s2 SourceMap
+	if _, err := s2.ReadFrom(&b); err != nil {
+		t.Fatal(err)
+	}
+
+	if len(s2.Data) != len(expected) {
+		t.Fatalf("expected data ranges %v, got %v", expected, s2.Data)
+	}
+	for i := range expected {
+		if s2.Data[i] != expected[i] {
+			t.Errorf("expected data range %v, got %v", expected[i], s2.Data[i])
+		}
+	}
+
+	if _, ok := s2.FindData(0x1003); ok {
+		t.Error("unexpected data range at $1003")
+	}
+	if d, ok := s2.FindData(0x100a); !ok || d != expected[1] {
+		t.Errorf("expected data range %v at $100A, got %v", expected[1], d)
+	}
+	if _, ok := s2.FindData(0x1010); ok {
+		t.Error("unexpected data range at $1010")
+	}
+
+	s2.ClearRange(0x1006, 0x0007)
+	trimmed := []DataRange{
+		{Address: 0x1004, Size: 2, Unit: 1},
+		{Address: 0x100d, Size: 3, Unit: 1},
+	}
+	if len(s2.Data) != len(trimmed) || s2.Data[0] != trimmed[0] || s2.Data[1] != trimmed[1] {
+		t.Errorf("expected trimmed data ranges %v, got %v", trimmed, s2.Data)
+	}
+}
+
+func TestStats(t *testing.T) {
+	asm := `
+COUNT	.EQ $10
+START	LDX #COUNT
+.loop	DEX
+	BNE .loop
+	RTS
+DATA	.DB 1,2,3`
+
+	r := bytes.NewReader([]byte(asm))
+	assembly, _, err := Assemble(r, "test", 0x1000, os.Stdout, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	expected := Stats{Bytes: 9, Instructions: 4, Labels: 3, Start: 0x1000, End: 0x1008}
+	if assembly.Stats != expected {
+		t.Errorf("expected %+v, got %+v", expected, assembly.Stats)
+	}
+}
+
+func TestAssembleFileResult(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "prog.asm")
+	err := os.WriteFile(path, []byte("\tLDA #$01\n\tRTS\n"), 0600)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var out bytes.Buffer
+	result, err := AssembleFileResult(path, 0, &out)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(result.Assembly.Code, []byte{0xa9, 0x01, 0x60}) {
+		t.Errorf("unexpected code %X", result.Assembly.Code)
+	}
+	if len(result.SourceMap.Lines) != 3 {
+		t.Errorf("expected 3 source lines, got %d", len(result.SourceMap.Lines))
+	}
+
+	code, err := os.ReadFile(result.BinPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(code, result.Assembly.Code) {
+		t.Errorf("binary file contents %X don't match assembly", code)
+	}
+	if _, err := os.Stat(result.MapPath); err != nil {
+		t.Error(err)
+	}
+}
+
+func TestAssembleFileTo(t *testing.T) {
+	dir := t.TempDir()
+	path := filepath.Join(dir, "prog.asm")
+	err := os.WriteFile(path, []byte("\tNOP\n"), 0600)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var out bytes.Buffer
+	outPath := filepath.Join(dir, "build", "out.bin")
+	if err := os.Mkdir(filepath.Dir(outPath), 0700); err != nil {
+		t.Fatal(err)
+	}
+	result, err := AssembleFileTo(path, outPath, 0, &out)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	expected := filepath.Join(dir, "build", "out")
+	if result.BinPath != expected+".bin" || result.MapPath != expected+".map" {
+		t.Errorf("unexpected output paths %s and %s", result.BinPath, result.MapPath)
+	}
+	if _, err := os.Stat(filepath.Join(dir, "prog.bin")); err == nil {
+		t.Error("binary file written alongside the input file")
+	}
+}
+
+func TestAssembleFiles(t *testing.T) {
+	dir := t.TempDir()
+	mainPath := filepath.Join(dir, "main.asm")
+	libPath := filepath.Join(dir, "lib.asm")
+	err := os.WriteFile(mainPath, []byte("\t.OR $1000\nSTART\tJSR INC2\n\tJMP START\n"), 0600)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = os.WriteFile(libPath, []byte("INC2\tINX\n\tINX\n\tBNE START\n\tRTS\n"), 0600)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var out bytes.Buffer
+	result, err := AssembleFiles([]string{mainPath, libPath}, "", 0, &out)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if result.BinPath != filepath.Join(dir, "main.bin") {
+		t.Errorf("unexpected binary path %s", result.BinPath)
+	}
+
+	expected := []byte{0x20, 0x06, 0x10, 0x4c, 0x00, 0x10, 0xe8, 0xe8, 0xd0, 0xf6, 0x60}
+	if !bytes.Equal(result.Assembly.Code, expected) {
+		t.Errorf("code incorrect:\n  got:  % x\n  want: % x", result.Assembly.Code, expected)
+	}
+
+	sourceMap := result.SourceMap
+	tests := []struct {
+		addr int
+		file string
+		line int
+	}{
+		{0x1000, mainPath, 2},
+		{0x1003, mainPath, 3},
+		{0x1006, libPath, 1},
+		{0x100a, libPath, 4},
+	}
+	for _, test := range tests {
+		file, line, err := sourceMap.Find(test.addr)
+		if err != nil {
+			t.Error(err)
+		} else if file != test.file || line != test.line {
+			t.Errorf("$%04X: expected %s:%d, got %s:%d", test.addr, test.file, test.line, file, line)
+		}
+	}
+}
+
+func TestFindByLine(t *testing.T) {
+	asm := `
+START	LDX #$10
+
+	; comment
+	DEX
+	RTS`
+
+	r := bytes.NewReader([]byte(asm))
+	_, sourceMap, err := Assemble(r, "test", 0x1000, os.Stdout, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		line int
+		addr int
+	}{
+		{2, 0x1000},
+		{3, 0x1002},
+		{5, 0x1002},
+		{6, 0x1003},
+	}
+	for _, test := range tests {
+		addr, err := sourceMap.FindByLine("test", test.line)
+		if err != nil {
+			t.Error(err)
+		} else if addr != test.addr {
+			t.Errorf("line %d: expected $%04X, got $%04X", test.line, test.addr, addr)
+		}
+	}
+
+	if _, err := sourceMap.FindByLine("test", 7); err == nil {
+		t.Error("expected error for line without code")
+	}
+	if _, err := sourceMap.FindByLine("missing", 2); err == nil {
+		t.Error("expected error for missing file")
+	}
+}
+
+func TestEndOfFileLine(t *testing.T) {
+	asm := `
+	LDA #$01
+	RTS
+TABLE	.DB 1, 2
+END`
+
+	r := bytes.NewReader([]byte(asm))
+	_, sourceMap, err := Assemble(r, "test", 0x1000, os.Stdout, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	file, line, err := sourceMap.Find(0x1005)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if file != "test" || line != 5 {
+		t.Errorf("expected test:5, got %s:%d", file, line)
+	}
+}
+
+func TestSourceMapMerge(t *testing.T) {
+	asmA := `
+	.OR $1000
+A1	LDA #$01
+A2	LDA #$02
+	.EX A2
+A3	LDA #$03
+A4	RTS
+	.EX A4`
+
+	asmB := `
+	.OR $1004
+B1	LDX #$01
+	.EX B1`
+
+	r := bytes.NewReader([]byte(asmA))
+	_, mapA, err := Assemble(r, "a.asm", 0x1000, os.Stdout, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	r = bytes.NewReader([]byte(asmB))
+	_, mapB, err := Assemble(r, "b.asm", 0x1000, os.Stdout, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	mapA.Merge(mapB)
+
+	expected := []struct {
+		addr int
+		file string
+		line int
+	}{
+		{0x1000, "a.asm", 3},
+		{0x1002, "a.asm", 4},
+		{0x1004, "b.asm", 3},
+		{0x1006, "a.asm", 7},
+		{0x1007, "a.asm", 8},
+	}
+	if len(mapA.Lines) != len(expected) {
+		t.Fatalf("expected %d lines, got %d", len(expected), len(mapA.Lines))
+	}
+	for _, e := range expected {
+		file, line, err := mapA.Find(e.addr)
+		if err != nil {
+			t.Error(err)
+		} else if file != e.file || line != e.line {
+			t.Errorf("$%04X: expected %s:%d, got %s:%d", e.addr, e.file, e.line, file, line)
+		}
+	}
+
+	exports := []Export{{"A2", 0x1002}, {"B1", 0x1004}, {"A4", 0x1006}}
+	if len(mapA.Exports) != len(exports) {
+		t.Fatalf("expected exports %v, got %v", exports, mapA.Exports)
+	}
+	for i := range exports {
+		if mapA.Exports[i] != exports[i] {
+			t.Errorf("expected export %v, got %v", exports[i], mapA.Exports[i])
+		}
+	}
+}
+
+func TestArchSymbol(t *testing.T) {
+	asm := `
+	.DB __CPU__
+	.ARCH 65c02
+	.DB __CPU__, __CPU__ * 2
+	LDA #__CPU__
+	.ARCH 6502
+	.DB __CPU__`
+
+	checkASM(t, asm, "000102A90100")
+
+	// Expressions reevaluated after a later .ARCH, as when a branch is
+	// lengthened, keep the value of the architecture active where they are
+	// used.
+	asm = `
+	.DB __CPU__ + LATER - LATER
+	BEQ FAR
+	.ARCH 65c02
+LATER	.DB __CPU__
+	.DB 140 DUP 0
+FAR	NOP`
+
+	r := strings.NewReader(asm)
+	assembly, _, err := Assemble(r, "test", 0x1000, os.Stdout, LongBranches)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if assembly.Code[0] != 0 || assembly.Code[6] != 1 {
+		t.Errorf("architecture constants incorrect. exp: 00, 01, got: %02X, %02X", assembly.Code[0], assembly.Code[6])
+	}
+}
+
 func Test65c02(t *testing.T) {
 	prefix := `
 	.ARCH 65c02
@@ -338,3 +1327,53 @@ func Test65c02FailOn6502(t *testing.T) {
 		checkASMError(t, prefix+line, "parse error")
 	}
 }
+
+func TestAllErrors(t *testing.T) {
+	asm := `
+	.ORG $1000
+	LDA ($10)
+	STA #$20
+	BNE missing
+	JSR ($1234)
+	RTS`
+
+	r := bytes.NewReader([]byte(asm))
+	assembly, _, err := Assemble(r, "test", 0x1000, os.Stdout, 0)
+	if err == nil {
+		t.Fatal("expected error")
+	}
+	if len(assembly.Errors) != 1 {
+		t.Errorf("expected 1 error without AllErrors, got %d", len(assembly.Errors))
+	}
+
+	r = bytes.NewReader([]byte(asm))
+	assembly, _, err = Assemble(r, "test", 0x1000, os.Stdout, AllErrors)
+	if err == nil {
+		t.Fatal("expected error")
+	}
+	if len(assembly.Errors) != 4 {
+		t.Errorf("expected 4 errors with AllErrors, got %d", len(assembly.Errors))
+		for _, e := range assembly.Errors {
+			t.Log(e)
+		}
+	}
+}
+
+func TestDiagnostics(t *testing.T) {
+	asm := `
+	.ORG $1000
+	STA #$20`
+
+	r := bytes.NewReader([]byte(asm))
+	assembly, _, err := Assemble(r, "test.asm", 0x1000, os.Stdout, 0)
+	if err == nil {
+		t.Fatal("expected error")
+	}
+	if len(assembly.Diagnostics) != 1 {
+		t.Fatalf("expected 1 diagnostic, got %d", len(assembly.Diagnostics))
+	}
+	exp := "test.asm:3:9: invalid addressing mode for opcode 'STA'"
+	if s := assembly.Diagnostics[0].String(); s != exp {
+		t.Errorf("exp %q, got %q", exp, s)
+	}
+}
@@ -7,6 +7,7 @@ package asm
 import (
 	"fmt"
 	"strconv"
+	"strings"
 )
 
 //
@@ -47,6 +48,9 @@ const (
 	// pseudo-ops (20..21) (used only during parsing but not stored in expr's)
 	opLeftParen
 	opRightParen
+
+	// function call (22)
+	opFunction
 )
 
 type opdata struct {
@@ -96,6 +100,9 @@ var ops = []opdata{
 	// pseudo-operations
 	{0, 0, false, "", nil}, // lparen
 	{0, 0, false, "", nil}, // rparen
+
+	// function call
+	{0, 0, false, "", nil}, // function
 }
 
 func (op exprOp) isBinary() bool {
@@ -124,6 +131,38 @@ func (op exprOp) collapses(other exprOp) bool {
 	return ops[op].precedence < ops[other].precedence
 }
 
+//
+// exprFunc
+//
+
+// An exprFunc describes a built-in function that may be called from
+// within an expression.
+type exprFunc struct {
+	name string
+	args int
+	eval func(v []int) int
+}
+
+var exprFuncs = []*exprFunc{
+	{"lo", 1, func(v []int) int { return v[0] & 0xff }},
+	{"hi", 1, func(v []int) int { return (v[0] >> 8) & 0xff }},
+	{"bank", 1, func(v []int) int { return (v[0] >> 16) & 0xff }},
+	{"abs", 1, func(v []int) int { return absInt(v[0]) }},
+	{"min", 2, func(v []int) int { return minInt(v[0], v[1]) }},
+	{"max", 2, func(v []int) int { return maxInt(v[0], v[1]) }},
+}
+
+// Return the built-in function with the requested name. Function names are
+// case-insensitive.
+func lookupFunc(name string) *exprFunc {
+	for _, f := range exprFuncs {
+		if strings.EqualFold(f.name, name) {
+			return f
+		}
+	}
+	return nil
+}
+
 //
 // expr
 //
@@ -138,18 +177,20 @@ const (
 // An expr represents a single node in a binary expression tree.
 // The root node represents an entire expression.
 type expr struct {
-	line          fstring // start of expression line
-	op            exprOp  // type of expression
-	value         int     // resolved value
-	bytes         int     // number of bytes to hold the value
-	address       bool    // true if value is an address
-	evaluated     bool    // true if value has been evaluated
-	isString      bool    // true if expr is a string literal (not a value)
-	stringLiteral fstring // if op == opString
-	identifier    fstring // if op == opIdentifier
-	scopeLabel    fstring // active scope label when parsing began
-	child0        *expr   // first child in expression tree
-	child1        *expr   // second child in expression tree (parent must be binary op)
+	line          fstring   // start of expression line
+	op            exprOp    // type of expression
+	value         int       // resolved value
+	bytes         int       // number of bytes to hold the value
+	address       bool      // true if value is an address
+	evaluated     bool      // true if value has been evaluated
+	isString      bool      // true if expr is a string literal (not a value)
+	stringLiteral fstring   // if op == opString
+	identifier    fstring   // if op == opIdentifier
+	fn            *exprFunc // if op == opFunction
+	args          []*expr   // function arguments (if op == opFunction)
+	scopeLabel    fstring   // active scope label when parsing began
+	child0        *expr     // first child in expression tree
+	child1        *expr     // second child in expression tree (parent must be binary op)
 }
 
 // Return the expression as a postfix notation string.
@@ -166,6 +207,12 @@ func (e *expr) String() string {
 		return e.identifier.str
 	case e.op == opHere:
 		return "$"
+	case e.op == opFunction:
+		var s []string
+		for _, a := range e.args {
+			s = append(s, a.String())
+		}
+		return fmt.Sprintf("%s %s()", strings.Join(s, " "), e.fn.name)
 	case e.op.isBinary():
 		return fmt.Sprintf("%s %s %s", e.child0.String(), e.child1.String(), e.op.symbol())
 	case !e.op.isBinary():
@@ -175,6 +222,71 @@ func (e *expr) String() string {
 	}
 }
 
+// Mark the expression tree as unevaluated, so that it may be evaluated again
+// after the addresses of labels have changed.
+func (e *expr) reset() {
+	if e.op == opNumber || e.op == opString {
+		return
+	}
+	e.evaluated = false
+	if e.child0 != nil {
+		e.child0.reset()
+	}
+	if e.child1 != nil {
+		e.child1.reset()
+	}
+	for _, a := range e.args {
+		a.reset()
+	}
+}
+
+// Return the key used to look up an identifier expression in the constant
+// and label tables. Local identifiers are prefixed by their scope label.
+func (e *expr) identifierKey() string {
+	if e.identifier.startsWithChar('.') || e.identifier.startsWithChar('@') {
+		return "~" + e.scopeLabel.str + e.identifier.str
+	}
+	return e.identifier.str
+}
+
+// Return the first unevaluated identifier in the expression tree, or nil
+// if there is none.
+func (e *expr) unresolvedIdentifier() *expr {
+	if e == nil || e.evaluated {
+		return nil
+	}
+	if e.op == opIdentifier {
+		return e
+	}
+	for _, c := range append([]*expr{e.child0, e.child1}, e.args...) {
+		if u := c.unresolvedIdentifier(); u != nil {
+			return u
+		}
+	}
+	return nil
+}
+
+// Return true if the expression tree refers to the current address ($ or
+// *), either directly or through the constants it references.
+func (e *expr) refersToHere(constants map[string]*expr, seen map[*expr]bool) bool {
+	if e == nil || seen[e] {
+		return false
+	}
+	seen[e] = true
+	switch e.op {
+	case opHere:
+		return true
+	case opIdentifier:
+		return constants[e.identifierKey()].refersToHere(constants, seen)
+	}
+	for _, c := range append([]*expr{e.child0, e.child1}, e.args...) {
+		if c.refersToHere(constants, seen) {
+			return true
+		}
+	}
+	return false
+}
+
 // Evaluate the expression tree.
 func (e *expr) eval(addr int, constants map[string]*expr, labels map[string]int) bool {
 	if !e.evaluated {
@@ -186,13 +298,7 @@ func (e *expr) eval(addr int, constants map[string]*expr, labels map[string]int)
 			e.evaluated = true
 
 		case e.op == opIdentifier:
-			var ident string
-			switch {
-			case e.identifier.startsWithChar('.') || e.identifier.startsWithChar('@'):
-				ident = "~" + e.scopeLabel.str + e.identifier.str
-			default:
-				ident = e.identifier.str
-			}
+			ident := e.identifierKey()
 			if m, ok := constants[ident]; ok {
 				e.bytes = maxInt(e.bytes, m.bytes)
 				if m.address {
@@ -211,6 +317,27 @@ func (e *expr) eval(addr int, constants map[string]*expr, labels map[string]int)
 				e.value, e.bytes, e.address, e.evaluated = addr, 2, true, true
 			}
 
+		case e.op == opFunction:
+			evaluated, values := true, make([]int, len(e.args))
+			for i, a := range e.args {
+				if a.eval(addr, constants, labels) {
+					values[i] = a.value
+					e.bytes = maxInt(e.bytes, a.bytes)
+				} else {
+					evaluated = false
+				}
+				if a.address {
+					e.address = true
+				}
+			}
+			if evaluated {
+				e.value = e.fn.eval(values)
+				e.evaluated = true
+			}
+			if e.address {
+				e.bytes = 2
+			}
+
 		case e.op.isBinary():
 			e.child0.eval(addr, constants, labels)
 			e.child1.eval(addr, constants, labels)
@@ -253,6 +380,8 @@ const (
 	tokenHere
 	tokenLeftParen
 	tokenRightParen
+	tokenFunction
+	tokenComma
 )
 
 func (tt tokentype) isValue() bool {
@@ -260,7 +389,8 @@ func (tt tokentype) isValue() bool {
 }
 
 func (tt tokentype) canPrecedeUnaryOp() bool {
-	return tt == tokenOp || tt == tokenLeftParen || tt == tokenNil
+	return tt == tokenOp || tt == tokenLeftParen || tt == tokenNil ||
+		tt == tokenFunction || tt == tokenComma
 }
 
 type token struct {
@@ -270,6 +400,7 @@ type token struct {
 	stringLiteral fstring
 	identifier    fstring
 	op            exprOp
+	fn            *exprFunc
 }
 
 //
@@ -279,12 +410,25 @@ type token struct {
 type exprParser struct {
 	operandStack  stack[*expr]
 	operatorStack stack[exprOp]
+	callStack     stack[funcCall]
 	parenCounter  int
 	flags         parseFlags
 	prevTokenType tokentype
+	extLabels     bool // allow extended label characters in identifiers
+	ignoreCase    bool // identifiers are case-insensitive
+	arch          int  // value of the predefined architecture constant
 	errors        []asmerror
 }
 
+// A funcCall tracks the state of a function call while its arguments are
+// being parsed.
+type funcCall struct {
+	fn     *exprFunc
+	name   fstring // function name as it appears in the source
+	depth  int     // operand stack depth when the call began
+	commas int     // number of argument separators parsed
+}
+
 // Parse an expression from the line until it is exhausted.
 func (p *exprParser) parse(line, scopeLabel fstring, flags parseFlags) (e *expr, remain fstring, err error) {
 	p.errors = nil
@@ -336,6 +480,13 @@ func (p *exprParser) parse(line, scopeLabel fstring, flags parseFlags) (e *expr,
 				identifier: token.identifier,
 				scopeLabel: scopeLabel,
 			}
+
+			// The architecture constant takes the value of the
+			// architecture active where it is used, even if the
+			// expression is evaluated later.
+			if token.identifier.str == archSymbol {
+				e = &expr{op: opNumber, value: p.arch, bytes: 1, evaluated: true}
+			}
 			p.operandStack.push(e)
 
 		case tokenHere:
@@ -358,6 +509,31 @@ func (p *exprParser) parse(line, scopeLabel fstring, flags parseFlags) (e *expr,
 		case tokenLeftParen:
 			p.operatorStack.push(opLeftParen)
 
+		case tokenFunction:
+			p.callStack.push(funcCall{
+				fn:    token.fn,
+				name:  token.identifier,
+				depth: len(p.operandStack.data),
+			})
+			p.operatorStack.push(opFunction)
+
+		case tokenComma:
+			for err == nil {
+				if p.operatorStack.empty() || p.operatorStack.peek() == opLeftParen {
+					p.addError(line, "invalid expression")
+					err = errParse
+					break
+				}
+				if p.operatorStack.peek() == opFunction {
+					p.callStack.data[len(p.callStack.data)-1].commas++
+					break
+				}
+				err = collapse(&p.operandStack, p.operatorStack.pop())
+				if err != nil {
+					p.addError(line, "invalid expression")
+				}
+			}
+
 		case tokenRightParen:
 			for err == nil {
 				if p.operatorStack.empty() {
@@ -369,6 +545,10 @@ func (p *exprParser) parse(line, scopeLabel fstring, flags parseFlags) (e *expr,
 				if op == opLeftParen {
 					break
 				}
+				if op == opFunction {
+					err = p.collapseCall()
+					break
+				}
 				err = collapse(&p.operandStack, op)
 				if err != nil {
 					p.addError(line, "invalid expression")
@@ -430,6 +610,36 @@ func collapse(s *stack[*expr], op exprOp) error {
 	}
 }
 
+func (p *exprParser) identifierStartChar(c byte) bool {
+	return identifierStartChar(c) || (p.extLabels && extendedLabelChar(c))
+}
+
+func (p *exprParser) identifierChar(c byte) bool {
+	return identifierChar(c) || (p.extLabels && extendedLabelChar(c))
+}
+
+// Collapse the arguments of the function call on the top of the call
+// stack into a function expression node, and push the node onto the
+// operand stack.
+func (p *exprParser) collapseCall() error {
+	call := p.callStack.pop()
+	n := len(p.operandStack.data) - call.depth
+	if n != call.fn.args || call.commas != n-1 {
+		p.addError(call.name, fmt.Sprintf("function '%s' requires %d argument(s)", call.fn.name, call.fn.args))
+		return errParse
+	}
+
+	e := &expr{
+		op:   opFunction,
+		fn:   call.fn,
+		args: make([]*expr, n),
+	}
+	copy(e.args, p.operandStack.data[call.depth:])
+	p.operandStack.data = p.operandStack.data[:call.depth]
+	p.operandStack.push(e)
+	return nil
+}
+
 // Attempt to parse the next token from the line.
 func (p *exprParser) parseToken(line fstring) (t token, remain fstring, err error) {
 	if line.isEmpty() {
@@ -442,6 +652,13 @@ func (p *exprParser) parseToken(line fstring) (t token, remain fstring, err erro
 		t.typ = tokenHere
 		t.bytes = 2
 
+	// A '*' where a value is expected is also the current address, so
+	// "*+4" and "2*3" are both valid.
+	case line.startsWithChar('*') && !p.prevTokenType.isValue() && p.prevTokenType != tokenRightParen:
+		remain = line.consume(1)
+		t.typ = tokenHere
+		t.bytes = 2
+
 	case line.startsWith(decimal) || line.startsWithChar('$') || line.startsWithChar('%'):
 		t.value, t.bytes, remain, err = p.parseNumber(line)
 		t.typ = tokenNumber
@@ -469,7 +686,7 @@ func (p *exprParser) parseToken(line fstring) (t token, remain fstring, err erro
 		t.typ, t.op = tokenLeftParen, opLeftParen
 		remain = line.consume(1)
 
-	case line.startsWithChar(')') && (p.flags&allowParentheses) != 0:
+	case line.startsWithChar(')') && ((p.flags&allowParentheses) != 0 || !p.callStack.empty()):
 		if p.parenCounter == 0 {
 			p.addError(line, "mismatched parentheses")
 			err = errParse
@@ -479,13 +696,22 @@ func (p *exprParser) parseToken(line fstring) (t token, remain fstring, err erro
 			t.typ, t.op, remain = tokenRightParen, opRightParen, line.consume(1)
 		}
 
-	case line.startsWith(identifierStartChar):
+	case line.startsWithChar(',') && !p.callStack.empty():
+		t.typ, remain = tokenComma, line.consume(1)
+
+	case line.startsWith(p.identifierStartChar):
 		t.typ = tokenIdentifier
-		t.identifier, remain = line.consumeWhile(identifierChar)
+		t.identifier, remain = line.consumeWhile(p.identifierChar)
 		if p.prevTokenType.isValue() || p.prevTokenType == tokenRightParen {
 			p.addError(line, "invalid identifier")
 			err = errParse
 		}
+		if f := lookupFunc(t.identifier.str); f != nil && remain.startsWithChar('(') {
+			p.parenCounter++
+			t.typ, t.fn, remain = tokenFunction, f, remain.consume(1)
+		} else if p.ignoreCase {
+			t.identifier.str = strings.ToUpper(t.identifier.str)
+		}
 
 	default:
 		for i, o := range ops {
@@ -539,13 +765,13 @@ func (p *exprParser) parseNumber(line fstring) (value, bytes int, remain fstring
 	case line.startsWithChar('$'):
 		line = line.consume(1)
 		base, fn, bitsPerChar = 16, hexadecimal, 4
-	case line.startsWithString("0x"):
+	case line.startsWithStringFold("0x"):
 		line = line.consume(2)
 		base, fn, bitsPerChar = 16, hexadecimal, 4
 	case line.startsWithChar('%'):
 		line = line.consume(1)
 		base, fn, bitsPerChar = 2, binarynum, 1
-	case line.startsWithString("0b"):
+	case line.startsWithStringFold("0b"):
 		line = line.consume(2)
 		base, fn, bitsPerChar = 2, binarynum, 1
 	}
@@ -626,6 +852,7 @@ func (p *exprParser) addError(line fstring, msg string) {
 
 func (p *exprParser) reset() {
 	p.operandStack.data, p.operatorStack.data = nil, nil
+	p.callStack.data = nil
 	p.parenCounter = 0
 }
 
@@ -4,6 +4,8 @@
 
 package asm
 
+import "strings"
+
 // An fstring is a string that keeps track of its position within the
 // file from which it was read.
 type fstring struct {
@@ -59,6 +61,10 @@ func (l *fstring) startsWithString(s string) bool {
 	return len(l.str) >= len(s) && l.str[:len(s)] == s
 }
 
+func (l *fstring) startsWithStringFold(s string) bool {
+	return len(l.str) >= len(s) && strings.EqualFold(l.str[:len(s)], s)
+}
+
 func (l fstring) consumeWhitespace() fstring {
 	return l.consume(l.scanWhile(whitespace))
 }
@@ -102,27 +108,71 @@ func (l *fstring) consumeUntilChar(c byte) (consumed, remain fstring) {
 	return
 }
 
-func (l *fstring) consumeUntilUnquotedChar(c byte) (consumed, remain fstring) {
+// Consume characters until one satisfying fn is found outside of any quoted
+// string or parenthesized group.
+func (l *fstring) consumeUntilUnnested(fn func(c byte) bool) (consumed, remain fstring) {
 	var quote byte
+	depth := 0
 	i := 0
+loop:
 	for ; i < len(l.str); i++ {
-		if quote == 0 {
-			if l.str[i] == c {
-				break
-			}
-			if l.str[i] == '\'' || l.str[i] == '"' {
-				quote = l.str[i]
-			}
-		} else {
-			if l.str[i] == quote {
+		c := l.str[i]
+		switch {
+		case quote != 0:
+			if c == quote {
 				quote = 0
 			}
+		case depth == 0 && fn(c):
+			break loop
+		case c == '\'' || c == '"':
+			quote = c
+		case c == '(':
+			depth++
+		case c == ')' && depth > 0:
+			depth--
 		}
 	}
 	consumed, remain = l.trunc(i), l.consume(i)
 	return
 }
 
+func (l *fstring) consumeUntilUnnestedChar(c byte) (consumed, remain fstring) {
+	return l.consumeUntilUnnested(func(x byte) bool { return x == c })
+}
+
+// Return the index of the first occurrence of the string s that is not
+// inside a quoted string, or -1 if there is none. If word is true, the
+// occurrence must be surrounded by whitespace and is matched without regard
+// to case.
+func (l *fstring) findUnquoted(s string, word bool) int {
+	var quote byte
+	for i := 0; i < len(l.str); i++ {
+		c := l.str[i]
+		switch {
+		case quote != 0:
+			if c == quote {
+				quote = 0
+			}
+		case stringQuote(c):
+			quote = c
+		case i+len(s) <= len(l.str):
+			if !word {
+				if l.str[i:i+len(s)] == s {
+					return i
+				}
+				continue
+			}
+			if i == 0 || !whitespace(l.str[i-1]) || i+len(s) == len(l.str) || !whitespace(l.str[i+len(s)]) {
+				continue
+			}
+			if strings.EqualFold(l.str[i:i+len(s)], s) {
+				return i
+			}
+		}
+	}
+	return -1
+}
+
 func (l fstring) stripTrailingComment() fstring {
 	lastNonWS := 0
 	for i := 0; i < len(l.str); i++ {
@@ -146,6 +196,16 @@ func (l fstring) stripTrailingComment() fstring {
 	return l.trunc(lastNonWS)
 }
 
+// Return the text of the line's trailing comment, without the leading
+// comment character.
+func (l fstring) trailingComment() string {
+	rest := strings.TrimSpace(l.str[len(l.stripTrailingComment().str):])
+	if len(rest) > 0 && comment(rest[0]) {
+		return strings.TrimSpace(rest[1:])
+	}
+	return ""
+}
+
 //
 // character helper functions
 //
@@ -178,6 +238,10 @@ func binarynum(c byte) bool {
 	return c == '0' || c == '1'
 }
 
+// Labels begin with a letter, '_', '.' or '@', and continue with letters,
+// digits, '_', '.' or '@'. A leading '.' or '@' marks a local label. When
+// the ExtendedLabels option is used, '?' and '!' are also allowed anywhere
+// in a label.
 func labelStartChar(c byte) bool {
 	return alpha(c) || c == '_' || c == '.' || c == '@'
 }
@@ -194,6 +258,10 @@ func identifierChar(c byte) bool {
 	return alpha(c) || decimal(c) || c == '_' || c == '.' || c == '@' || c == ':'
 }
 
+func extendedLabelChar(c byte) bool {
+	return c == '?' || c == '!'
+}
+
 func stringQuote(c byte) bool {
 	return c == '"' || c == '\''
 }
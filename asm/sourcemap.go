@@ -19,12 +19,30 @@ import (
 // A SourceMap describes the mapping between source code line numbers and
 // assembly code addresses.
 type SourceMap struct {
-	Origin  uint16
-	Size    uint32
-	CRC     uint32
-	Files   []string
-	Lines   []SourceLine
-	Exports []Export
+	Origin   uint16
+	Size     uint32
+	CRC      uint32
+	Files    []string
+	Lines    []SourceLine
+	Exports  []Export
+	Symbols  []Export  // all labels and constants, if requested
+	Comments []Comment // source code comments, if requested
+	Data     []DataRange
+}
+
+// A DataRange is a range of addresses holding data generated by data
+// pseudo-ops (such as .DB or .DW) rather than by instructions.
+type DataRange struct {
+	Address uint16
+	Size    uint16
+	Unit    int // size of each data item in bytes (1, 2 or 4)
+}
+
+// A Comment is the trailing comment of a source code line that generated
+// the machine code at an address.
+type Comment struct {
+	Address uint16
+	Text    string
 }
 
 // A SourceLine represents a mapping between a machine code address and
@@ -45,9 +63,12 @@ const (
 // NewSourceMap creates an empty source map.
 func NewSourceMap() *SourceMap {
 	return &SourceMap{
-		Files:   []string{},
-		Lines:   []SourceLine{},
-		Exports: []Export{},
+		Files:    []string{},
+		Lines:    []SourceLine{},
+		Exports:  []Export{},
+		Symbols:  []Export{},
+		Comments: []Comment{},
+		Data:     []DataRange{},
 	}
 }
 
@@ -63,17 +84,82 @@ func (s *SourceMap) Find(addr int) (filename string, line int, err error) {
 	return "", 0, fmt.Errorf("address $%04X not found in source file", addr)
 }
 
+// FindByLine searches the source map for the address of the machine code
+// generated by a source code line. If the line generated no code, the address
+// of the next line in the same file that did is returned.
+func (s *SourceMap) FindByLine(filename string, line int) (addr int, err error) {
+	fileIndex := slices.Index(s.Files, filename)
+	if fileIndex < 0 {
+		return 0, fmt.Errorf("file '%s' not found in source map", filename)
+	}
+
+	best := -1
+	for i, l := range s.Lines {
+		if l.FileIndex != fileIndex || l.Line < line {
+			continue
+		}
+		if best < 0 || l.Line < s.Lines[best].Line {
+			best = i
+		}
+	}
+	if best < 0 {
+		return 0, fmt.Errorf("line %d not found in source file '%s'", line, filename)
+	}
+	return s.Lines[best].Address, nil
+}
+
+// FindComment searches the source map for the source code comment
+// associated with the requested address.
+func (s *SourceMap) FindComment(addr int) (text string, ok bool) {
+	i := sort.Search(len(s.Comments), func(i int) bool {
+		return int(s.Comments[i].Address) >= addr
+	})
+	if i < len(s.Comments) && int(s.Comments[i].Address) == addr {
+		return s.Comments[i].Text, true
+	}
+	return "", false
+}
+
+// FindData searches the source map for a data range containing the
+// requested address.
+func (s *SourceMap) FindData(addr int) (r DataRange, ok bool) {
+	i := sort.Search(len(s.Data), func(i int) bool {
+		return int(s.Data[i].Address)+int(s.Data[i].Size) > addr
+	})
+	if i < len(s.Data) && int(s.Data[i].Address) <= addr {
+		return s.Data[i], true
+	}
+	return DataRange{}, false
+}
+
 // ClearRange clears portions of the source map that reference the
-// address range between `origin` and `origin+size`.
+// address range between `origin` (inclusive) and `origin+size` (exclusive).
 func (s *SourceMap) ClearRange(origin, size int) {
-	min := uint16(origin)
-	max := uint16(origin + size)
+	min, max := origin, origin+size
+
+	// Filter out original exports and symbols covered by the new map's
+	// address range.
+	exports := filterExports(s.Exports, min, max)
+	symbols := filterExports(s.Symbols, min, max)
+
+	// Filter out original comments covered by the new map's address range.
+	comments := make([]Comment, 0, len(s.Comments))
+	for _, c := range s.Comments {
+		if int(c.Address) < min || int(c.Address) >= max {
+			comments = append(comments, c)
+		}
+	}
 
-	// Filter out original exports covered by the new map's address range.
-	exports := make([]Export, 0, len(s.Exports))
-	for _, e := range s.Exports {
-		if e.Address < min || e.Address > max {
-			exports = append(exports, e)
+	// Trim original data ranges so they no longer overlap the new map's
+	// address range.
+	data := make([]DataRange, 0, len(s.Data))
+	for _, r := range s.Data {
+		start, end := int(r.Address), int(r.Address)+int(r.Size)
+		if start < min {
+			data = appendDataRange(data, start, minInt(end, min), r.Unit)
+		}
+		if end > max {
+			data = appendDataRange(data, maxInt(start, max), end, r.Unit)
 		}
 	}
 
@@ -83,7 +169,7 @@ func (s *SourceMap) ClearRange(origin, size int) {
 	fileMap := make(map[string]int) // filename -> file index
 	lines := make([]SourceLine, 0, len(s.Lines))
 	for _, l := range s.Lines {
-		if uint16(l.Address) < min || uint16(l.Address) >= max {
+		if l.Address < min || l.Address >= max {
 			filename := s.Files[l.FileIndex]
 			if fileIndex, ok := fileMap[filename]; ok {
 				l.FileIndex = fileIndex
@@ -106,6 +192,28 @@ func (s *SourceMap) ClearRange(origin, size int) {
 	s.Files = files
 	s.Lines = lines
 	s.Exports = exports
+	s.Symbols = symbols
+	s.Comments = comments
+	s.Data = data
+}
+
+// Append a data range covering the addresses from start (inclusive) to end
+// (exclusive), unless it is empty or holds only part of a data item.
+func appendDataRange(data []DataRange, start, end, unit int) []DataRange {
+	if end-start < unit {
+		return data
+	}
+	return append(data, DataRange{Address: uint16(start), Size: uint16(end - start), Unit: unit})
+}
+
+func filterExports(exports []Export, min, max int) []Export {
+	filtered := make([]Export, 0, len(exports))
+	for _, e := range exports {
+		if int(e.Address) < min || int(e.Address) >= max {
+			filtered = append(filtered, e)
+		}
+	}
+	return filtered
 }
 
 // Merge merges another source map (s2) into this source map.
@@ -116,6 +224,9 @@ func (s *SourceMap) Merge(s2 *SourceMap) {
 
 	// Add exports from the new map.
 	s.Exports = sortExports(append(s.Exports, s2.Exports...))
+	s.Symbols = sortExports(append(s.Symbols, s2.Symbols...))
+	s.Comments = sortComments(append(s.Comments, s2.Comments...))
+	s.Data = sortDataRanges(append(s.Data, s2.Data...))
 
 	// Build a mapping from filename to file index.
 	fileCount := 0
@@ -125,8 +236,14 @@ func (s *SourceMap) Merge(s2 *SourceMap) {
 		fileCount++
 	}
 
-	// Add source lines from the new map.
+	// Add source lines from the new map. A line mapped to the new map's end
+	// address is dropped if the original map already has code there.
+	end := int(s2.Origin) + int(s2.Size)
+	existing := s.Lines
 	for _, l := range s2.Lines {
+		if l.Address >= end && hasLine(existing, l.Address) {
+			continue
+		}
 		filename := s2.Files[l.FileIndex]
 		if fileIndex, ok := fileMap[filename]; ok {
 			l.FileIndex = fileIndex
@@ -147,12 +264,20 @@ func (s *SourceMap) Merge(s2 *SourceMap) {
 	}
 }
 
+// Return true if the sorted source lines include one at the address.
+func hasLine(lines []SourceLine, addr int) bool {
+	i := sort.Search(len(lines), func(i int) bool {
+		return lines[i].Address >= addr
+	})
+	return i < len(lines) && lines[i].Address == addr
+}
+
 // ReadFrom reads the contents of an assembly source map.
 func (s *SourceMap) ReadFrom(r io.Reader) (n int64, err error) {
 	rr := bufio.NewReader(r)
 
-	b := make([]byte, 26)
-	nn, err := io.ReadFull(rr, b)
+	b := make([]byte, 38)
+	nn, err := io.ReadFull(rr, b[:26])
 	n += int64(nn)
 	if err != nil {
 		return n, err
@@ -161,10 +286,29 @@ func (s *SourceMap) ReadFrom(r io.Reader) (n int64, err error) {
 	if len(b) < 16 || !bytes.Equal(b[0:4], []byte(sourceMapSignature)) {
 		return n, errors.New("invalid source map format")
 	}
-	if b[4] != versionMajor || b[5] != versionMinor {
+	if b[4] != versionMajor || b[5] == 0 || b[5] > versionMinor {
 		return n, errors.New("invalid source map version")
 	}
 
+	// Version 0.2 added a symbol count to the header, version 0.3 added a
+	// comment count, and version 0.4 added a data range count.
+	var symbolCount, commentCount, dataCount int
+	if b[5] >= 2 {
+		hdrSize := 26 + 4*int(b[5]-1)
+		nn, err = io.ReadFull(rr, b[26:hdrSize])
+		n += int64(nn)
+		if err != nil {
+			return n, err
+		}
+		symbolCount = int(binary.LittleEndian.Uint32(b[26:30]))
+		if b[5] >= 3 {
+			commentCount = int(binary.LittleEndian.Uint32(b[30:34]))
+		}
+		if b[5] >= 4 {
+			dataCount = int(binary.LittleEndian.Uint32(b[34:38]))
+		}
+	}
+
 	s.Origin = binary.LittleEndian.Uint16(b[6:8])
 	s.Size = binary.LittleEndian.Uint32(b[8:12])
 	s.CRC = binary.LittleEndian.Uint32(b[12:16])
@@ -196,36 +340,84 @@ func (s *SourceMap) ReadFrom(r io.Reader) (n int64, err error) {
 		}
 	}
 
-	s.Exports = make([]Export, exportCount)
-	for i := 0; i < exportCount; i++ {
-		label, err := rr.ReadString(0)
-		n += int64(len(label))
+	s.Exports, nn, err = readExports(rr, exportCount)
+	n += int64(nn)
+	if err != nil {
+		return n, err
+	}
+
+	s.Symbols, nn, err = readExports(rr, symbolCount)
+	n += int64(nn)
+	if err != nil {
+		return n, err
+	}
+
+	s.Comments = make([]Comment, commentCount)
+	for i := 0; i < commentCount; i++ {
+		nn, err = io.ReadFull(rr, b[:2])
+		n += int64(nn)
 		if err != nil {
 			return n, err
 		}
-		s.Exports[i].Label = label[:len(label)-1]
+		s.Comments[i].Address = binary.LittleEndian.Uint16(b[0:2])
 
-		nn, err = io.ReadFull(rr, b[:2])
+		text, err := rr.ReadString(0)
+		n += int64(len(text))
+		if err != nil {
+			return n, err
+		}
+		s.Comments[i].Text = text[:len(text)-1]
+	}
+
+	s.Data = make([]DataRange, dataCount)
+	for i := 0; i < dataCount; i++ {
+		nn, err = io.ReadFull(rr, b[:5])
 		n += int64(nn)
 		if err != nil {
 			return n, err
 		}
-		s.Exports[i].Address = binary.LittleEndian.Uint16(b[0:2])
+		s.Data[i].Address = binary.LittleEndian.Uint16(b[0:2])
+		s.Data[i].Size = binary.LittleEndian.Uint16(b[2:4])
+		s.Data[i].Unit = int(b[4])
 	}
 
 	return n, nil
 }
 
+func readExports(r *bufio.Reader, count int) (exports []Export, n int, err error) {
+	exports = make([]Export, count)
+	for i := 0; i < count; i++ {
+		label, err := r.ReadString(0)
+		n += len(label)
+		if err != nil {
+			return exports, n, err
+		}
+		exports[i].Label = label[:len(label)-1]
+
+		var b [2]byte
+		nn, err := io.ReadFull(r, b[:])
+		n += nn
+		if err != nil {
+			return exports, n, err
+		}
+		exports[i].Address = binary.LittleEndian.Uint16(b[:])
+	}
+	return exports, n, nil
+}
+
 // WriteTo writes the contents of an assembly source map to an output
 // stream.
 func (s *SourceMap) WriteTo(w io.Writer) (n int64, err error) {
 	fileCount := uint16(len(s.Files))
 	lineCount := uint32(len(s.Lines))
 	exportCount := uint32(len(s.Exports))
+	symbolCount := uint32(len(s.Symbols))
+	commentCount := uint32(len(s.Comments))
+	dataCount := uint32(len(s.Data))
 
 	ww := bufio.NewWriter(w)
 
-	var hdr [26]byte
+	var hdr [38]byte
 	copy(hdr[:], []byte(sourceMapSignature))
 	hdr[4] = versionMajor
 	hdr[5] = versionMinor
@@ -235,6 +427,9 @@ func (s *SourceMap) WriteTo(w io.Writer) (n int64, err error) {
 	binary.LittleEndian.PutUint16(hdr[16:18], fileCount)
 	binary.LittleEndian.PutUint32(hdr[18:22], lineCount)
 	binary.LittleEndian.PutUint32(hdr[22:26], exportCount)
+	binary.LittleEndian.PutUint32(hdr[26:30], symbolCount)
+	binary.LittleEndian.PutUint32(hdr[30:34], commentCount)
+	binary.LittleEndian.PutUint32(hdr[34:38], dataCount)
 	nn, err := ww.Write(hdr[:])
 	n += int64(nn)
 	if err != nil {
@@ -266,17 +461,41 @@ func (s *SourceMap) WriteTo(w io.Writer) (n int64, err error) {
 		}
 	}
 
-	for _, e := range s.Exports {
-		nn, err = ww.WriteString(e.Label)
+	nn, err = writeExports(ww, s.Exports)
+	n += int64(nn)
+	if err != nil {
+		return n, err
+	}
+
+	nn, err = writeExports(ww, s.Symbols)
+	n += int64(nn)
+	if err != nil {
+		return n, err
+	}
+
+	for _, c := range s.Comments {
+		var b [2]byte
+		binary.LittleEndian.PutUint16(b[:], c.Address)
+		nn, err = ww.Write(b[:])
+		n += int64(nn)
+		if err != nil {
+			return n, err
+		}
+
+		nn, err = ww.WriteString(c.Text)
 		n += int64(nn)
 		if err != nil {
 			return n, err
 		}
 		ww.WriteByte(0)
 		n++
+	}
 
-		var b [2]byte
-		binary.LittleEndian.PutUint16(b[:], e.Address)
+	for _, r := range s.Data {
+		var b [5]byte
+		binary.LittleEndian.PutUint16(b[0:2], r.Address)
+		binary.LittleEndian.PutUint16(b[2:4], r.Size)
+		b[4] = byte(r.Unit)
 		nn, err = ww.Write(b[:])
 		n += int64(nn)
 		if err != nil {
@@ -289,6 +508,27 @@ func (s *SourceMap) WriteTo(w io.Writer) (n int64, err error) {
 	return n, nil
 }
 
+func writeExports(w *bufio.Writer, exports []Export) (n int, err error) {
+	for _, e := range exports {
+		nn, err := w.WriteString(e.Label)
+		n += nn
+		if err != nil {
+			return n, err
+		}
+		w.WriteByte(0)
+		n++
+
+		var b [2]byte
+		binary.LittleEndian.PutUint16(b[:], e.Address)
+		nn, err = w.Write(b[:])
+		n += nn
+		if err != nil {
+			return n, err
+		}
+	}
+	return n, nil
+}
+
 func decodeSourceLine(r *bufio.Reader, prev SourceLine) (line SourceLine, n int, err error) {
 	da, nn, err := decode67(r)
 	n += nn
@@ -503,8 +743,79 @@ func sortLines(lines []SourceLine) []SourceLine {
 
 func sortExports(exports []Export) []Export {
 	cmp := func(a, b Export) int {
-		return cmp.Compare(a.Address, b.Address)
+		if c := cmp.Compare(a.Address, b.Address); c != 0 {
+			return c
+		}
+		return cmp.Compare(a.Label, b.Label)
 	}
 	slices.SortFunc(exports, cmp)
 	return exports
 }
+
+func sortComments(comments []Comment) []Comment {
+	cmp := func(a, b Comment) int {
+		return cmp.Compare(a.Address, b.Address)
+	}
+	slices.SortFunc(comments, cmp)
+	return comments
+}
+
+func sortDataRanges(data []DataRange) []DataRange {
+	cmp := func(a, b DataRange) int {
+		return cmp.Compare(a.Address, b.Address)
+	}
+	slices.SortFunc(data, cmp)
+	return data
+}
+
+// WriteSymbolsVICE writes the source map's symbols to an output stream as a
+// VICE monitor label file, which the monitor loads with its "ll" command.
+// If the source map holds no symbols, its exports are written instead.
+// Characters that VICE doesn't allow in labels are replaced by underscores.
+func (s *SourceMap) WriteSymbolsVICE(w io.Writer) (n int64, err error) {
+	ww := bufio.NewWriter(w)
+	for _, e := range s.symbolList() {
+		nn, err := fmt.Fprintf(ww, "al C:%04x .%s\n", e.Address, viceLabel(e.Label))
+		n += int64(nn)
+		if err != nil {
+			return n, err
+		}
+	}
+	return n, ww.Flush()
+}
+
+// WriteSymbolsNoCash writes the source map's symbols to an output stream in
+// the .sym format used by the no$ family of debuggers, with one "bank:address
+// label" entry per line. If the source map holds no symbols, its exports are
+// written instead.
+func (s *SourceMap) WriteSymbolsNoCash(w io.Writer) (n int64, err error) {
+	ww := bufio.NewWriter(w)
+	for _, e := range s.symbolList() {
+		nn, err := fmt.Fprintf(ww, "00:%04X %s\n", e.Address, e.Label)
+		n += int64(nn)
+		if err != nil {
+			return n, err
+		}
+	}
+	return n, ww.Flush()
+}
+
+// Return the symbols written to debugger symbol files.
+func (s *SourceMap) symbolList() []Export {
+	if len(s.Symbols) > 0 {
+		return s.Symbols
+	}
+	return s.Exports
+}
+
+// Return a label with every character VICE doesn't accept in a label
+// replaced by an underscore.
+func viceLabel(label string) string {
+	b := []byte(label)
+	for i, c := range b {
+		if !(c >= 'a' && c <= 'z' || c >= 'A' && c <= 'Z' || c >= '0' && c <= '9' || c == '_') {
+			b[i] = '_'
+		}
+	}
+	return string(b)
+}
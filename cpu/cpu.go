@@ -23,6 +23,19 @@ type BrkHandler interface {
 	OnBrk(cpu *CPU)
 }
 
+// IllegalOpcodeHandler is an interface implemented by types that wish to be
+// notified when an opcode undefined on the CPU's architecture is about to be
+// executed.
+type IllegalOpcodeHandler interface {
+	OnIllegalOpcode(cpu *CPU)
+}
+
+// ResetHandler is an interface implemented by types that wish to be notified
+// when the CPU resets itself and jumps to the address in the reset vector.
+type ResetHandler interface {
+	OnReset(cpu *CPU)
+}
+
 // CPU represents a single 6502 CPU. It contains a pointer to the
 // memory associated with the CPU.
 type CPU struct {
@@ -32,10 +45,18 @@ type CPU struct {
 	Cycles      uint64          // total executed CPU cycles
 	LastPC      uint16          // Previous program counter
 	InstSet     *InstructionSet // Instruction set used by the CPU
+	StackPage   byte            // Memory page holding the stack (normally 1)
 	pageCrossed bool
 	deltaCycles int8
+	pendingIRQ  bool // IRQ requested but not yet serviced
+	pendingNMI  bool // NMI requested but not yet serviced
+	irqMaskOld  bool // poll the I flag's value from before the last instruction
+	irqMask     bool // I flag value before the last instruction
+	noPoll      bool // don't poll for interrupts before the next instruction
 	debugger    *Debugger
 	brkHandler  BrkHandler
+	illHandler  IllegalOpcodeHandler
+	rstHandler  ResetHandler
 	storeByte   func(cpu *CPU, addr uint16, v byte)
 }
 
@@ -53,6 +74,7 @@ func NewCPU(arch Architecture, m Memory) *CPU {
 		Arch:      arch,
 		Mem:       m,
 		InstSet:   GetInstructionSet(arch),
+		StackPage: 1,
 		storeByte: (*CPU).storeByteNormal,
 	}
 
@@ -60,33 +82,136 @@ func NewCPU(arch Architecture, m Memory) *CPU {
 	return cpu
 }
 
+// Run creates a CPU bound to the specified memory, executes 'steps'
+// instructions starting at address 'pc', and returns the number of cycles
+// they took. No debugger or handlers are attached to the CPU, so Run
+// measures the speed of the emulator's fastest execution path.
+func Run(m Memory, arch Architecture, pc uint16, steps int) uint64 {
+	cpu := NewCPU(arch, m)
+	cpu.SetPC(pc)
+	for i := 0; i < steps; i++ {
+		cpu.Step()
+	}
+	return cpu.Cycles
+}
+
 // SetPC updates the CPU program counter to 'addr'.
 func (cpu *CPU) SetPC(addr uint16) {
 	cpu.Reg.PC = addr
 }
 
+// PeekByte returns the byte at the address. If the CPU's memory is a
+// Peeker, the byte is read without side effects.
+func (cpu *CPU) PeekByte(addr uint16) byte {
+	if p, ok := cpu.Mem.(Peeker); ok {
+		return p.PeekByte(addr)
+	}
+	return cpu.Mem.LoadByte(addr)
+}
+
+// PeekBytes reads multiple bytes from the address into the buffer 'b'. If
+// the CPU's memory is a Peeker, the bytes are read without side effects.
+func (cpu *CPU) PeekBytes(addr uint16, b []byte) {
+	if p, ok := cpu.Mem.(Peeker); ok {
+		p.PeekBytes(addr, b)
+		return
+	}
+	cpu.Mem.LoadBytes(addr, b)
+}
+
+// PeekAddress returns the 16-bit address stored at the requested address,
+// with the same page wrapping as LoadAddress. If the CPU's memory is a
+// Peeker, the address is read without side effects.
+func (cpu *CPU) PeekAddress(addr uint16) uint16 {
+	if (addr & 0xff) == 0xff {
+		return uint16(cpu.PeekByte(addr)) | uint16(cpu.PeekByte(addr-0xff))<<8
+	}
+	return uint16(cpu.PeekByte(addr)) | uint16(cpu.PeekByte(addr+1))<<8
+}
+
 // GetInstruction returns the instruction opcode at the requested address.
 func (cpu *CPU) GetInstruction(addr uint16) *Instruction {
-	opcode := cpu.Mem.LoadByte(addr)
+	opcode := cpu.PeekByte(addr)
 	return cpu.InstSet.Lookup(opcode)
 }
 
 // NextAddr returns the address of the next instruction following the
 // instruction at addr.
 func (cpu *CPU) NextAddr(addr uint16) uint16 {
-	opcode := cpu.Mem.LoadByte(addr)
+	opcode := cpu.PeekByte(addr)
 	inst := cpu.InstSet.Lookup(opcode)
 	return addr + uint16(inst.Length)
 }
 
-// Step the cpu by one instruction.
+// EffectiveAddress returns the memory address an instruction with the given
+// operand bytes would access if executed with the current register values.
+// It uses the same addressing logic as instruction execution, including
+// zero page wrapping and the NMOS indirect jump page wrap, but has no side
+// effects. For jumps, it returns the address of the jump target. The
+// function returns false for addressing modes that have no memory address
+// (implied, accumulator and immediate) and for relative branches, whose
+// targets depend on the instruction's address.
+func (cpu *CPU) EffectiveAddress(inst *Instruction, operand []byte) (addr uint16, ok bool) {
+	switch inst.Mode {
+	case ZPG, ABS:
+		return operandToAddress(operand), true
+	case ZPX:
+		return offsetZeroPage(operandToAddress(operand), cpu.Reg.X), true
+	case ZPY:
+		return offsetZeroPage(operandToAddress(operand), cpu.Reg.Y), true
+	case ABX:
+		addr, _ = offsetAddress(operandToAddress(operand), cpu.Reg.X)
+		if inst.Name == "JMP" {
+			addr = cpu.PeekAddress(addr)
+		}
+		return addr, true
+	case ABY:
+		addr, _ = offsetAddress(operandToAddress(operand), cpu.Reg.Y)
+		return addr, true
+	case IND:
+		addr = operandToAddress(operand)
+		if cpu.Arch == CMOS && len(operand) == 2 && operand[0] == 0xff {
+			// The 65c02 doesn't wrap the indirect jump address within
+			// the page.
+			return uint16(cpu.PeekByte(addr)) | uint16(cpu.PeekByte(addr+1))<<8, true
+		}
+		return cpu.PeekAddress(addr), true
+	case IDX:
+		zpaddr := offsetZeroPage(operandToAddress(operand), cpu.Reg.X)
+		return cpu.PeekAddress(zpaddr), true
+	case IDY:
+		addr, _ = offsetAddress(cpu.PeekAddress(operandToAddress(operand)), cpu.Reg.Y)
+		return addr, true
+	default:
+		return 0, false
+	}
+}
+
+// Step the cpu by one instruction. If an interrupt is pending, the step
+// instead performs the interrupt sequence, leaving the program counter at
+// the start of the interrupt handler.
 func (cpu *CPU) Step() {
+	if cpu.serviceInterrupt() {
+		if cpu.debugger != nil {
+			cpu.debugger.onInterrupt(cpu)
+		}
+		return
+	}
+
 	// Grab the next opcode at the current PC
 	opcode := cpu.Mem.LoadByte(cpu.Reg.PC)
 
 	// Look up the instruction data for the opcode
 	inst := cpu.InstSet.Lookup(opcode)
 
+	// If the opcode is undefined on this architecture and an illegal opcode
+	// handler has been installed, call the handler instead of executing the
+	// instruction.
+	if inst.illegal && cpu.illHandler != nil {
+		cpu.illHandler.OnIllegalOpcode(cpu)
+		return
+	}
+
 	// If the instruction is undefined, reset the CPU (for now).
 	if inst.fn == nil {
 		cpu.reset()
@@ -110,8 +235,16 @@ func (cpu *CPU) Step() {
 	// Execute the instruction
 	cpu.pageCrossed = false
 	cpu.deltaCycles = 0
+	iflag := cpu.Reg.InterruptDisable
 	inst.fn(cpu, inst, operand)
 
+	// Interrupts are polled before the last cycle of an instruction. CLI,
+	// SEI and PLP change the I flag during the last cycle, so the next IRQ
+	// poll uses the flag's previous value.
+	cpu.irqMaskOld = inst.Name == "CLI" || inst.Name == "SEI" || inst.Name == "PLP"
+	cpu.irqMask = iflag
+	cpu.noPoll = false
+
 	// Update the CPU cycle counter, with special-case logic
 	// to handle a page boundary crossing
 	cpu.Cycles += uint64(int8(inst.Cycles) + cpu.deltaCycles)
@@ -125,22 +258,56 @@ func (cpu *CPU) Step() {
 	}
 }
 
+// RunUntil steps the cpu until the predicate 'pred', which is evaluated
+// after each instruction, returns true or until 'maxSteps' instructions
+// have been executed. If maxSteps is zero or negative, there is no step
+// limit. RunUntil returns true if it stopped because of the predicate.
+func (cpu *CPU) RunUntil(pred func(cpu *CPU) bool, maxSteps int) (stopped bool) {
+	for step := 0; maxSteps <= 0 || step < maxSteps; step++ {
+		cpu.Step()
+		if pred(cpu) {
+			return true
+		}
+	}
+	return false
+}
+
 // AttachBrkHandler attaches a handler that is called whenever the BRK
 // instruction is executed.
 func (cpu *CPU) AttachBrkHandler(handler BrkHandler) {
 	cpu.brkHandler = handler
 }
 
+// AttachResetHandler attaches a handler that is called whenever the CPU
+// resets itself, after the program counter has been loaded from the reset
+// vector.
+func (cpu *CPU) AttachResetHandler(handler ResetHandler) {
+	cpu.rstHandler = handler
+}
+
+// AttachIllegalOpcodeHandler attaches a handler that is called whenever an
+// opcode undefined on the CPU's architecture is about to be executed. On
+// the 65c02, all unused opcodes behave as documented NOPs, so the handler is
+// called only on NMOS CPUs. Without a handler, undefined opcodes execute as
+// NOPs.
+func (cpu *CPU) AttachIllegalOpcodeHandler(handler IllegalOpcodeHandler) {
+	cpu.illHandler = handler
+}
+
 // AttachDebugger attaches a debugger to the CPU. The debugger receives
-// notifications whenever the CPU executes an instruction or stores a byte
-// to memory.
+// notifications whenever the CPU executes an instruction, and whenever it
+// stores a byte to memory while the debugger has data breakpoints.
 func (cpu *CPU) AttachDebugger(debugger *Debugger) {
 	cpu.debugger = debugger
-	cpu.storeByte = (*CPU).storeByteDebugger
+	debugger.cpu = cpu
+	debugger.updateStoreByte()
 }
 
 // DetachDebugger detaches the currently debugger from the CPU.
 func (cpu *CPU) DetachDebugger() {
+	if cpu.debugger != nil && cpu.debugger.cpu == cpu {
+		cpu.debugger.cpu = nil
+	}
 	cpu.debugger = nil
 	cpu.storeByte = (*CPU).storeByteNormal
 }
@@ -247,7 +414,10 @@ func (cpu *CPU) store(mode Mode, operand []byte, v byte) {
 	}
 }
 
-// Execute a branch using the instruction operand.
+// Execute a branch using the instruction operand. This should only be called
+// once the branch has been determined to be taken. A taken branch costs one
+// extra cycle, plus another if the branch target lies on a different page
+// than the following instruction. Branches not taken cost no extra cycles.
 func (cpu *CPU) branch(operand []byte) {
 	offset := operandToAddress(operand)
 	oldPC := cpu.Reg.PC
@@ -275,8 +445,11 @@ func (cpu *CPU) storeByteDebugger(addr uint16, v byte) {
 
 // Push a value 'v' onto the stack.
 func (cpu *CPU) push(v byte) {
-	cpu.storeByte(cpu, stackAddress(cpu.Reg.SP), v)
+	cpu.storeByte(cpu, stackAddress(cpu.StackPage, cpu.Reg.SP), v)
 	cpu.Reg.SP--
+	if cpu.debugger != nil {
+		cpu.debugger.onStackPush(cpu)
+	}
 }
 
 // Push the address 'addr' onto the stack.
@@ -288,7 +461,10 @@ func (cpu *CPU) pushAddress(addr uint16) {
 // Pop a value from the stack and return it.
 func (cpu *CPU) pop() byte {
 	cpu.Reg.SP++
-	return cpu.Mem.LoadByte(stackAddress(cpu.Reg.SP))
+	if cpu.debugger != nil {
+		cpu.debugger.onStackPull(cpu)
+	}
+	return cpu.Mem.LoadByte(stackAddress(cpu.StackPage, cpu.Reg.SP))
 }
 
 // Pop a 16-bit address off the stack.
@@ -318,21 +494,95 @@ func (cpu *CPU) handleInterrupt(brk bool, addr uint16) {
 	cpu.Reg.PC = cpu.Mem.LoadAddress(addr)
 }
 
-// Generate a maskable IRQ (hardware) interrupt request (unused)
-func (cpu *CPU) irq() {
-	if !cpu.Reg.InterruptDisable {
-		cpu.handleInterrupt(false, vectorIRQ)
+// IRQ requests a maskable hardware interrupt. The interrupt remains pending
+// until it is serviced at an instruction boundary by a call to Step, which
+// doesn't happen while the interrupt disable flag is set. A request made
+// between steps is treated as if it were asserted during the previously
+// executed instruction.
+func (cpu *CPU) IRQ() {
+	cpu.pendingIRQ = true
+}
+
+// NMI requests a non-maskable interrupt. It is serviced at the next
+// instruction boundary by a call to Step. An NMI takes priority over a
+// pending IRQ.
+func (cpu *CPU) NMI() {
+	cpu.pendingNMI = true
+}
+
+// PendingIRQ returns true if an IRQ has been requested but not yet
+// serviced.
+func (cpu *CPU) PendingIRQ() bool {
+	return cpu.pendingIRQ
+}
+
+// PendingNMI returns true if an NMI has been requested but not yet
+// serviced.
+func (cpu *CPU) PendingNMI() bool {
+	return cpu.pendingNMI
+}
+
+// InterruptDue returns true if the next call to Step will service a pending
+// interrupt instead of executing an instruction. A pending IRQ isn't due
+// while interrupts are disabled.
+func (cpu *CPU) InterruptDue() bool {
+	return !cpu.noPoll && (cpu.pendingNMI || cpu.pendingIRQ && !cpu.irqMasked())
+}
+
+// Perform the interrupt sequence for a pending interrupt, if there is one
+// that may be serviced. The sequence takes 7 cycles. The first instruction
+// of the interrupt handler always executes before another interrupt is
+// serviced.
+func (cpu *CPU) serviceInterrupt() bool {
+	var vector uint16
+	switch {
+	case cpu.noPoll:
+		return false
+	case cpu.pendingNMI:
+		cpu.pendingNMI = false
+		vector = vectorNMI
+	case cpu.pendingIRQ && !cpu.irqMasked():
+		cpu.pendingIRQ = false
+		vector = vectorIRQ
+	default:
+		return false
+	}
+
+	cpu.LastPC = cpu.Reg.PC
+	cpu.handleInterrupt(false, vector)
+	cpu.Cycles += 7
+	cpu.noPoll = true
+	return true
+}
+
+// Return true if IRQs were masked when interrupts were last polled.
+func (cpu *CPU) irqMasked() bool {
+	if cpu.irqMaskOld {
+		return cpu.irqMask
 	}
+	return cpu.Reg.InterruptDisable
 }
 
-// Generate a non-maskable interrupt (unused)
-func (cpu *CPU) nmi() {
-	cpu.handleInterrupt(false, vectorNMI)
+// Reset performs the CPU's reset sequence. It loads the program counter
+// from the reset vector, disables interrupts and discards any pending
+// interrupt requests. The CMOS 65C02 also clears the decimal flag. Other
+// registers and the cycle counter are left unchanged.
+func (cpu *CPU) Reset() {
+	cpu.Reg.PC = cpu.Mem.LoadAddress(vectorReset)
+	cpu.Reg.InterruptDisable = true
+	cpu.pendingIRQ, cpu.pendingNMI = false, false
+	cpu.irqMaskOld, cpu.noPoll = false, false
+	if cpu.Arch == CMOS {
+		cpu.Reg.Decimal = false
+	}
 }
 
 // Generate a reset signal.
 func (cpu *CPU) reset() {
-	cpu.Reg.PC = cpu.Mem.LoadAddress(vectorReset)
+	cpu.Reset()
+	if cpu.rstHandler != nil {
+		cpu.rstHandler.OnReset(cpu)
+	}
 }
 
 // Add with carry (CMOS)
@@ -1,6 +1,7 @@
 package cpu_test
 
 import (
+	"bytes"
 	"os"
 	"strings"
 	"testing"
@@ -10,6 +11,10 @@ import (
 )
 
 func loadCPU(t *testing.T, asmString string) *cpu.CPU {
+	return loadCPUArch(t, cpu.NMOS, asmString)
+}
+
+func loadCPUArch(t *testing.T, arch cpu.Architecture, asmString string) *cpu.CPU {
 	b := strings.NewReader(asmString)
 	r, sm, err := asm.Assemble(b, "test.asm", 0x1000, os.Stdout, 0)
 	if err != nil {
@@ -18,7 +23,7 @@ func loadCPU(t *testing.T, asmString string) *cpu.CPU {
 	}
 
 	mem := cpu.NewFlatMemory()
-	cpu := cpu.NewCPU(cpu.NMOS, mem)
+	cpu := cpu.NewCPU(arch, mem)
 	mem.StoreBytes(sm.Origin, r.Code)
 	cpu.SetPC(sm.Origin)
 	return cpu
@@ -31,7 +36,11 @@ func stepCPU(cpu *cpu.CPU, steps int) {
 }
 
 func runCPU(t *testing.T, asmString string, steps int) *cpu.CPU {
-	cpu := loadCPU(t, asmString)
+	return runCPUArch(t, cpu.NMOS, asmString, steps)
+}
+
+func runCPUArch(t *testing.T, arch cpu.Architecture, asmString string, steps int) *cpu.CPU {
+	cpu := loadCPUArch(t, arch, asmString)
 	if cpu != nil {
 		stepCPU(cpu, steps)
 	}
@@ -62,6 +71,14 @@ func expectSP(t *testing.T, cpu *cpu.CPU, sp byte) {
 	}
 }
 
+// Compare the status flags selected by mask against the expected flags.
+func expectFlags(t *testing.T, cpu *cpu.CPU, mask, ps byte) {
+	got := cpu.Reg.SavePS(false) & mask
+	if got != ps&mask {
+		t.Errorf("Status flags incorrect. exp: %08b, got: %08b (mask %08b)", ps&mask, got, mask)
+	}
+}
+
 func expectMem(t *testing.T, cpu *cpu.CPU, addr uint16, v byte) {
 	got := cpu.Mem.LoadByte(addr)
 	if got != v {
@@ -122,6 +139,32 @@ func TestStack(t *testing.T) {
 	expectMem(t, cpu, 0x2002, 0x11)
 }
 
+func TestStackPage(t *testing.T) {
+	asm := `
+	.ORG $1000
+	LDA #$11
+	PHA
+	JSR SUB
+	PLA
+	STA $2000
+	BRK
+SUB	RTS`
+
+	cpu := loadCPU(t, asm)
+	cpu.StackPage = 0x04
+	stepCPU(cpu, 3)
+
+	expectSP(t, cpu, 0xfc)
+	expectMem(t, cpu, 0x4ff, 0x11)
+	expectMem(t, cpu, 0x4fe, 0x10)
+	expectMem(t, cpu, 0x4fd, 0x05)
+	expectMem(t, cpu, 0x1ff, 0x00)
+
+	stepCPU(cpu, 3)
+	expectSP(t, cpu, 0xff)
+	expectMem(t, cpu, 0x2000, 0x11)
+}
+
 func TestIndirect(t *testing.T) {
 	asm := `
 	.ORG $1000
@@ -149,6 +192,204 @@ func TestIndirect(t *testing.T) {
 	expectMem(t, cpu, 0x0512, 0xbb)
 }
 
+func TestEffectiveAddress(t *testing.T) {
+	code := `
+	.ORG $1000
+	LDA $10,X
+	LDX $FE,Y
+	LDA $12FF,X
+	STA $2000,Y
+	LDA ($05,X)
+	STA ($06),Y
+	JMP ($0006)
+	BNE $1000
+	LDA #$10
+	NOP`
+
+	cpu := loadCPU(t, code)
+	if cpu == nil {
+		return
+	}
+	cpu.Reg.X, cpu.Reg.Y = 0x05, 0x03
+	cpu.Mem.StoreAddress(0x0006, 0x3456)
+	cpu.Mem.StoreAddress(0x000a, 0x789a)
+
+	exp := []struct {
+		ea uint16
+		ok bool
+	}{
+		{0x0015, true},
+		{0x0001, true},
+		{0x1304, true},
+		{0x2003, true},
+		{0x789a, true},
+		{0x3459, true},
+		{0x3456, true},
+		{0, false},
+		{0, false},
+		{0, false},
+	}
+
+	addr := uint16(0x1000)
+	for i, e := range exp {
+		inst := cpu.GetInstruction(addr)
+		operand := make([]byte, inst.Length-1)
+		cpu.PeekBytes(addr+1, operand)
+		ea, ok := cpu.EffectiveAddress(inst, operand)
+		if ea != e.ea || ok != e.ok {
+			t.Errorf("instruction %d: exp ($%04X, %v), got ($%04X, %v)", i, e.ea, e.ok, ea, ok)
+		}
+		addr = cpu.NextAddr(addr)
+	}
+	expectPC(t, cpu, 0x1000)
+}
+
+func TestEffectiveAddressArch(t *testing.T) {
+	for _, arch := range []cpu.Architecture{cpu.NMOS, cpu.CMOS} {
+		c := cpu.NewCPU(arch, cpu.NewFlatMemory())
+		c.Reg.X, c.Reg.Y = 0x02, 0x04
+		c.Mem.StoreBytes(0x12ff, []byte{0x34, 0x56})
+		c.Mem.StoreByte(0x1200, 0x78)
+		c.Mem.StoreAddress(0x0010, 0x2000)
+
+		tests := []struct {
+			opcode  byte
+			operand []byte
+			addr    uint16
+			ok      bool
+		}{
+			{0xb5, []byte{0xff}, 0x0001, true},       // LDA $FF,X
+			{0x99, []byte{0xfe, 0x20}, 0x2102, true}, // STA $20FE,Y
+			{0xb1, []byte{0x10}, 0x2004, true},       // LDA ($10),Y
+			{0x6c, []byte{0xff, 0x12}, 0x7834, true}, // JMP ($12FF)
+			{0xa9, []byte{0x10}, 0, false},           // LDA #$10
+			{0xd0, []byte{0x10}, 0, false},           // BNE
+			{0xea, []byte{}, 0, false},               // NOP
+		}
+		if arch == cpu.CMOS {
+			tests[3].addr = 0x5634
+		}
+
+		for _, tt := range tests {
+			inst := c.InstSet.Lookup(tt.opcode)
+			addr, ok := c.EffectiveAddress(inst, tt.operand)
+			if addr != tt.addr || ok != tt.ok {
+				t.Errorf("%s %s: exp ($%04X, %v), got ($%04X, %v)", archNames[arch], inst.Name, tt.addr, tt.ok, addr, ok)
+			}
+		}
+	}
+}
+
+var archNames = map[cpu.Architecture]string{
+	cpu.NMOS: "NMOS",
+	cpu.CMOS: "CMOS",
+}
+
+func TestDecimalADC(t *testing.T) {
+	tests := []struct {
+		a, add byte
+		carry  bool
+		exp    byte
+		ps     byte
+	}{
+		{0x12, 0x34, false, 0x46, 0},
+		{0x58, 0x46, true, 0x05, cpu.CarryBit},
+		{0x09, 0x01, false, 0x10, 0},
+		{0x45, 0x45, false, 0x90, cpu.SignBit},
+		{0x99, 0x98, true, 0x98, cpu.CarryBit | cpu.SignBit},
+	}
+
+	// The 65C02 takes an extra cycle to perform a decimal mode addition.
+	cycles := map[cpu.Architecture]uint64{cpu.NMOS: 2, cpu.CMOS: 3}
+	mask := byte(cpu.CarryBit | cpu.SignBit)
+
+	for arch, name := range archNames {
+		for _, tt := range tests {
+			c := loadCPUArch(t, arch, "\t.ORG $1000\n\tADC #$00")
+			if c == nil {
+				return
+			}
+			c.Mem.StoreByte(0x1001, tt.add)
+			c.Reg.A, c.Reg.Carry, c.Reg.Decimal = tt.a, tt.carry, true
+			c.Step()
+
+			if c.Reg.A != tt.exp {
+				t.Errorf("%s: $%02X+$%02X: exp $%02X, got $%02X", name, tt.a, tt.add, tt.exp, c.Reg.A)
+			}
+			expectFlags(t, c, mask, tt.ps)
+			expectCycles(t, c, cycles[arch])
+		}
+	}
+}
+
+func TestDecimalSBC(t *testing.T) {
+	tests := []struct {
+		a, sub byte
+		carry  bool
+		exp    byte
+		ps     byte
+	}{
+		{0x46, 0x12, true, 0x34, cpu.CarryBit},
+		{0x40, 0x13, true, 0x27, cpu.CarryBit},
+		{0x32, 0x02, false, 0x29, cpu.CarryBit},
+		{0x12, 0x21, true, 0x91, cpu.SignBit},
+		{0x00, 0x01, true, 0x99, cpu.SignBit},
+	}
+
+	// The 65C02 takes an extra cycle to perform a decimal mode subtraction.
+	cycles := map[cpu.Architecture]uint64{cpu.NMOS: 2, cpu.CMOS: 3}
+	mask := byte(cpu.CarryBit | cpu.SignBit)
+
+	for arch, name := range archNames {
+		for _, tt := range tests {
+			c := loadCPUArch(t, arch, "\t.ORG $1000\n\tSBC #$00")
+			if c == nil {
+				return
+			}
+			c.Mem.StoreByte(0x1001, tt.sub)
+			c.Reg.A, c.Reg.Carry, c.Reg.Decimal = tt.a, tt.carry, true
+			c.Step()
+
+			if c.Reg.A != tt.exp {
+				t.Errorf("%s: $%02X-$%02X: exp $%02X, got $%02X", name, tt.a, tt.sub, tt.exp, c.Reg.A)
+			}
+			expectFlags(t, c, mask, tt.ps)
+			expectCycles(t, c, cycles[arch])
+		}
+	}
+}
+
+func TestJumpIndirectPageWrap(t *testing.T) {
+	asm := `
+	.ORG $1000
+	JMP ($12FF)`
+
+	// The NMOS 6502 fetches the high byte of the target from the start of
+	// the pointer's page. The 65C02 fixes the bug and takes an extra cycle.
+	tests := []struct {
+		arch   cpu.Architecture
+		pc     uint16
+		cycles uint64
+	}{
+		{cpu.NMOS, 0x5634, 5},
+		{cpu.CMOS, 0x7834, 6},
+	}
+
+	for _, tt := range tests {
+		c := loadCPUArch(t, tt.arch, asm)
+		if c == nil {
+			return
+		}
+		c.Mem.StoreByte(0x12ff, 0x34)
+		c.Mem.StoreByte(0x1200, 0x56)
+		c.Mem.StoreByte(0x1300, 0x78)
+		c.Step()
+
+		expectPC(t, c, tt.pc)
+		expectCycles(t, c, tt.cycles)
+	}
+}
+
 func TestPageCross(t *testing.T) {
 	asm := `
 	.ORG $1000
@@ -169,6 +410,555 @@ func TestPageCross(t *testing.T) {
 	expectMem(t, cpu, 0x1101, 0x55)
 }
 
+func TestIndexedStoreCycles(t *testing.T) {
+	tests := []struct {
+		code   string
+		cycles uint64 // cycles without a page crossing
+		extra  uint64 // additional cycles when a page is crossed
+	}{
+		{"STA $2080,X", 5, 0},
+		{"STA $2080,Y", 5, 0},
+		{"STA ($20),Y", 6, 0},
+		{"LDA $2080,X", 4, 1},
+		{"LDA $2080,Y", 4, 1},
+		{"LDA ($20),Y", 5, 1},
+	}
+
+	for _, arch := range []cpu.Architecture{cpu.NMOS, cpu.CMOS} {
+		for _, tt := range tests {
+			for _, index := range []byte{0x10, 0xf0} {
+				c := loadCPUArch(t, arch, "\t.ORG $1000\n\t"+tt.code)
+				if c == nil {
+					return
+				}
+				c.Mem.StoreAddress(0x20, 0x2080)
+				c.Reg.X, c.Reg.Y = index, index
+				stepCPU(c, 1)
+
+				exp := tt.cycles
+				if index == 0xf0 {
+					exp += tt.extra
+				}
+				if c.Cycles != exp {
+					t.Errorf("%s %s with index $%02X: exp %d cycles, got %d", archNames[arch], tt.code, index, exp, c.Cycles)
+				}
+			}
+		}
+	}
+}
+
+func TestBranchNotTaken(t *testing.T) {
+	asm := `
+	.ORG $1000
+	LDA #$00		; 2 cycles
+	BNE $1010		; 2 cycles (not taken)`
+
+	cpu := runCPU(t, asm, 2)
+	if cpu == nil {
+		return
+	}
+
+	expectPC(t, cpu, 0x1004)
+	expectCycles(t, cpu, 4)
+}
+
+func TestBranchTaken(t *testing.T) {
+	asm := `
+	.ORG $1000
+	LDA #$01		; 2 cycles
+	BNE $1010		; 3 cycles (taken, same page)`
+
+	cpu := runCPU(t, asm, 2)
+	if cpu == nil {
+		return
+	}
+
+	expectPC(t, cpu, 0x1010)
+	expectCycles(t, cpu, 5)
+}
+
+func TestBranchPageCross(t *testing.T) {
+	asm := `
+	.ORG $10FB
+	LDA #$01		; 2 cycles
+	BNE $1110		; 4 cycles (taken, page crossed)`
+
+	cpu := runCPU(t, asm, 2)
+	if cpu == nil {
+		return
+	}
+
+	expectPC(t, cpu, 0x1110)
+	expectCycles(t, cpu, 6)
+}
+
+type stackHandler struct {
+	overflows, underflows int
+}
+
+func (h *stackHandler) OnStackOverflow(cpu *cpu.CPU)  { h.overflows++ }
+func (h *stackHandler) OnStackUnderflow(cpu *cpu.CPU) { h.underflows++ }
+
+func TestStackWrap(t *testing.T) {
+	asm := `
+	.ORG $1000
+	LDX #$00
+	TXS
+	PHA
+	PLA
+	PLA`
+
+	c := loadCPU(t, asm)
+	if c == nil {
+		return
+	}
+
+	h := &stackHandler{}
+	d := cpu.NewDebugger(nil)
+	d.AttachStackHandler(h)
+	c.AttachDebugger(d)
+
+	stepCPU(c, 3)
+	if h.overflows != 1 || h.underflows != 0 {
+		t.Errorf("expected 1 overflow, got %d overflows, %d underflows", h.overflows, h.underflows)
+	}
+
+	stepCPU(c, 2)
+	if h.overflows != 1 || h.underflows != 1 {
+		t.Errorf("expected 1 underflow, got %d overflows, %d underflows", h.overflows, h.underflows)
+	}
+}
+
+type dataBreakpointHandler struct {
+	values []byte
+}
+
+func (h *dataBreakpointHandler) OnBreakpoint(cpu *cpu.CPU, b *cpu.Breakpoint) {}
+
+func (h *dataBreakpointHandler) OnDataBreakpoint(cpu *cpu.CPU, b *cpu.DataBreakpoint) {
+	h.values = append(h.values, cpu.Reg.A)
+}
+
+func TestDataBreakpointAfterAttach(t *testing.T) {
+	asm := `
+	.ORG $1000
+	LDA #$01
+	STA $20
+	LDA #$02
+	STA $20
+	LDA #$03
+	STA $20`
+
+	c := loadCPU(t, asm)
+	h := &dataBreakpointHandler{}
+	d := cpu.NewDebugger(h)
+	c.AttachDebugger(d)
+
+	// Breakpoints added and removed while the debugger is attached take
+	// effect immediately.
+	d.AddDataBreakpoint(0x20)
+	stepCPU(c, 2)
+	d.RemoveDataBreakpoint(0x20)
+	stepCPU(c, 2)
+	d.AddStackDataBreakpoint()
+	d.AddDataBreakpoint(0x20)
+	stepCPU(c, 2)
+	if !bytes.Equal(h.values, []byte{0x01, 0x03}) {
+		t.Errorf("unexpected data breakpoint values % X", h.values)
+	}
+}
+
+func TestMaskedDataBreakpoint(t *testing.T) {
+	asm := `
+	.ORG $1000
+	LDA #$7F
+	STA $20
+	LDA #$80
+	STA $20
+	LDA #$05
+	STA $20
+	LDA #$C1
+	STA $20
+	LDA #$11
+	STA $21
+	LDA #$12
+	STA $21`
+
+	c := loadCPU(t, asm)
+	if c == nil {
+		return
+	}
+
+	h := &dataBreakpointHandler{}
+	d := cpu.NewDebugger(h)
+	d.AddMaskedDataBreakpoint(0x20, 0x80, 0x80)
+	d.AddConditionalDataBreakpoint(0x21, 0x12)
+	c.AttachDebugger(d)
+
+	stepCPU(c, 12)
+	if !bytes.Equal(h.values, []byte{0x80, 0xc1, 0x12}) {
+		t.Errorf("unexpected data breakpoint values % X", h.values)
+	}
+
+	// A zero mask compares all bits.
+	if b := d.AddMaskedDataBreakpoint(0x22, 0, 0x34); b.Mask != 0xff || b.Value != 0x34 {
+		t.Errorf("zero mask not normalized. got mask $%02X, value $%02X", b.Mask, b.Value)
+	}
+}
+
+func TestStoreLog(t *testing.T) {
+	asm := `
+	.ORG $1000
+	LDA #$05
+	STA $20
+	INC $20
+	STA $21`
+
+	c := loadCPU(t, asm)
+	if c == nil {
+		return
+	}
+
+	h := &dataBreakpointHandler{}
+	d := cpu.NewDebugger(h)
+	d.AddLogDataBreakpoint(0x20)
+	c.AttachDebugger(d)
+
+	stepCPU(c, 4)
+	if len(h.values) != 0 {
+		t.Errorf("watch stopped the CPU")
+	}
+
+	exp := []cpu.StoreRecord{
+		{PC: 0x1002, Address: 0x20, Value: 0x05, Cycles: 2},
+		{PC: 0x1004, Address: 0x20, Value: 0x06, Cycles: 5},
+	}
+	log := d.GetStoreLog()
+	if len(log) != len(exp) {
+		t.Fatalf("expected %d logged stores, got %d", len(exp), len(log))
+	}
+	for i := range exp {
+		if log[i] != exp[i] {
+			t.Errorf("store %d: exp %+v, got %+v", i, exp[i], log[i])
+		}
+	}
+
+	d.ClearStoreLog()
+	if len(d.GetStoreLog()) != 0 {
+		t.Errorf("store log not cleared")
+	}
+}
+
+func TestStoreLogFull(t *testing.T) {
+	asm := `
+	.ORG $1000
+LOOP	INX
+	STX $20
+	JMP LOOP`
+
+	c := loadCPU(t, asm)
+	d := cpu.NewDebugger(&dataBreakpointHandler{})
+	d.AddLogDataBreakpoint(0x20)
+	c.AttachDebugger(d)
+
+	// Once the log is full, the oldest stores are discarded.
+	const stores = 10000 + 300
+	stepCPU(c, stores*3)
+	log := d.GetStoreLog()
+	if len(log) != 10000 {
+		t.Fatalf("expected 10000 logged stores, got %d", len(log))
+	}
+	for i, r := range log {
+		if exp := byte(300 + 1 + i); r.Value != exp {
+			t.Fatalf("store %d: exp value $%02X, got $%02X", i, exp, r.Value)
+		}
+	}
+}
+
+func TestStackDataBreakpoint(t *testing.T) {
+	asm := `
+	.ORG $1000
+	LDX #$FF
+	TXS
+	JSR SUB
+	LDA #$AA
+	STA $01F0
+	BRK
+SUB	PHA
+	TSX
+	LDA #$00
+	STA $0102,X
+	PLA
+	RTS`
+
+	c := loadCPU(t, asm)
+	if c == nil {
+		return
+	}
+
+	h := &dataBreakpointHandler{}
+	d := cpu.NewDebugger(h)
+	b := d.AddStackDataBreakpoint()
+	c.AttachDebugger(d)
+
+	stepCPU(c, 7)
+	if !bytes.Equal(h.values, []byte{0x00}) {
+		t.Fatalf("unexpected stack data breakpoint values % X", h.values)
+	}
+	if b.Address != 0x01fe {
+		t.Errorf("expected store to $01FE, got $%04X", b.Address)
+	}
+
+	// Stores below the stack pointer don't touch the in-use stack.
+	stepCPU(c, 4)
+	if len(h.values) != 1 {
+		t.Errorf("unexpected stack data breakpoint at $%04X", b.Address)
+	}
+}
+
+func TestHistory(t *testing.T) {
+	asm := `
+	.ORG $1000
+	LDX #$00
+LOOP	INX
+	BNE LOOP`
+
+	c := loadCPU(t, asm)
+	if c == nil {
+		return
+	}
+
+	d := cpu.NewDebugger(nil)
+	c.AttachDebugger(d)
+
+	stepCPU(c, 3)
+	h := d.GetHistory()
+	if len(h) != 3 || h[0].PC != 0x1000 || h[1].PC != 0x1002 || h[2].PC != 0x1003 {
+		t.Fatalf("unexpected history %+v", h)
+	}
+	if h[2].Reg.PC != 0x1002 || h[2].Reg.X != 1 || h[2].Cycles != c.Cycles {
+		t.Errorf("unexpected state after branch %+v", h[2])
+	}
+
+	stepCPU(c, 100)
+	h = d.GetHistory()
+	if len(h) != 64 {
+		t.Fatalf("expected 64 history records, got %d", len(h))
+	}
+	if h[63].PC != 0x1003 || h[63].Reg.X != 51 {
+		t.Errorf("unexpected last history record %+v", h[63])
+	}
+
+	c.IRQ()
+	c.Reg.InterruptDisable = false
+	stepCPU(c, 1)
+	h = d.GetHistory()
+	if last := h[len(h)-1]; !last.Interrupt || last.Reg.PC != c.Reg.PC {
+		t.Errorf("interrupt not recorded: %+v", last)
+	}
+
+	d.ClearHistory()
+	if len(d.GetHistory()) != 0 {
+		t.Errorf("history not cleared")
+	}
+}
+
+type illegalHandler struct {
+	count int
+}
+
+func (h *illegalHandler) OnIllegalOpcode(cpu *cpu.CPU) { h.count++ }
+
+func TestReset(t *testing.T) {
+	code := `
+	.ORG $1000
+	SED
+	CLI
+	LDA #$12`
+
+	cpu := runCPU(t, code, 3)
+	if cpu == nil {
+		return
+	}
+	cpu.Mem.StoreAddress(0xfffc, 0x2000)
+	cpu.Reset()
+
+	expectPC(t, cpu, 0x2000)
+	expectACC(t, cpu, 0x12)
+	if !cpu.Reg.InterruptDisable {
+		t.Error("interrupt disable flag not set by reset")
+	}
+	if !cpu.Reg.Decimal {
+		t.Error("decimal flag cleared by NMOS reset")
+	}
+}
+
+func TestInterrupts(t *testing.T) {
+	code := `
+	.ORG $1000
+	SEI
+	NOP
+	CLI
+	NOP
+	NOP`
+
+	c := loadCPU(t, code)
+	if c == nil {
+		return
+	}
+	c.Mem.StoreAddress(0xfffe, 0x2000)
+	c.Mem.StoreAddress(0xfffa, 0x3000)
+	c.Mem.StoreByte(0x2000, 0xea)
+
+	// An IRQ stays pending while interrupts are disabled, and CLI takes
+	// effect only after the following instruction.
+	stepCPU(c, 2)
+	c.IRQ()
+	stepCPU(c, 1)
+	if c.InterruptDue() {
+		t.Error("IRQ due while interrupts are disabled")
+	}
+	stepCPU(c, 1)
+	expectPC(t, c, 0x1004)
+	if !c.PendingIRQ() {
+		t.Error("expected IRQ to remain pending")
+	}
+	if !c.InterruptDue() {
+		t.Error("expected IRQ to be due")
+	}
+
+	cycles, sp := c.Cycles, c.Reg.SP
+	stepCPU(c, 1)
+	expectPC(t, c, 0x2000)
+	expectCycles(t, c, cycles+7)
+	expectSP(t, c, sp-3)
+	if c.PendingIRQ() {
+		t.Error("expected IRQ to be serviced")
+	}
+	if c.Mem.LoadAddress(0x100|uint16(sp-1)) != 0x1004 {
+		t.Error("incorrect return address pushed by IRQ")
+	}
+
+	// An NMI takes priority over an IRQ, and the first instruction of the
+	// handler executes before another interrupt is serviced.
+	stepCPU(c, 1)
+	expectPC(t, c, 0x2001)
+	c.Reg.InterruptDisable = false
+	c.IRQ()
+	c.NMI()
+	stepCPU(c, 1)
+	expectPC(t, c, 0x3000)
+	if c.PendingNMI() || !c.PendingIRQ() {
+		t.Error("expected NMI to be serviced before IRQ")
+	}
+	if c.InterruptDue() {
+		t.Error("interrupt due before the handler's first instruction")
+	}
+
+	c.Mem.StoreByte(0x3000, 0x58) // CLI
+	c.NMI()
+	stepCPU(c, 1)
+	expectPC(t, c, 0x3001)
+	stepCPU(c, 1)
+	expectPC(t, c, 0x3000)
+}
+
+func TestRunUntil(t *testing.T) {
+	code := `
+	.ORG $1000
+	LDX #0
+LOOP	INX
+	BNE LOOP
+	BRK`
+
+	c := loadCPU(t, code)
+	if c == nil {
+		return
+	}
+
+	stopped := c.RunUntil(func(c *cpu.CPU) bool { return c.Reg.X == 10 }, 100)
+	if !stopped {
+		t.Error("expected RunUntil to stop on the predicate")
+	}
+	expectPC(t, c, 0x1003)
+
+	stopped = c.RunUntil(func(c *cpu.CPU) bool { return false }, 5)
+	if stopped {
+		t.Error("expected RunUntil to stop at the step limit")
+	}
+	expectPC(t, c, 0x1002)
+}
+
+func TestIllegalOpcode(t *testing.T) {
+	asm := `
+	.ORG $1000
+	NOP
+	.DH 02`
+
+	c := loadCPU(t, asm)
+	if c == nil {
+		return
+	}
+
+	h := &illegalHandler{}
+	c.AttachIllegalOpcodeHandler(h)
+
+	stepCPU(c, 2)
+	if h.count != 1 {
+		t.Errorf("expected 1 illegal opcode, got %d", h.count)
+	}
+	expectPC(t, c, 0x1001)
+	expectCycles(t, c, 2)
+}
+
+func TestUnused65c02Reference(t *testing.T) {
+	// Lengths and cycle counts of the 65C02's unused opcodes, which all
+	// behave as NOPs.
+	type nop struct{ length, cycles byte }
+	ref := map[byte]nop{
+		0x02: {2, 2}, 0x22: {2, 2}, 0x42: {2, 2}, 0x62: {2, 2},
+		0x82: {2, 2}, 0xc2: {2, 2}, 0xe2: {2, 2},
+		0x44: {2, 3}, 0x54: {2, 4}, 0xd4: {2, 4}, 0xf4: {2, 4},
+		0x5c: {3, 8}, 0xdc: {3, 4}, 0xfc: {3, 4},
+	}
+	for i := 0; i < 16; i++ {
+		for _, lo := range []byte{0x03, 0x07, 0x0b, 0x0f} {
+			ref[byte(i<<4)|lo] = nop{1, 1}
+		}
+	}
+
+	set := cpu.GetInstructionSet(cpu.CMOS)
+	for i := 0; i < 256; i++ {
+		opcode := byte(i)
+		inst := set.Lookup(opcode)
+		r, ok := ref[opcode]
+		if inst.Name != "???" {
+			if ok {
+				t.Errorf("opcode $%02X should be unused, got %s", opcode, inst.Name)
+			}
+			continue
+		}
+		if !ok {
+			t.Errorf("opcode $%02X is unexpectedly unused", opcode)
+			continue
+		}
+		if inst.Length != r.length || inst.Cycles != r.cycles {
+			t.Errorf("opcode $%02X: exp length %d cycles %d, got length %d cycles %d",
+				opcode, r.length, r.cycles, inst.Length, inst.Cycles)
+		}
+
+		// Execute the opcode and make sure the PC and cycle counter advance
+		// by the expected amounts.
+		mem := cpu.NewFlatMemory()
+		c := cpu.NewCPU(cpu.CMOS, mem)
+		mem.StoreBytes(0x1000, []byte{opcode, 0xea, 0xea})
+		c.SetPC(0x1000)
+		c.Step()
+		expectPC(t, c, 0x1000+uint16(r.length))
+		expectCycles(t, c, uint64(r.cycles))
+	}
+}
+
 func TestUnused65c02(t *testing.T) {
 	asm := `
 	.ORG $1000
@@ -188,3 +978,185 @@ func TestUnused65c02(t *testing.T) {
 	expectPC(t, cpu, 0x1009)
 	expectCycles(t, cpu, 10)
 }
+
+func TestFlatMemoryWords(t *testing.T) {
+	mem := cpu.NewFlatMemory()
+
+	mem.StoreWord(0x12ff, 0xabcd)
+	if v := mem.LoadByte(0x12ff); v != 0xcd {
+		t.Errorf("low byte incorrect. exp: $CD, got: $%02X", v)
+	}
+	if v := mem.LoadByte(0x1300); v != 0xab {
+		t.Errorf("high byte incorrect. exp: $AB, got: $%02X", v)
+	}
+	if v := mem.LoadWord(0x12ff); v != 0xabcd {
+		t.Errorf("word incorrect. exp: $ABCD, got: $%04X", v)
+	}
+
+	mem.Fill(0xfff0, 0xffff, 0xea)
+	for a := 0xfff0; a <= 0xffff; a++ {
+		if v := mem.LoadByte(uint16(a)); v != 0xea {
+			t.Errorf("Memory at $%04X incorrect. exp: $EA, got: $%02X", a, v)
+		}
+	}
+	if v := mem.LoadByte(0xffef); v != 0 {
+		t.Errorf("Memory at $FFEF incorrect. exp: $00, got: $%02X", v)
+	}
+}
+
+type testDevice struct {
+	loads  []uint16
+	stores []uint16
+}
+
+func (d *testDevice) LoadByte(offset uint16) byte {
+	d.loads = append(d.loads, offset)
+	return 0x40 + byte(offset)
+}
+
+func (d *testDevice) StoreByte(offset uint16, v byte) {
+	d.stores = append(d.stores, offset)
+}
+
+func (d *testDevice) PeekByte(offset uint16) byte {
+	return 0x40 + byte(offset)
+}
+
+func TestMappedMemory(t *testing.T) {
+	code := `
+	.ORG $1000
+	LDA $C001
+	STA $C000
+	STA $0200
+	LDX $C002`
+
+	b := strings.NewReader(code)
+	r, sm, err := asm.Assemble(b, "test.asm", 0x1000, os.Stdout, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	mem := cpu.NewMappedMemory()
+	dev := &testDevice{}
+	if err := mem.Map(0xc000, 0xc001, dev); err != nil {
+		t.Fatal(err)
+	}
+	if err := mem.Map(0xc001, 0xc00f, dev); err != cpu.ErrMemoryMapOverlap {
+		t.Errorf("expected overlap error, got %v", err)
+	}
+
+	c := cpu.NewCPU(cpu.NMOS, mem)
+	mem.StoreBytes(sm.Origin, r.Code)
+	c.SetPC(sm.Origin)
+	stepCPU(c, 4)
+
+	expectACC(t, c, 0x41)
+	expectMem(t, c, 0x0200, 0x41)
+	if c.Reg.X != 0 {
+		t.Errorf("X register incorrect. exp: $00, got: $%02X", c.Reg.X)
+	}
+	if len(dev.loads) != 1 || dev.loads[0] != 1 {
+		t.Errorf("unexpected device loads %v", dev.loads)
+	}
+	if len(dev.stores) != 1 || dev.stores[0] != 0 {
+		t.Errorf("unexpected device stores %v", dev.stores)
+	}
+
+	// Peeking reads the device without loading from it.
+	if v := c.PeekByte(0xc001); v != 0x41 {
+		t.Errorf("Peeked $C001 incorrect. exp: $41, got: $%02X", v)
+	}
+	if len(dev.loads) != 1 {
+		t.Errorf("unexpected device loads %v", dev.loads)
+	}
+
+	mem.Unmap(dev)
+	if v := mem.LoadByte(0xc001); v != 0 {
+		t.Errorf("Memory at $C001 incorrect. exp: $00, got: $%02X", v)
+	}
+}
+
+func TestOpenBus(t *testing.T) {
+	code := `
+	.ORG $1000
+	LDA $C010
+	STA $0200
+	LDX #$77
+	STX $C011`
+
+	b := strings.NewReader(code)
+	r, sm, err := asm.Assemble(b, "test.asm", 0x1000, os.Stdout, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	mem := cpu.NewMappedMemory()
+	mem.StoreByte(0xc010, 0x55)
+	mem.SetUnmapped(0xc000, 0xc0ff)
+	mem.OpenBus = true
+
+	c := cpu.NewCPU(cpu.NMOS, mem)
+	mem.StoreBytes(sm.Origin, r.Code)
+	c.SetPC(sm.Origin)
+	stepCPU(c, 4)
+
+	// The last byte on the bus before the read is the operand's high byte.
+	expectACC(t, c, 0xc0)
+	expectMem(t, c, 0x0200, 0xc0)
+
+	// Peeking leaves the bus unchanged.
+	bus := c.PeekByte(0xc010)
+	if v := c.PeekByte(0x1000); v != 0xad {
+		t.Errorf("Peeked $1000 incorrect. exp: $AD, got: $%02X", v)
+	}
+	if v := c.PeekByte(0xc010); v != bus {
+		t.Errorf("Peeked $C010 incorrect. exp: $%02X, got: $%02X", bus, v)
+	}
+
+	mem.OpenBus = false
+	expectMem(t, c, 0xc010, 0x55)
+	expectMem(t, c, 0xc011, 0x00)
+}
+
+// A loop that fills a page of memory forever.
+const fillLoop = `
+	.ORG $1000
+LOOP	LDX #0
+FILL	STA $2000,X
+	INX
+	BNE FILL
+	CLC
+	ADC #1
+	JMP LOOP`
+
+func TestRun(t *testing.T) {
+	b := strings.NewReader(fillLoop)
+	r, sm, err := asm.Assemble(b, "test.asm", 0x1000, os.Stdout, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	mem := cpu.NewFlatMemory()
+	mem.StoreBytes(sm.Origin, r.Code)
+
+	// LDX, then 256 iterations of STA, INX and BNE (the last not taken),
+	// then CLC, ADC and JMP.
+	cycles := cpu.Run(mem, cpu.NMOS, sm.Origin, 1+256*3+3)
+	if exp := uint64(2 + 256*(5+2+3) - 1 + 2 + 2 + 3); cycles != exp {
+		t.Errorf("expected %d cycles, got %d", exp, cycles)
+	}
+}
+
+func BenchmarkRun(b *testing.B) {
+	r, sm, err := asm.Assemble(strings.NewReader(fillLoop), "test.asm", 0x1000, os.Stdout, 0)
+	if err != nil {
+		b.Fatal(err)
+	}
+
+	mem := cpu.NewFlatMemory()
+	mem.StoreBytes(sm.Origin, r.Code)
+
+	b.ResetTimer()
+	cycles := cpu.Run(mem, cpu.NMOS, sm.Origin, b.N)
+	b.ReportMetric(float64(cycles)/float64(b.N), "cycles/op")
+}
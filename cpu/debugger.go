@@ -9,9 +9,17 @@ import "sort"
 // The Debugger interface may be implemented to intercept instructions before
 // and after they are executed on the emulated CPU.
 type Debugger struct {
+	cpu               *CPU // the CPU the debugger is attached to
 	breakpointHandler BreakpointHandler
 	breakpoints       map[uint16]*Breakpoint
 	dataBreakpoints   map[uint16]*DataBreakpoint
+	stackBreakpoint   *DataBreakpoint
+	stackHandler      StackHandler
+	storeLog          []StoreRecord // ring buffer of logged stores
+	storeLogNext      int           // index of the next record to overwrite when full
+	history           [historySize]ExecRecord
+	historyLen        int // number of valid history records
+	historyNext       int // index of the next history record to write
 }
 
 // The BreakpointHandler interface should be implemented by any object that
@@ -21,11 +29,20 @@ type BreakpointHandler interface {
 	OnDataBreakpoint(cpu *CPU, b *DataBreakpoint)
 }
 
+// The StackHandler interface should be implemented by any object that
+// wishes to be notified when the stack pointer wraps around the stack page.
+type StackHandler interface {
+	OnStackOverflow(cpu *CPU)
+	OnStackUnderflow(cpu *CPU)
+}
+
 // A Breakpoint represents an address that will cause the debugger to stop
 // code execution when the program counter reaches it.
 type Breakpoint struct {
 	Address  uint16 // address of execution breakpoint
 	Disabled bool   // this breakpoint is currently disabled
+	Command  string // command run by the breakpoint handler when hit
+	Continue bool   // continue execution after running Command
 }
 
 // A DataBreakpoint represents an address that will cause the debugger to
@@ -35,6 +52,45 @@ type DataBreakpoint struct {
 	Disabled    bool   // this breakpoint is currently disabled
 	Conditional bool   // this breakpoint is conditional on a certain Value being stored
 	Value       byte   // the value that must be stored if the breakpoint is conditional
+	Mask        byte   // bits of the stored value compared with Value (0 = all bits)
+	LogOnly     bool   // log matching stores instead of stopping the CPU
+	Stack       bool   // this breakpoint guards the in-use part of the stack
+}
+
+// A StoreRecord describes a store logged by a LogOnly data breakpoint.
+type StoreRecord struct {
+	PC      uint16 // address of the instruction that stored the value
+	Address uint16 // address the value was stored to
+	Value   byte   // the stored value
+	Cycles  uint64 // CPU cycle count before the storing instruction executed
+}
+
+// An ExecRecord describes a recently executed instruction, or a serviced
+// interrupt, along with the CPU state immediately afterward.
+type ExecRecord struct {
+	PC        uint16    // address of the executed instruction
+	Interrupt bool      // an interrupt was serviced instead of an instruction
+	Reg       Registers // registers after the instruction executed
+	Cycles    uint64    // CPU cycle count after the instruction executed
+}
+
+// The number of execution records kept in the debugger's history.
+const historySize = 64
+
+// The maximum number of store records kept by the debugger. Once the log is
+// full, the oldest records are discarded.
+const maxStoreLog = 10000
+
+// Return true if storing the value v triggers the data breakpoint.
+func (b *DataBreakpoint) matches(v byte) bool {
+	if !b.Conditional {
+		return true
+	}
+	mask := b.Mask
+	if mask == 0 {
+		mask = 0xff
+	}
+	return v&mask == b.Value&mask
 }
 
 // NewDebugger creates a new CPU debugger.
@@ -115,26 +171,155 @@ func (d *Debugger) GetDataBreakpoints() []*DataBreakpoint {
 func (d *Debugger) AddDataBreakpoint(addr uint16) *DataBreakpoint {
 	b := &DataBreakpoint{Address: addr}
 	d.dataBreakpoints[addr] = b
+	d.updateStoreByte()
 	return b
 }
 
 // AddConditionalDataBreakpoint adds a conditional data breakpoint on the
 // requested address.
-func (d *Debugger) AddConditionalDataBreakpoint(addr uint16, value byte) {
-	d.dataBreakpoints[addr] = &DataBreakpoint{
+func (d *Debugger) AddConditionalDataBreakpoint(addr uint16, value byte) *DataBreakpoint {
+	b := &DataBreakpoint{
 		Address:     addr,
 		Conditional: true,
 		Value:       value,
 	}
+	d.dataBreakpoints[addr] = b
+	d.updateStoreByte()
+	return b
+}
+
+// AddMaskedDataBreakpoint adds a conditional data breakpoint on the
+// requested address that is triggered when a stored value, after masking
+// with mask, equals value. For example, a mask and value of $80 trigger the
+// breakpoint whenever a value with bit 7 set is stored. A mask of 0 is
+// treated as $FF, so the breakpoint compares all bits, just like a
+// conditional data breakpoint. To break on any stored value, use
+// AddDataBreakpoint instead.
+func (d *Debugger) AddMaskedDataBreakpoint(addr uint16, mask, value byte) *DataBreakpoint {
+	if mask == 0 {
+		mask = 0xff
+	}
+	b := &DataBreakpoint{
+		Address:     addr,
+		Conditional: true,
+		Value:       value & mask,
+		Mask:        mask,
+	}
+	d.dataBreakpoints[addr] = b
+	d.updateStoreByte()
+	return b
+}
+
+// AddLogDataBreakpoint adds a data breakpoint on the requested address
+// that logs every store to the address without stopping the CPU. Use
+// GetStoreLog to retrieve the logged stores.
+func (d *Debugger) AddLogDataBreakpoint(addr uint16) *DataBreakpoint {
+	b := &DataBreakpoint{Address: addr, LogOnly: true}
+	d.dataBreakpoints[addr] = b
+	d.updateStoreByte()
+	return b
+}
+
+// GetStoreLog returns all stores logged by LogOnly data breakpoints, oldest
+// first.
+func (d *Debugger) GetStoreLog() []StoreRecord {
+	log := make([]StoreRecord, 0, len(d.storeLog))
+	log = append(log, d.storeLog[d.storeLogNext:]...)
+	return append(log, d.storeLog[:d.storeLogNext]...)
+}
+
+// ClearStoreLog discards all logged stores.
+func (d *Debugger) ClearStoreLog() {
+	d.storeLog, d.storeLogNext = nil, 0
 }
 
 // RemoveDataBreakpoint removes a (conditional or unconditional) data
 // breakpoint at the requested address.
 func (d *Debugger) RemoveDataBreakpoint(addr uint16) {
 	delete(d.dataBreakpoints, addr)
+	d.updateStoreByte()
+}
+
+// AddStackDataBreakpoint adds a data breakpoint that guards the in-use part
+// of the stack page, the addresses above the current stack pointer. It stops
+// the CPU whenever an instruction stores to one of these addresses, which
+// usually means a saved return address or status register is being
+// corrupted. Pushes never trigger it, because they store below the in-use
+// part of the stack. When triggered, the breakpoint's Address holds the
+// address that was stored to.
+func (d *Debugger) AddStackDataBreakpoint() *DataBreakpoint {
+	d.stackBreakpoint = &DataBreakpoint{Stack: true}
+	d.updateStoreByte()
+	return d.stackBreakpoint
+}
+
+// GetStackDataBreakpoint returns the stack data breakpoint, or nil if none
+// has been added.
+func (d *Debugger) GetStackDataBreakpoint() *DataBreakpoint {
+	return d.stackBreakpoint
+}
+
+// RemoveStackDataBreakpoint removes the stack data breakpoint.
+func (d *Debugger) RemoveStackDataBreakpoint() {
+	d.stackBreakpoint = nil
+	d.updateStoreByte()
+}
+
+// Check the attached CPU's stores for data breakpoints only while there
+// are data breakpoints to check, so that stores are as fast as possible
+// otherwise.
+func (d *Debugger) updateStoreByte() {
+	if d.cpu == nil || d.cpu.debugger != d {
+		return
+	}
+	if len(d.dataBreakpoints) > 0 || d.stackBreakpoint != nil {
+		d.cpu.storeByte = (*CPU).storeByteDebugger
+	} else {
+		d.cpu.storeByte = (*CPU).storeByteNormal
+	}
+}
+
+// GetHistory returns the most recently executed instructions, oldest
+// first. Up to 64 records are kept.
+func (d *Debugger) GetHistory() []ExecRecord {
+	h := make([]ExecRecord, 0, d.historyLen)
+	for i := d.historyNext - d.historyLen; i < d.historyNext; i++ {
+		h = append(h, d.history[(i+historySize)%historySize])
+	}
+	return h
+}
+
+// ClearHistory discards all execution records.
+func (d *Debugger) ClearHistory() {
+	d.historyLen, d.historyNext = 0, 0
+}
+
+// Add a record to the execution history, overwriting the oldest record if
+// the history is full.
+func (d *Debugger) addHistory(cpu *CPU, interrupt bool) {
+	d.history[d.historyNext] = ExecRecord{
+		PC:        cpu.LastPC,
+		Interrupt: interrupt,
+		Reg:       cpu.Reg,
+		Cycles:    cpu.Cycles,
+	}
+	d.historyNext = (d.historyNext + 1) % historySize
+	if d.historyLen < historySize {
+		d.historyLen++
+	}
+}
+
+func (d *Debugger) onInterrupt(cpu *CPU) {
+	d.addHistory(cpu, true)
+	d.checkBreakpoint(cpu, cpu.Reg.PC)
 }
 
 func (d *Debugger) onUpdatePC(cpu *CPU, addr uint16) {
+	d.addHistory(cpu, false)
+	d.checkBreakpoint(cpu, addr)
+}
+
+func (d *Debugger) checkBreakpoint(cpu *CPU, addr uint16) {
 	if d.breakpointHandler != nil {
 		if b, ok := d.breakpoints[addr]; ok && !b.Disabled {
 			d.breakpointHandler.OnBreakpoint(cpu, b)
@@ -143,11 +328,53 @@ func (d *Debugger) onUpdatePC(cpu *CPU, addr uint16) {
 }
 
 func (d *Debugger) onDataStore(cpu *CPU, addr uint16, v byte) {
-	if d.breakpointHandler != nil {
-		if b, ok := d.dataBreakpoints[addr]; ok && !b.Disabled {
-			if !b.Conditional || b.Value == v {
-				d.breakpointHandler.OnDataBreakpoint(cpu, b)
-			}
+	if s := d.stackBreakpoint; s != nil && !s.Disabled && d.breakpointHandler != nil &&
+		byte(addr>>8) == cpu.StackPage && byte(addr) > cpu.Reg.SP {
+		s.Address = addr
+		d.breakpointHandler.OnDataBreakpoint(cpu, s)
+	}
+
+	b, ok := d.dataBreakpoints[addr]
+	if !ok || b.Disabled || !b.matches(v) {
+		return
+	}
+
+	switch {
+	case b.LogOnly:
+		r := StoreRecord{
+			PC:      cpu.LastPC,
+			Address: addr,
+			Value:   v,
+			Cycles:  cpu.Cycles,
+		}
+		if len(d.storeLog) < maxStoreLog {
+			d.storeLog = append(d.storeLog, r)
+		} else {
+			d.storeLog[d.storeLogNext] = r
+			d.storeLogNext = (d.storeLogNext + 1) % maxStoreLog
 		}
+	case d.breakpointHandler != nil:
+		d.breakpointHandler.OnDataBreakpoint(cpu, b)
+	}
+}
+
+// AttachStackHandler attaches a handler that is notified whenever a push
+// wraps the stack pointer from $00 to $FF (an overflow) or a pull wraps it
+// from $FF to $00 (an underflow). Because wrapping the stack pointer is legal
+// on a 6502, no checks are made until a handler is attached. Attach a nil
+// handler to disable the checks.
+func (d *Debugger) AttachStackHandler(handler StackHandler) {
+	d.stackHandler = handler
+}
+
+func (d *Debugger) onStackPush(cpu *CPU) {
+	if d.stackHandler != nil && cpu.Reg.SP == 0xff {
+		d.stackHandler.OnStackOverflow(cpu)
+	}
+}
+
+func (d *Debugger) onStackPull(cpu *CPU) {
+	if d.stackHandler != nil && cpu.Reg.SP == 0x00 {
+		d.stackHandler.OnStackUnderflow(cpu)
 	}
 }
@@ -173,6 +173,30 @@ const (
 	ACC             // Accumulator (no operand)
 )
 
+var modeNames = []string{
+	"IMM",
+	"IMP",
+	"REL",
+	"ZPG",
+	"ZPX",
+	"ZPY",
+	"ABS",
+	"ABX",
+	"ABY",
+	"IND",
+	"IDX",
+	"IDY",
+	"ACC",
+}
+
+// String returns the three-letter name of the addressing mode.
+func (m Mode) String() string {
+	if int(m) < len(modeNames) {
+		return modeNames[m]
+	}
+	return "???"
+}
+
 // Opcode data for an (opcode, mode) pair
 type opcodeData struct {
 	sym      opsym // internal opcode symbol
@@ -399,7 +423,8 @@ var data = []opcodeData{
 	{symROR, ABX, 0x7e, 3, 7, 0, false},
 }
 
-// Unused opcodes
+// Unused opcodes. On the 65C02, each of these opcodes is a NOP with the
+// listed length and cycle count.
 type unused struct {
 	opcode byte
 	mode   Mode
@@ -499,6 +524,7 @@ type Instruction struct {
 	Cycles   byte     // number of CPU cycles to execute the instruction
 	BPCycles byte     // additional cycles required if boundary page crossed
 	fn       instfunc // emulator implementation of the function
+	illegal  bool     // opcode is undefined on the architecture
 }
 
 // An InstructionSet defines the set of all possible instructions that
@@ -551,6 +577,7 @@ func newInstructionSet(arch Architecture) *InstructionSet {
 			inst.Cycles = d.cycles
 			inst.BPCycles = 0
 			inst.fn = (*CPU).unusedn
+			inst.illegal = true
 			continue
 		}
 
@@ -584,6 +611,7 @@ func newInstructionSet(arch Architecture) *InstructionSet {
 		switch arch {
 		case NMOS:
 			inst.fn = (*CPU).unusedn
+			inst.illegal = true
 		case CMOS:
 			inst.fn = (*CPU).unusedc
 		}
@@ -9,6 +9,7 @@ import "errors"
 // Errors
 var (
 	ErrMemoryOutOfBounds = errors.New("Memory access out of bounds")
+	ErrMemoryMapOverlap  = errors.New("Memory map overlaps an existing device")
 )
 
 // The Memory interface presents an interface to the CPU through which all
@@ -35,6 +36,18 @@ type Memory interface {
 	StoreAddress(addr uint16, v uint16)
 }
 
+// A Peeker is a Memory that can be read without side effects, such as
+// advancing a device's state or changing the value left on the bus.
+// Debuggers use it to examine memory without disturbing the program.
+type Peeker interface {
+	// PeekByte returns the byte at the address without side effects.
+	PeekByte(addr uint16) byte
+
+	// PeekBytes reads multiple bytes from the address into the buffer 'b'
+	// without side effects.
+	PeekBytes(addr uint16, b []byte)
+}
+
 // FlatMemory represents an entire 16-bit address space as a singular
 // 64K buffer.
 type FlatMemory struct {
@@ -97,6 +110,276 @@ func (m *FlatMemory) StoreAddress(addr uint16, v uint16) {
 	}
 }
 
+// LoadWord loads a little-endian 16-bit value from the requested address
+// and returns it. Unlike LoadAddress, the high byte is always read from the
+// address following 'addr', even when it lies on the next page.
+func (m *FlatMemory) LoadWord(addr uint16) uint16 {
+	return uint16(m.b[addr]) | uint16(m.b[addr+1])<<8
+}
+
+// StoreWord stores a little-endian 16-bit value to the requested address.
+// Unlike StoreAddress, the high byte is always stored to the address
+// following 'addr', even when it lies on the next page.
+func (m *FlatMemory) StoreWord(addr uint16, v uint16) {
+	m.b[addr] = byte(v & 0xff)
+	m.b[addr+1] = byte(v >> 8)
+}
+
+// Fill stores the value 'v' to every address from 'start' to 'end',
+// inclusive.
+func (m *FlatMemory) Fill(start, end uint16, v byte) {
+	for a := int(start); a <= int(end); a++ {
+		m.b[a] = v
+	}
+}
+
+// A Device is a hardware device whose registers are mapped into a range of
+// memory addresses. All device accesses are made using an offset relative to
+// the first address of the device's mapped range.
+type Device interface {
+	// LoadByte loads a byte from the device register at 'offset'.
+	LoadByte(offset uint16) byte
+
+	// StoreByte stores a byte to the device register at 'offset'.
+	StoreByte(offset uint16, v byte)
+
+	// PeekByte returns the value a load from the device register at
+	// 'offset' would return, without changing the device's state.
+	PeekByte(offset uint16) byte
+}
+
+// MappedMemory represents a 16-bit address space in which ranges of
+// addresses may be mapped to devices. Addresses not mapped to a device behave
+// exactly like FlatMemory.
+//
+// Ranges of addresses may also be flagged as unmapped. When OpenBus is true,
+// reading an unmapped address returns the last value transferred over the
+// bus, and storing to an unmapped address has no effect. When OpenBus is
+// false, unmapped addresses behave like RAM.
+type MappedMemory struct {
+	FlatMemory
+	OpenBus  bool        // emulate open-bus behavior for unmapped addresses
+	mappings []mapping   // device mappings
+	unmapped []addrRange // address ranges flagged as unmapped
+	bus      byte        // last value read or written
+}
+
+// An addrRange is an inclusive range of addresses.
+type addrRange struct {
+	start uint16
+	end   uint16
+}
+
+// A mapping associates a range of addresses with a device.
+type mapping struct {
+	start  uint16
+	end    uint16
+	device Device
+}
+
+// NewMappedMemory creates a new 16-bit memory space with no mapped devices.
+func NewMappedMemory() *MappedMemory {
+	return &MappedMemory{}
+}
+
+// Map maps the addresses from 'start' to 'end', inclusive, to a device.
+func (m *MappedMemory) Map(start, end uint16, d Device) error {
+	if end < start {
+		return ErrMemoryOutOfBounds
+	}
+	for _, mm := range m.mappings {
+		if start <= mm.end && end >= mm.start {
+			return ErrMemoryMapOverlap
+		}
+	}
+	m.mappings = append(m.mappings, mapping{start, end, d})
+	return nil
+}
+
+// Unmap removes all address ranges mapped to a device.
+func (m *MappedMemory) Unmap(d Device) {
+	mappings := m.mappings[:0]
+	for _, mm := range m.mappings {
+		if mm.device != d {
+			mappings = append(mappings, mm)
+		}
+	}
+	m.mappings = mappings
+}
+
+// SetUnmapped flags the addresses from 'start' to 'end', inclusive, as
+// unmapped.
+func (m *MappedMemory) SetUnmapped(start, end uint16) {
+	m.unmapped = append(m.unmapped, addrRange{start, end})
+}
+
+// ClearUnmapped removes all unmapped address flags.
+func (m *MappedMemory) ClearUnmapped() {
+	m.unmapped = nil
+}
+
+// IsMapped returns true if the address is mapped to a device.
+func (m *MappedMemory) IsMapped(addr uint16) bool {
+	return m.find(addr) != nil
+}
+
+// Return true if reading the address returns the open-bus value.
+func (m *MappedMemory) isOpenBus(addr uint16) bool {
+	if !m.OpenBus {
+		return false
+	}
+	for _, r := range m.unmapped {
+		if addr >= r.start && addr <= r.end {
+			return true
+		}
+	}
+	return false
+}
+
+// Return true if bulk loads and stores must be performed one byte at a time.
+func (m *MappedMemory) bytewise() bool {
+	return len(m.mappings) > 0 || (m.OpenBus && len(m.unmapped) > 0)
+}
+
+// Return the mapping containing the address, or nil if the address isn't
+// mapped to a device.
+func (m *MappedMemory) find(addr uint16) *mapping {
+	for i := range m.mappings {
+		if addr >= m.mappings[i].start && addr <= m.mappings[i].end {
+			return &m.mappings[i]
+		}
+	}
+	return nil
+}
+
+// LoadByte loads a single byte from the address and returns it.
+func (m *MappedMemory) LoadByte(addr uint16) byte {
+	switch mm := m.find(addr); {
+	case m.isOpenBus(addr):
+	case mm != nil:
+		m.bus = mm.device.LoadByte(addr - mm.start)
+	default:
+		m.bus = m.b[addr]
+	}
+	return m.bus
+}
+
+// PeekByte returns the byte at the address without side effects. Device
+// registers are read with the device's PeekByte, and the value left on the
+// bus is unchanged.
+func (m *MappedMemory) PeekByte(addr uint16) byte {
+	switch mm := m.find(addr); {
+	case m.isOpenBus(addr):
+		return m.bus
+	case mm != nil:
+		return mm.device.PeekByte(addr - mm.start)
+	default:
+		return m.b[addr]
+	}
+}
+
+// PeekBytes reads multiple bytes from the address without side effects.
+func (m *MappedMemory) PeekBytes(addr uint16, b []byte) {
+	if !m.bytewise() {
+		m.FlatMemory.LoadBytes(addr, b)
+		return
+	}
+	for i := range b {
+		if int(addr)+i < len(m.b) {
+			b[i] = m.PeekByte(addr + uint16(i))
+		} else {
+			b[i] = 0
+		}
+	}
+}
+
+// LoadBytes loads multiple bytes from the address and returns them.
+func (m *MappedMemory) LoadBytes(addr uint16, b []byte) {
+	if !m.bytewise() {
+		m.FlatMemory.LoadBytes(addr, b)
+		if len(b) > 0 {
+			m.bus = b[len(b)-1]
+		}
+		return
+	}
+	for i := range b {
+		if int(addr)+i < len(m.b) {
+			b[i] = m.LoadByte(addr + uint16(i))
+		} else {
+			b[i] = 0
+		}
+	}
+}
+
+// LoadAddress loads a 16-bit address value from the requested address and
+// returns it. Page-wrapping behaves as it does for FlatMemory.
+func (m *MappedMemory) LoadAddress(addr uint16) uint16 {
+	if (addr & 0xff) == 0xff {
+		return uint16(m.LoadByte(addr)) | uint16(m.LoadByte(addr-0xff))<<8
+	}
+	return uint16(m.LoadByte(addr)) | uint16(m.LoadByte(addr+1))<<8
+}
+
+// LoadWord loads a little-endian 16-bit value from the requested address
+// and returns it.
+func (m *MappedMemory) LoadWord(addr uint16) uint16 {
+	return uint16(m.LoadByte(addr)) | uint16(m.LoadByte(addr+1))<<8
+}
+
+// StoreByte stores a byte at the requested address.
+func (m *MappedMemory) StoreByte(addr uint16, v byte) {
+	m.bus = v
+	switch mm := m.find(addr); {
+	case m.isOpenBus(addr):
+	case mm != nil:
+		mm.device.StoreByte(addr-mm.start, v)
+	default:
+		m.b[addr] = v
+	}
+}
+
+// StoreBytes stores multiple bytes to the requested address.
+func (m *MappedMemory) StoreBytes(addr uint16, b []byte) {
+	if !m.bytewise() {
+		m.FlatMemory.StoreBytes(addr, b)
+		if len(b) > 0 {
+			m.bus = b[len(b)-1]
+		}
+		return
+	}
+	for i, v := range b {
+		if int(addr)+i >= len(m.b) {
+			break
+		}
+		m.StoreByte(addr+uint16(i), v)
+	}
+}
+
+// StoreAddress stores a 16-bit address value to the requested address.
+// Page-wrapping behaves as it does for FlatMemory.
+func (m *MappedMemory) StoreAddress(addr uint16, v uint16) {
+	m.StoreByte(addr, byte(v&0xff))
+	if (addr & 0xff) == 0xff {
+		m.StoreByte(addr-0xff, byte(v>>8))
+	} else {
+		m.StoreByte(addr+1, byte(v>>8))
+	}
+}
+
+// StoreWord stores a little-endian 16-bit value to the requested address.
+func (m *MappedMemory) StoreWord(addr uint16, v uint16) {
+	m.StoreByte(addr, byte(v&0xff))
+	m.StoreByte(addr+1, byte(v>>8))
+}
+
+// Fill stores the value 'v' to every address from 'start' to 'end',
+// inclusive.
+func (m *MappedMemory) Fill(start, end uint16, v byte) {
+	for a := int(start); a <= int(end); a++ {
+		m.StoreByte(uint16(a), v)
+	}
+}
+
 // Return the offset address 'addr' + 'offset'. If the offset
 // crossed a page boundary, return 'pageCrossed' as true.
 func offsetAddress(addr uint16, offset byte) (newAddr uint16, pageCrossed bool) {
@@ -126,8 +409,8 @@ func operandToAddress(operand []byte) uint16 {
 	return 0
 }
 
-// Given a 1-byte stack pointer register, return the stack
-// corresponding memory address.
-func stackAddress(offset byte) uint16 {
-	return uint16(0x100) + uint16(offset)
+// Given a stack page and a 1-byte stack pointer register, return the
+// corresponding stack memory address.
+func stackAddress(page, offset byte) uint16 {
+	return uint16(page)<<8 | uint16(offset)
 }
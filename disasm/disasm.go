@@ -7,7 +7,9 @@
 package disasm
 
 import (
+	"bufio"
 	"fmt"
+	"io"
 	"strings"
 
 	"github.com/beevik/go6502/cpu"
@@ -28,6 +30,9 @@ type Theme struct {
 	Reset      string
 }
 
+// A theme with no colors, used to produce plain text.
+var plainTheme Theme
+
 // Disassembler formatting for addressing modes
 var modeFormat = []string{
 	"#$%s",    // IMM
@@ -56,6 +61,7 @@ const (
 	ShowRegisters
 	ShowCycles
 	ShowAnnotations
+	ShowTiming
 
 	ShowBasic = ShowAddress | ShowCode | ShowInstruction | ShowAnnotations
 	ShowFull  = ShowAddress | ShowCode | ShowInstruction | ShowRegisters | ShowCycles
@@ -65,7 +71,14 @@ const (
 // representing the disassembled instruction and the address of the next
 // instruction.
 func Disassemble(c *cpu.CPU, addr uint16, flags Flags, anno string, theme *Theme) (line string, next uint16) {
-	opcode := c.Mem.LoadByte(addr)
+	return DisassembleLabels(c, addr, flags, anno, nil, theme)
+}
+
+// DisassembleLabels disassembles the machine code at memory address addr
+// like Disassemble, but displays the target of a branch, jump or
+// subroutine call using its name when the labels map contains it.
+func DisassembleLabels(c *cpu.CPU, addr uint16, flags Flags, anno string, labels map[uint16]string, theme *Theme) (line string, next uint16) {
+	opcode := c.PeekByte(addr)
 	inst := c.InstSet.Lookup(opcode)
 	next = addr + uint16(inst.Length)
 	line = ""
@@ -76,14 +89,14 @@ func Disassemble(c *cpu.CPU, addr uint16, flags Flags, anno string, theme *Theme
 
 	if (flags & ShowCode) != 0 {
 		var csbuf [3]byte
-		c.Mem.LoadBytes(addr, csbuf[:next-addr])
+		c.PeekBytes(addr, csbuf[:next-addr])
 		line += fmt.Sprintf("%s%-8s%s  ", theme.Code, codeString(csbuf[:next-addr]), theme.Reset)
 	}
 
 	if (flags & ShowInstruction) != 0 {
 		var buf [2]byte
 		operand := buf[:inst.Length-1]
-		c.Mem.LoadBytes(addr+1, operand)
+		c.PeekBytes(addr+1, operand)
 		if inst.Mode == cpu.REL {
 			// Convert relative offset to absolute address.
 			operand = buf[:]
@@ -92,12 +105,19 @@ func Disassemble(c *cpu.CPU, addr uint16, flags Flags, anno string, theme *Theme
 			operand[1] = byte(braddr >> 8)
 		}
 
+		// Replace a target address with its label.
+		arg := fmt.Sprintf(modeFormat[inst.Mode], hexString(operand))
+		if inst.Mode == cpu.REL || (inst.Mode == cpu.ABS && (inst.Name == "JMP" || inst.Name == "JSR")) {
+			if name, ok := labels[uint16(operand[0])|uint16(operand[1])<<8]; ok {
+				arg = name
+			}
+		}
+
 		// Return string composed of CPU instruction and operand.
-		line += fmt.Sprintf("%s%s   %s"+modeFormat[inst.Mode]+"%s", theme.Inst, inst.Name, theme.Operand, hexString(operand), theme.Reset)
+		line += fmt.Sprintf("%s%s   %s%s%s", theme.Inst, inst.Name, theme.Operand, arg, theme.Reset)
 
 		// Pad to next column using uncolorized version of the operand.
-		dummy := fmt.Sprintf(modeFormat[inst.Mode], hexString(operand))
-		line += strings.Repeat(" ", 9-len(dummy))
+		line += strings.Repeat(" ", max(0, 9-len(arg)))
 	}
 
 	if (flags & ShowRegisters) != 0 {
@@ -108,6 +128,69 @@ func Disassemble(c *cpu.CPU, addr uint16, flags Flags, anno string, theme *Theme
 		line += GetCyclesString(c, theme)
 	}
 
+	if (flags & ShowTiming) != 0 {
+		timing := timingString(inst)
+		if (flags&ShowAnnotations) != 0 && anno != "" {
+			timing = fmt.Sprintf("%-29s", timing)
+		}
+		line += theme.Annotation + timing + theme.Reset
+	}
+
+	if (flags&ShowAnnotations) != 0 && anno != "" {
+		line += fmt.Sprintf(" ; %s%s%s", theme.Annotation, anno, theme.Reset)
+	}
+
+	return line, next
+}
+
+// DisassembleData disassembles the data stored at memory address addr as a
+// data pseudo-op (.DB, .DW or .DD, depending on the unit size in bytes). No
+// more than 'remain' bytes are consumed. Return a string representing the
+// data and the address of the next line. Only the address, code and
+// annotation flags apply to data.
+func DisassembleData(c *cpu.CPU, addr uint16, remain, unit int, flags Flags, anno string, theme *Theme) (line string, next uint16) {
+	if (unit != 2 && unit != 4) || remain < unit {
+		unit = 1
+	}
+
+	// Bytes are grouped three to a line, so that they fit in the code
+	// column. Larger units are displayed one to a line.
+	n := unit
+	if unit == 1 {
+		n = min(3, remain)
+	}
+	var buf [4]byte
+	b := buf[:n]
+	c.PeekBytes(addr, b)
+	next = addr + uint16(n)
+
+	if (flags & ShowAddress) != 0 {
+		line += fmt.Sprintf("%s%04X%s- ", theme.Addr, addr, theme.Reset)
+	}
+
+	if (flags & ShowCode) != 0 {
+		line += fmt.Sprintf("%s%-8s%s  ", theme.Code, codeString(b), theme.Reset)
+	}
+
+	if (flags & ShowInstruction) != 0 {
+		var name string
+		var items []string
+		switch unit {
+		case 1:
+			name = ".DB"
+			for i := range b {
+				items = append(items, "$"+hexString(b[i:i+1]))
+			}
+		case 2:
+			name, items = ".DW", []string{"$" + hexString(b)}
+		case 4:
+			name, items = ".DD", []string{"$" + hexString(b)}
+		}
+		operand := strings.Join(items, ",")
+		line += fmt.Sprintf("%s%s   %s%s%s", theme.Inst, name, theme.Operand, operand, theme.Reset)
+		line += strings.Repeat(" ", max(0, 9-len(operand)))
+	}
+
 	if (flags&ShowAnnotations) != 0 && anno != "" {
 		line += fmt.Sprintf(" ; %s%s%s", theme.Annotation, anno, theme.Reset)
 	}
@@ -115,6 +198,26 @@ func Disassemble(c *cpu.CPU, addr uint16, flags Flags, anno string, theme *Theme
 	return line, next
 }
 
+// Fprint disassembles all instructions from address start through address
+// end and writes them to w, one instruction per line. An instruction that
+// begins at or before end is disassembled in full, even if it extends past
+// end. If theme is nil, the output is not colorized.
+func Fprint(w io.Writer, c *cpu.CPU, start, end uint16, flags Flags, theme *Theme) error {
+	if theme == nil {
+		theme = &plainTheme
+	}
+
+	ww := bufio.NewWriter(w)
+	for addr := int(start); addr <= int(end); {
+		line, next := Disassemble(c, uint16(addr), flags, "", theme)
+		if _, err := ww.WriteString(line + "\n"); err != nil {
+			return err
+		}
+		addr += int(next - uint16(addr))
+	}
+	return ww.Flush()
+}
+
 // GetCyclesString returns a string describing the number of elapsed
 // CPU cycles.
 func GetCyclesString(c *cpu.CPU, theme *Theme) string {
@@ -123,15 +226,36 @@ func GetCyclesString(c *cpu.CPU, theme *Theme) string {
 		theme.Reset)
 }
 
+// GetCyclesStringPlain returns a string describing the number of elapsed
+// CPU cycles. The string contains no color escape codes.
+func GetCyclesStringPlain(c *cpu.CPU) string {
+	return GetCyclesString(c, &plainTheme)
+}
+
 // GetRegisterString returns a string describing the contents of the 6502
 // registers.
 func GetRegisterString(r *cpu.Registers, theme *Theme) string {
+	return GetRegisterStringBase(r, 16, theme)
+}
+
+// GetRegisterStringBase returns a string describing the contents of the 6502
+// registers, with register values displayed in the requested numeric base
+// (2, 10 or 16).
+func GetRegisterStringBase(r *cpu.Registers, base int, theme *Theme) string {
+	format8, format16 := "%02X", "%04X"
+	switch base {
+	case 2:
+		format8, format16 = "%08b", "%016b"
+	case 10:
+		format8, format16 = "%d", "%d"
+	}
+
 	fmt8 := func(name string, val byte) string {
-		return fmt.Sprintf("%s%s%s=%s%02X ",
+		return fmt.Sprintf("%s%s%s=%s"+format8+" ",
 			theme.RegName, name, theme.RegEqual, theme.RegValue, val)
 	}
 	fmt16 := func(name string, val uint16) string {
-		return fmt.Sprintf("%s%s%s=%s%04X ",
+		return fmt.Sprintf("%s%s%s=%s"+format16+" ",
 			theme.RegName, name, theme.RegEqual, theme.RegValue, val)
 	}
 	fmtS := func(name string, val string) string {
@@ -148,6 +272,27 @@ func GetRegisterString(r *cpu.Registers, theme *Theme) string {
 		theme.Reset
 }
 
+// GetRegisterStringPlain returns a string describing the contents of the
+// 6502 registers. The string contains no color escape codes, making it
+// suitable for log files and test output.
+func GetRegisterStringPlain(r *cpu.Registers) string {
+	return GetRegisterString(r, &plainTheme)
+}
+
+// Return a string describing the number of cycles required to execute an
+// instruction, including any penalty for crossing a page boundary. A taken
+// branch costs an extra cycle, and a second if its target is on another
+// page.
+func timingString(inst *cpu.Instruction) string {
+	s := fmt.Sprintf("%d cycles", inst.Cycles)
+	if inst.Mode == cpu.REL {
+		s += " (+1 if taken, +2 if page crossed)"
+	} else if inst.BPCycles > 0 {
+		s += fmt.Sprintf(" (+%d if page crossed)", inst.BPCycles)
+	}
+	return s
+}
+
 func codeString(b []byte) string {
 	switch len(b) {
 	case 1:
@@ -156,6 +301,8 @@ func codeString(b []byte) string {
 		return fmt.Sprintf("%02X %02X", b[0], b[1])
 	case 3:
 		return fmt.Sprintf("%02X %02X %02X", b[0], b[1], b[2])
+	case 4:
+		return fmt.Sprintf("%02X %02X %02X %02X", b[0], b[1], b[2], b[3])
 	default:
 		return ""
 	}
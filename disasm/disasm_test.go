@@ -0,0 +1,47 @@
+// Copyright 2014-2018 Brett Vickers. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package disasm
+
+import (
+	"os"
+	"strings"
+	"testing"
+
+	"github.com/beevik/go6502/asm"
+	"github.com/beevik/go6502/cpu"
+)
+
+func TestShowTiming(t *testing.T) {
+	code := `
+	.ORG	$1000
+	LDA	$12FF,X
+	STA	$12FF,X
+	BNE	$1000
+	NOP`
+
+	a, sm, err := asm.Assemble(strings.NewReader(code), "test.asm", 0x1000, os.Stdout, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	mem := cpu.NewFlatMemory()
+	mem.StoreBytes(sm.Origin, a.Code)
+	c := cpu.NewCPU(cpu.NMOS, mem)
+
+	exp := []string{
+		"4 cycles (+1 if page crossed)",
+		"5 cycles",
+		"2 cycles (+1 if taken, +2 if page crossed)",
+		"2 cycles",
+	}
+	addr := sm.Origin
+	for _, e := range exp {
+		var line string
+		line, addr = Disassemble(c, addr, ShowTiming, "", &plainTheme)
+		if line != e {
+			t.Errorf("timing incorrect. exp: '%s', got: '%s'", e, line)
+		}
+	}
+}
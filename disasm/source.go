@@ -0,0 +1,241 @@
+// Copyright 2014-2018 Brett Vickers. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package disasm
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"sort"
+	"strings"
+
+	"github.com/beevik/go6502/cpu"
+)
+
+// SourceOptions describe the memory being disassembled by FprintSource.
+type SourceOptions struct {
+	// Labels maps addresses to label names. A label whose address is the
+	// start of a disassembled line is placed on that line. Other labels
+	// used by an operand are defined as constants.
+	Labels map[uint16]string
+
+	// Data returns the number of bytes remaining in the data region
+	// containing addr, along with the region's unit size in bytes (1, 2 or
+	// 4). It returns zero bytes if addr holds code. If Data is nil, all
+	// addresses are assumed to hold code.
+	Data func(addr uint16) (remain, unit int)
+}
+
+// A sourceLine is a single line of disassembled source code.
+type sourceLine struct {
+	addr uint16
+	size int // number of bytes generated by the line
+	op   string
+	arg  string
+	ref  int // address referenced by arg (-1 = none)
+}
+
+// FprintSource disassembles all memory from address start through address
+// end and writes it to w as assembly language source code. The source code
+// reassembles to the same bytes. Branch and jump targets within the range
+// that have no label are given generated labels of the form Lxxxx. Bytes
+// that don't hold valid instructions are written as .DB data.
+func FprintSource(w io.Writer, c *cpu.CPU, start, end uint16, opts *SourceOptions) error {
+	if opts == nil {
+		opts = &SourceOptions{}
+	}
+
+	lines, starts, targets := sourceLines(c, start, end, opts)
+	labels := sourceLabels(opts.Labels, starts, targets)
+
+	// Labels referenced by operands but not placed on a line are defined
+	// as constants.
+	var equates []uint16
+	defined := make(map[uint16]bool)
+	for _, l := range lines {
+		if _, ok := labels[uint16(l.ref)]; ok && l.ref >= 0 && !starts[uint16(l.ref)] && !defined[uint16(l.ref)] {
+			equates = append(equates, uint16(l.ref))
+			defined[uint16(l.ref)] = true
+		}
+	}
+	sort.Slice(equates, func(i, j int) bool { return equates[i] < equates[j] })
+
+	ww := bufio.NewWriter(w)
+	fmt.Fprintf(ww, "; Disassembly of $%04X..$%04X\n\n", start, end)
+	if c.Arch == cpu.CMOS {
+		fmt.Fprintf(ww, "\t.ARCH\t65c02\n")
+	}
+	fmt.Fprintf(ww, "\t.ORG\t$%04X\n\n", start)
+	for _, a := range equates {
+		fmt.Fprintf(ww, "%s\t.EQ\t$%04X\n", labels[a], a)
+	}
+	if len(equates) > 0 {
+		fmt.Fprintln(ww)
+	}
+
+	for _, l := range lines {
+		arg := l.arg
+		if name, ok := labels[uint16(l.ref)]; ok && l.ref >= 0 {
+			arg = strings.Replace(arg, fmt.Sprintf("$%04X", l.ref), name, 1)
+		}
+		line := strings.TrimRight(labels[l.addr]+"\t"+l.op+"\t"+arg, "\t")
+		if _, err := ww.WriteString(line + "\n"); err != nil {
+			return err
+		}
+	}
+	return ww.Flush()
+}
+
+// TargetLabels returns the labels FprintSource would place on the branch
+// and jump targets within the code from address start through end. Only
+// targets that start a disassembled line are labeled. Targets named in
+// opts.Labels keep their names, and others are given generated labels of
+// the form Lxxxx.
+func TargetLabels(c *cpu.CPU, start, end uint16, opts *SourceOptions) map[uint16]string {
+	if opts == nil {
+		opts = &SourceOptions{}
+	}
+
+	_, starts, targets := sourceLines(c, start, end, opts)
+	labels := sourceLabels(opts.Labels, starts, targets)
+	for a := range labels {
+		if !starts[a] || !targets[a] {
+			delete(labels, a)
+		}
+	}
+	return labels
+}
+
+// Disassemble every line from address start through end, recording the
+// address of each line and the addresses referenced by branches and jumps.
+func sourceLines(c *cpu.CPU, start, end uint16, opts *SourceOptions) (lines []sourceLine, starts, targets map[uint16]bool) {
+	starts = make(map[uint16]bool)
+	targets = make(map[uint16]bool)
+	for addr := int(start); addr <= int(end); {
+		var l []sourceLine
+		if opts.Data != nil {
+			if remain, unit := opts.Data(uint16(addr)); remain > 0 {
+				l = sourceData(c, uint16(addr), min(remain, int(end)-addr+1), unit)
+			}
+		}
+		if l == nil {
+			l = sourceInstruction(c, uint16(addr), int(end)-addr+1, targets)
+		}
+		for _, sl := range l {
+			starts[sl.addr] = true
+			addr += sl.size
+		}
+		lines = append(lines, l...)
+	}
+	return lines, starts, targets
+}
+
+// Return the named labels, along with generated labels for the branch and
+// jump targets that start a line.
+func sourceLabels(named map[uint16]string, starts, targets map[uint16]bool) map[uint16]string {
+	labels := make(map[uint16]string)
+	names := make(map[string]bool)
+	for a, name := range named {
+		labels[a] = name
+		names[strings.ToLower(name)] = true
+	}
+	for a := range targets {
+		name := fmt.Sprintf("L%04X", a)
+		if _, ok := labels[a]; !ok && starts[a] && !names[strings.ToLower(name)] {
+			labels[a] = name
+		}
+	}
+	return labels
+}
+
+// Disassemble the instruction at addr as a source line. No more than
+// 'remain' bytes are consumed. Branch and jump targets are added to the
+// targets map.
+func sourceInstruction(c *cpu.CPU, addr uint16, remain int, targets map[uint16]bool) []sourceLine {
+	inst := c.GetInstruction(addr)
+	if inst.Name == "???" || int(inst.Length) > remain {
+		return sourceBytes(c, addr, min(remain, int(inst.Length)))
+	}
+
+	var buf [2]byte
+	operand := buf[:inst.Length-1]
+	c.PeekBytes(addr+1, operand)
+	v := uint16(0)
+	if len(operand) > 0 {
+		v = uint16(operand[0])
+	}
+	if len(operand) > 1 {
+		v |= uint16(operand[1]) << 8
+	}
+
+	l := sourceLine{addr: addr, size: int(inst.Length), op: inst.Name, ref: -1}
+	switch {
+	case inst.Mode == cpu.IMP || inst.Mode == cpu.ACC:
+	case inst.Mode == cpu.IMM:
+		l.arg = fmt.Sprintf("#$%02X", v)
+	case inst.Mode == cpu.REL:
+		target := addr + uint16(inst.Length) + uint16(int8(v))
+		l.arg, l.ref = fmt.Sprintf("$%04X", target), int(target)
+		targets[target] = true
+	case len(operand) == 1:
+		l.arg = fmt.Sprintf(modeFormat[inst.Mode], fmt.Sprintf("%02X", v))
+	default:
+		// Absolute operands must not be reassembled with zero page
+		// addressing. Indirect operands have no zero page form.
+		l.arg, l.ref = fmt.Sprintf(modeFormat[inst.Mode], fmt.Sprintf("%04X", v)), int(v)
+		if v < 0x100 && (inst.Mode == cpu.ABS || inst.Mode == cpu.ABX || inst.Mode == cpu.ABY) {
+			l.arg = "A:" + l.arg
+		}
+		if inst.Mode == cpu.ABS && (inst.Name == "JMP" || inst.Name == "JSR") {
+			targets[v] = true
+		}
+	}
+	return []sourceLine{l}
+}
+
+// Disassemble the data region at addr as .DB, .DW or .DD source lines.
+// No more than 'remain' bytes are consumed.
+func sourceData(c *cpu.CPU, addr uint16, remain, unit int) []sourceLine {
+	if unit != 2 && unit != 4 {
+		return sourceBytes(c, addr, remain)
+	}
+
+	var lines []sourceLine
+	name := map[int]string{2: ".DW", 4: ".DD"}[unit]
+	for ; remain >= unit; remain -= unit {
+		var buf [4]byte
+		b := buf[:unit]
+		c.PeekBytes(addr, b)
+
+		// The assembler can't parse 32-bit literals with the sign bit
+		// set, so write them as bytes.
+		if unit == 4 && b[3] >= 0x80 {
+			lines = append(lines, sourceBytes(c, addr, unit)...)
+			addr += uint16(unit)
+			continue
+		}
+		lines = append(lines, sourceLine{addr: addr, size: unit, op: name, arg: "$" + hexString(b), ref: -1})
+		addr += uint16(unit)
+	}
+	return append(lines, sourceBytes(c, addr, remain)...)
+}
+
+// Disassemble n bytes starting at addr as .DB source lines of up to 8
+// bytes each.
+func sourceBytes(c *cpu.CPU, addr uint16, n int) []sourceLine {
+	var lines []sourceLine
+	for n > 0 {
+		b := make([]byte, min(8, n))
+		c.PeekBytes(addr, b)
+		items := make([]string, len(b))
+		for i := range b {
+			items[i] = "$" + hexString(b[i:i+1])
+		}
+		lines = append(lines, sourceLine{addr: addr, size: len(b), op: ".DB", arg: strings.Join(items, ","), ref: -1})
+		addr += uint16(len(b))
+		n -= len(b)
+	}
+	return lines
+}
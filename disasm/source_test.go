@@ -0,0 +1,69 @@
+// Copyright 2014-2018 Brett Vickers. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package disasm
+
+import (
+	"bytes"
+	"os"
+	"strings"
+	"testing"
+
+	"github.com/beevik/go6502/asm"
+	"github.com/beevik/go6502/cpu"
+)
+
+func TestFprintSourceRoundTrip(t *testing.T) {
+	code := `
+	.ARCH	65c02
+	.ORG	$1000
+START	LDA	A:$0010
+	STA	A:$0020,X
+	LDA	A:$0030,Y
+	LDA	$10
+	JMP	($00FE)
+	JMP	($1234)
+	LDA	($50),Y
+LOOP	DEX
+	BNE	LOOP
+	JSR	SUB
+	JMP	START
+SUB	RTS
+TABLE	.DB	$01,$02,$03,$04,$05,$06,$07,$08,$09
+	.DW	$1234,$0010
+	.DD	$12345678
+	.DB	$FF`
+
+	a, sm, err := asm.Assemble(strings.NewReader(code), "test.asm", 0x1000, os.Stdout, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	mem := cpu.NewFlatMemory()
+	mem.StoreBytes(sm.Origin, a.Code)
+	c := cpu.NewCPU(cpu.CMOS, mem)
+
+	opts := &SourceOptions{
+		Data: func(addr uint16) (remain, unit int) {
+			if r, ok := sm.FindData(int(addr)); ok {
+				return int(r.Address) + int(r.Size) - int(addr), r.Unit
+			}
+			return 0, 0
+		},
+	}
+	end := sm.Origin + uint16(len(a.Code)) - 1
+
+	var buf bytes.Buffer
+	if err := FprintSource(&buf, c, sm.Origin, end, opts); err != nil {
+		t.Fatal(err)
+	}
+
+	a2, _, err := asm.Assemble(strings.NewReader(buf.String()), "source.asm", 0, os.Stdout, 0)
+	if err != nil {
+		t.Fatalf("reassembly failed: %v\n%s", err, buf.String())
+	}
+	if !bytes.Equal(a.Code, a2.Code) {
+		t.Errorf("reassembled code differs.\nexp: %X\ngot: %X\n%s", a.Code, a2.Code, buf.String())
+	}
+}
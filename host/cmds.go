@@ -4,6 +4,15 @@ import "github.com/beevik/cmd"
 
 var cmds *cmd.Tree
 
+// Commands whose arguments keep their quotes, so that quoted strings can be
+// told apart from other values.
+var quotedArgCommands map[*cmd.Command]bool
+
+// Commands that may be run as breakpoint actions. Actions run while the CPU
+// is executing an instruction, so only commands that display information
+// are allowed.
+var actionCommands map[*cmd.Command]bool
+
 func init() {
 	root := cmd.NewTree(cmd.TreeDescriptor{Name: "go6502"})
 	root.AddCommand(cmd.CommandDescriptor{
@@ -12,13 +21,30 @@ func init() {
 		Usage:       "help [<command>]",
 		Data:        (*Host).cmdHelp,
 	})
+	root.AddCommand(cmd.CommandDescriptor{
+		Name:  "alias",
+		Brief: "Define a command alias",
+		Description: "Define a new command that expands to the specified" +
+			" command string. Any arguments given to the alias are appended" +
+			" to the expanded command. If no command string is given, the" +
+			" alias is removed. If no arguments are given, all aliases are" +
+			" listed.",
+		Usage: "alias [<name> [<command string>]]",
+		Data:  (*Host).cmdAlias,
+	})
 	root.AddCommand(cmd.CommandDescriptor{
 		Name:  "annotate",
 		Brief: "Annotate an address",
 		Description: "Provide a code annotation at a memory address." +
 			" When disassembling code at this address, the annotation will" +
-			" be displayed.",
-		Usage: "annotate <address> <string>",
+			" be displayed. Use 'annotate save' to write all annotations to" +
+			" a text file, and 'annotate load' to read them back. Each line" +
+			" of the file holds a hexadecimal address followed by its" +
+			" annotation. Use 'annotate listing' to write a listing of the" +
+			" code from <start> through <end> to a file, with each line of" +
+			" source code followed by the address, bytes and disassembly of" +
+			" the code it generated.",
+		Usage: "annotate <address> <string>|load <filename>|save <filename>|listing <start> <end> <filename>",
 		Data:  (*Host).cmdAnnotate,
 	})
 
@@ -29,8 +55,12 @@ func init() {
 		Brief: "Assemble a file from disk and save the binary to disk",
 		Description: "Run the cross-assembler on the specified file," +
 			" producing a binary file and source map file if successful." +
-			" If you want verbose output, specify true as a second parameter.",
-		Usage: "assemble file <filename> [<verbose>]",
+			" If more than one file is specified, the files are assembled" +
+			" in order into a single binary and source map named after" +
+			" the first file, and labels defined in any file are visible" +
+			" in all of them. If you want verbose output, specify true as" +
+			" the last parameter.",
+		Usage: "assemble file <filename> [<filename> ...] [<verbose>]",
 		Data:  (*Host).cmdAssembleFile,
 	})
 	as.AddCommand(cmd.CommandDescriptor{
@@ -39,10 +69,25 @@ func init() {
 		Description: "Start interactive assembler mode. A new prompt will" +
 			" appear, allowing you to enter assembly language instructions" +
 			" interactively.  Once you type END, the instructions will be" +
-			" assembled and stored in memory at the specified address.",
+			" assembled and stored in memory at the specified address." +
+			" Labels are not case-sensitive, but string and character" +
+			" literals keep their case.",
 		Usage: "assemble interactive <address>",
 		Data:  (*Host).cmdAssembleInteractive,
 	})
+	as.AddCommand(cmd.CommandDescriptor{
+		Name:  "text",
+		Brief: "Assemble pasted source code",
+		Description: "Start source text entry mode. Lines of assembly" +
+			" language source code may be typed or pasted, using the full" +
+			" syntax accepted by the assembler, including labels and" +
+			" pseudo-ops. Once you type .END on a line by itself, the" +
+			" source is assembled and stored in memory at the specified" +
+			" address, or at the address given by an .ORG pseudo-op." +
+			" Labels are not case-sensitive.",
+		Usage: "assemble text <address>",
+		Data:  (*Host).cmdAssembleText,
+	})
 	as.AddCommand(cmd.CommandDescriptor{
 		Name:  "map",
 		Brief: "Create a source map file",
@@ -53,6 +98,31 @@ func init() {
 		Data:  (*Host).cmdAssembleMap,
 	})
 
+	// BCD commands
+	bc := root.AddSubtree(cmd.TreeDescriptor{Name: "bcd", Brief: "Decimal mode arithmetic commands"})
+	bc.AddCommand(cmd.CommandDescriptor{
+		Name:  "adc",
+		Brief: "Compute a decimal mode addition",
+		Description: "Compute the result of a decimal mode ADC instruction" +
+			" with the given accumulator value, operand and carry flag, and" +
+			" display the resulting accumulator, flags and cycle count on" +
+			" both the NMOS 6502 and the CMOS 65C02. The CPU state is not" +
+			" changed.",
+		Usage: "bcd adc <a> <operand> <carry>",
+		Data:  (*Host).cmdBCDAdc,
+	})
+	bc.AddCommand(cmd.CommandDescriptor{
+		Name:  "sbc",
+		Brief: "Compute a decimal mode subtraction",
+		Description: "Compute the result of a decimal mode SBC instruction" +
+			" with the given accumulator value, operand and carry flag, and" +
+			" display the resulting accumulator, flags and cycle count on" +
+			" both the NMOS 6502 and the CMOS 65C02. The CPU state is not" +
+			" changed.",
+		Usage: "bcd sbc <a> <operand> <carry>",
+		Data:  (*Host).cmdBCDSbc,
+	})
+
 	// Breakpoint commands
 	bp := root.AddSubtree(cmd.TreeDescriptor{Name: "breakpoint", Brief: "Breakpoint commands"})
 	bp.AddCommand(cmd.CommandDescriptor{
@@ -66,10 +136,28 @@ func init() {
 		Name:  "add",
 		Brief: "Add a breakpoint",
 		Description: "Add a breakpoint at the specified address." +
-			" The breakpoints starts enabled.",
+			" The address may be given as the name of any label defined" +
+			" by a loaded source map. If the name isn't found, similarly" +
+			" named labels are suggested. The breakpoints starts enabled.",
 		Usage: "breakpoint add <address>",
 		Data:  (*Host).cmdBreakpointAdd,
 	})
+	bp.AddCommand(cmd.CommandDescriptor{
+		Name:  "action",
+		Brief: "Run a command when a breakpoint is hit",
+		Description: "Attach a command to the breakpoint at the specified" +
+			" address, adding the breakpoint if necessary. The command is" +
+			" run whenever the breakpoint is hit. If 'continue' is" +
+			" specified, the CPU keeps running after the command instead" +
+			" of stopping, which is useful for logging registers or memory" +
+			" without halting the program. If 'stop' is specified, the CPU" +
+			" stops as usual before the command runs. If no command is" +
+			" given, the breakpoint's action is removed. Only commands" +
+			" that display information, such as disassemble, evaluate," +
+			" examine, memory dump and register, can be used as actions.",
+		Usage: "breakpoint action <address> [stop|continue <command>]",
+		Data:  (*Host).cmdBreakpointAction,
+	})
 	bp.AddCommand(cmd.CommandDescriptor{
 		Name:        "remove",
 		Brief:       "Remove a breakpoint",
@@ -78,22 +166,86 @@ func init() {
 		Data:        (*Host).cmdBreakpointRemove,
 	})
 	bp.AddCommand(cmd.CommandDescriptor{
-		Name:        "enable",
-		Brief:       "Enable a breakpoint",
-		Description: "Enable a previously added breakpoint.",
-		Usage:       "breakpoint enable <address>",
-		Data:        (*Host).cmdBreakpointEnable,
+		Name:  "enable",
+		Brief: "Enable a breakpoint",
+		Description: "Enable a previously added breakpoint. Specify all" +
+			" instead of an address to enable every breakpoint.",
+		Usage: "breakpoint enable <address>|all",
+		Data:  (*Host).cmdBreakpointEnable,
 	})
 	bp.AddCommand(cmd.CommandDescriptor{
 		Name:  "disable",
 		Brief: "Disable a breakpoint",
 		Description: "Disable a previously added breakpoint. This" +
 			" prevents the breakpoint from being hit when running the" +
-			" CPU",
-		Usage: "breakpoint disable <address>",
+			" CPU. Specify all instead of an address to disable every" +
+			" breakpoint.",
+		Usage: "breakpoint disable <address>|all",
 		Data:  (*Host).cmdBreakpointDisable,
 	})
 
+	// Call trace commands
+	ct := root.AddSubtree(cmd.TreeDescriptor{Name: "calltrace", Brief: "Call trace commands"})
+	ct.AddCommand(cmd.CommandDescriptor{
+		Name:  "start",
+		Brief: "Start tracing calls",
+		Description: "Start recording subroutine calls and returns while the" +
+			" CPU runs or steps. Each JSR, RTS and RTI executed is recorded," +
+			" along with serviced interrupts and trapped BRK instructions." +
+			" Any previously recorded trace is discarded.",
+		Usage: "calltrace start",
+		Data:  (*Host).cmdCallTraceStart,
+	})
+	ct.AddCommand(cmd.CommandDescriptor{
+		Name:        "stop",
+		Brief:       "Stop tracing calls",
+		Description: "Stop recording subroutine calls and returns.",
+		Usage:       "calltrace stop",
+		Data:        (*Host).cmdCallTraceStop,
+	})
+	ct.AddCommand(cmd.CommandDescriptor{
+		Name:  "show",
+		Brief: "Display the call trace",
+		Description: "Display the recorded calls and returns as a tree," +
+			" indented by call depth. Each line shows the address of the" +
+			" call or return instruction and the address it transferred" +
+			" control to. The number of most recent events to display may" +
+			" be specified as an option.",
+		Usage: "calltrace show [<count>]",
+		Data:  (*Host).cmdCallTraceShow,
+	})
+	ct.AddCommand(cmd.CommandDescriptor{
+		Name:        "clear",
+		Brief:       "Clear the call trace",
+		Description: "Discard all recorded calls and returns.",
+		Usage:       "calltrace clear",
+		Data:        (*Host).cmdCallTraceClear,
+	})
+
+	root.AddCommand(cmd.CommandDescriptor{
+		Name:  "codefind",
+		Brief: "Search code for a sequence of instructions",
+		Description: "Disassemble the most recently loaded binary and" +
+			" display every place where the specified instructions appear" +
+			" consecutively, regardless of their operands or addressing" +
+			" modes. Use * to match any instruction. For example," +
+			" 'codefind LDA STA' finds every LDA immediately followed by" +
+			" an STA. Data regions in the loaded source maps are skipped.",
+		Usage: "codefind <mnemonic> [<mnemonic> ...]",
+		Data:  (*Host).cmdCodeFind,
+	})
+	root.AddCommand(cmd.CommandDescriptor{
+		Name:  "coldstart",
+		Brief: "Reset the CPU to its power-on state",
+		Description: "Simulate a cold boot of the CPU. The A, X and Y" +
+			" registers and the status flags are cleared, the stack" +
+			" pointer is set to $FD, the cycle counter is zeroed, and the" +
+			" CPU's reset sequence is run, loading the program counter" +
+			" from the reset vector. Memory is left unchanged.",
+		Usage: "coldstart",
+		Data:  (*Host).cmdColdStart,
+	})
+
 	// Data breakpoint commands
 	db := root.AddSubtree(cmd.TreeDescriptor{Name: "databreakpoint", Brief: "Data Breakpoint commands"})
 	db.AddCommand(cmd.CommandDescriptor{
@@ -110,32 +262,66 @@ func init() {
 			" memory address. When the CPU stores data at this address, the " +
 			" breakpoint will stop the CPU. Optionally, a byte " +
 			" value may be specified, and the CPU will stop only " +
-			" when this value is stored. The data breakpoint starts" +
-			" enabled.",
-		Usage: "databreakpoint add <address> [<value>]",
+			" when this value is stored. If 'mask' is specified, the CPU" +
+			" stops only when the stored value, masked with <mask>, equals" +
+			" <value>. The mask must be non-zero. The data breakpoint" +
+			" starts enabled.",
+		Usage: "databreakpoint add <address> [<value> | mask <mask> <value>]",
 		Data:  (*Host).cmdDataBreakpointAdd,
 	})
+	db.AddCommand(cmd.CommandDescriptor{
+		Name:  "stack",
+		Brief: "Guard the stack against stray stores",
+		Description: "Add a data breakpoint that stops the CPU whenever an" +
+			" instruction stores to the in-use part of the stack page," +
+			" the addresses above the current stack pointer. Pushes never" +
+			" trigger it, but an instruction like STA $0101,X that" +
+			" overwrites a saved return address does. Use 'stack' in" +
+			" place of an address to remove, enable or disable it.",
+		Usage: "databreakpoint stack",
+		Data:  (*Host).cmdDataBreakpointStack,
+	})
+	db.AddCommand(cmd.CommandDescriptor{
+		Name:  "watch",
+		Brief: "Log stores to an address",
+		Description: "Add a data breakpoint that logs every store to the" +
+			" specified memory address without stopping the CPU. Use" +
+			" 'databreakpoint log' to display the logged stores.",
+		Usage: "databreakpoint watch <address>",
+		Data:  (*Host).cmdDataBreakpointWatch,
+	})
+	db.AddCommand(cmd.CommandDescriptor{
+		Name:  "log",
+		Brief: "Display logged stores",
+		Description: "Display the stores logged by watch data breakpoints," +
+			" including the address of each storing instruction and the" +
+			" value it stored. Specify clear to discard the log.",
+		Usage: "databreakpoint log [clear]",
+		Data:  (*Host).cmdDataBreakpointLog,
+	})
 	db.AddCommand(cmd.CommandDescriptor{
 		Name:  "remove",
 		Brief: "Remove a data breakpoint",
 		Description: "Remove a previously added data breakpoint at" +
 			" the specified memory address.",
-		Usage: "databreakpoint remove <address>",
+		Usage: "databreakpoint remove <address>|stack",
 		Data:  (*Host).cmdDataBreakpointRemove,
 	})
 	db.AddCommand(cmd.CommandDescriptor{
-		Name:        "enable",
-		Brief:       "Enable a data breakpoint",
-		Description: "Enable a previously added breakpoint.",
-		Usage:       "databreakpoint enable <address>",
-		Data:        (*Host).cmdDataBreakpointEnable,
+		Name:  "enable",
+		Brief: "Enable a data breakpoint",
+		Description: "Enable a previously added data breakpoint. Specify" +
+			" all instead of an address to enable every data breakpoint.",
+		Usage: "databreakpoint enable <address>|stack|all",
+		Data:  (*Host).cmdDataBreakpointEnable,
 	})
 	db.AddCommand(cmd.CommandDescriptor{
-		Name:        "disable",
-		Brief:       "Disable a data breakpoint",
-		Description: "Disable a previously added breakpoint.",
-		Usage:       "databreakpoint disable <address>",
-		Data:        (*Host).cmdDataBreakpointDisable,
+		Name:  "disable",
+		Brief: "Disable a data breakpoint",
+		Description: "Disable a previously added data breakpoint. Specify" +
+			" all instead of an address to disable every data breakpoint.",
+		Usage: "databreakpoint disable <address>|stack|all",
+		Data:  (*Host).cmdDataBreakpointDisable,
 	})
 
 	root.AddCommand(cmd.CommandDescriptor{
@@ -144,16 +330,38 @@ func init() {
 		Description: "Disassemble machine code starting at the requested" +
 			" address. The number of instruction lines to disassemble may be" +
 			" specified as an option. If no address is specified, the" +
-			" disassembly continues from where the last disassembly left off.",
-		Usage: "disassemble [<address>] [<lines>]",
+			" disassembly continues from where the last disassembly left off." +
+			" If 'routine' is specified, disassembly stops after the first" +
+			" RTS, RTI or JMP instruction, and the number of lines is a" +
+			" limit. Addresses that a loaded source map identifies as data" +
+			" are displayed as .DB, .DW or .DD lines. If 'source' is" +
+			" specified, the code from <start> through <end> is written to a" +
+			" file as source code that reassembles to the same bytes, using" +
+			" exported labels and generating labels for branch and jump" +
+			" targets. If 'labels' is specified, the lines are first scanned" +
+			" for branch, jump and subroutine call targets, which are given" +
+			" generated labels of the form Lxxxx (or their exported labels)" +
+			" and displayed in operands and on label lines at the targets.",
+		Usage: "disassemble [routine|labels] [<address>] [<lines>]|source <start> <end> <filename>",
 		Data:  (*Host).cmdDisassemble,
 	})
 	root.AddCommand(cmd.CommandDescriptor{
-		Name:        "evaluate",
-		Brief:       "Evaluate an expression",
-		Description: "Evaluate a mathemetical expression.",
-		Usage:       "evaluate <expression>",
-		Data:        (*Host).cmdEvaluate,
+		Name:  "evaluate",
+		Brief: "Evaluate an expression",
+		Description: "Evaluate a mathemetical expression. The result is" +
+			" displayed in hexadecimal, decimal, signed and binary form.",
+		Usage: "evaluate <expression>",
+		Data:  (*Host).cmdEvaluate,
+	})
+	root.AddCommand(cmd.CommandDescriptor{
+		Name:  "examine",
+		Brief: "Examine the instruction at the program counter",
+		Description: "Disassemble the instruction at the program counter" +
+			" (or the requested address) and show the effective address it" +
+			" will access, computed from its addressing mode and the current" +
+			" register values, along with the value currently stored there.",
+		Usage: "examine [<address>]",
+		Data:  (*Host).cmdExamine,
 	})
 	root.AddCommand(cmd.CommandDescriptor{
 		Name:  "execute",
@@ -172,6 +380,77 @@ func init() {
 		Usage: "exports",
 		Data:  (*Host).cmdExports,
 	})
+	root.AddCommand(cmd.CommandDescriptor{
+		Name:  "file",
+		Brief: "Set the current source file",
+		Description: "Set the source file used by commands that accept" +
+			" a source line in place of an address. Any address may be" +
+			" given as <file>:<line>, which refers to the code generated" +
+			" by a line of a loaded source file. When the file is omitted," +
+			" as in :<line>, the current source file is used. When used" +
+			" without arguments, this command lists all loaded source" +
+			" files.",
+		Usage: "file [<filename>]",
+		Data:  (*Host).cmdFile,
+	})
+	root.AddCommand(cmd.CommandDescriptor{
+		Name:  "finish",
+		Brief: "Run until the current subroutine finishes",
+		Description: "Run the CPU until the stack pointer rises above its" +
+			" current value, meaning the current subroutine and everything" +
+			" it called have returned. Unlike step out, the return is" +
+			" detected by any instruction that pops the stack, so it works" +
+			" with code that manipulates the stack directly. To run until" +
+			" the stack pointer reaches a specific depth instead, specify" +
+			" the target stack pointer value.",
+		Usage: "finish [<sp>]",
+		Data:  (*Host).cmdFinish,
+	})
+	root.AddCommand(cmd.CommandDescriptor{
+		Name:  "histogram",
+		Brief: "Display instruction frequencies",
+		Description: "Disassemble a range of memory and display how many" +
+			" times each instruction and addressing mode appears, sorted" +
+			" from most to least frequent. Data regions in the loaded source" +
+			" maps and invalid opcodes are skipped. If no range is" +
+			" specified, the most recently loaded binary is used.",
+		Usage: "histogram [<start> <end>]",
+		Data:  (*Host).cmdHistogram,
+	})
+	root.AddCommand(cmd.CommandDescriptor{
+		Name:  "history",
+		Brief: "Display recently executed instructions",
+		Description: "Display the most recently executed instructions, oldest" +
+			" first, along with the register values after each one. Up to" +
+			" 64 instructions are remembered, making it easy to see how the" +
+			" CPU arrived at a breakpoint. Specify a count to display only" +
+			" the most recent instructions, or clear to discard the history.",
+		Usage: "history [<count> | clear]",
+		Data:  (*Host).cmdHistory,
+	})
+
+	// Interrupt commands
+	in := root.AddSubtree(cmd.TreeDescriptor{Name: "interrupt", Brief: "Interrupt commands"})
+	in.AddCommand(cmd.CommandDescriptor{
+		Name:  "irq",
+		Brief: "Request an IRQ",
+		Description: "Request a maskable interrupt. The interrupt stays" +
+			" pending until the CPU services it, which happens at the next" +
+			" instruction boundary where interrupts are enabled. Stepping" +
+			" into a serviced interrupt enters its handler, and stepping" +
+			" over it runs the whole handler.",
+		Usage: "interrupt irq",
+		Data:  (*Host).cmdInterruptIRQ,
+	})
+	in.AddCommand(cmd.CommandDescriptor{
+		Name:  "nmi",
+		Brief: "Request an NMI",
+		Description: "Request a non-maskable interrupt. The CPU services" +
+			" it at the next instruction boundary.",
+		Usage: "interrupt nmi",
+		Data:  (*Host).cmdInterruptNMI,
+	})
+
 	root.AddCommand(cmd.CommandDescriptor{
 		Name:  "list",
 		Brief: "List source code lines",
@@ -187,10 +466,40 @@ func init() {
 		Description: "Load the contents of a binary file into the emulated" +
 			" system's memory. If the file has an associated source map, it" +
 			" will be loaded too. If the file contains raw binary data, you must" +
-			" specify the address where the data will be loaded.",
-		Usage: "load <filename> [<address>]",
+			" specify the address where the data will be loaded. If 'raw' is" +
+			" specified, the file is loaded at the address without looking" +
+			" for a source map, leaving the loaded source maps and the" +
+			" binary checked by 'verify' unchanged. This is useful for" +
+			" loading data, such as graphics, over part of a program.",
+		Usage: "load [raw] <filename> [<address>]",
 		Data:  (*Host).cmdLoad,
 	})
+	root.AddCommand(cmd.CommandDescriptor{
+		Name:  "loadrun",
+		Brief: "Load a binary file and run it",
+		Description: "Load the contents of a binary file into the emulated" +
+			" system's memory, then run the CPU starting from the address" +
+			" where the file was loaded. If the file contains raw binary" +
+			" data, you must specify the address where the data will be" +
+			" loaded.",
+		Usage: "loadrun <filename> [<address>]",
+		Data:  (*Host).cmdLoadRun,
+	})
+
+	// Source map commands
+	mp := root.AddSubtree(cmd.TreeDescriptor{Name: "map", Brief: "Source map commands"})
+	mp.AddCommand(cmd.CommandDescriptor{
+		Name:  "diff",
+		Brief: "Compare two source map files",
+		Description: "Load two source map files and report how the address" +
+			" layout changed between them: a different origin or size," +
+			" source files that were added or removed, exported labels" +
+			" that were added, removed or moved, and ranges of source lines" +
+			" whose addresses shifted. Symbols are compared too if both" +
+			" maps contain them.",
+		Usage: "map diff <filename1> <filename2>",
+		Data:  (*Host).cmdMapDiff,
+	})
 
 	// Memory commands
 	me := root.AddSubtree(cmd.TreeDescriptor{Name: "memory", Brief: "Memory commands"})
@@ -200,20 +509,37 @@ func init() {
 		Description: "Dump the contents of memory starting from the" +
 			" specified address. The number of bytes to dump may be" +
 			" specified as an option. If no address is specified, the" +
-			" memory dump continues from where the last dump left off.",
+			" memory dump continues from where the last dump left off." +
+			" Values that changed since the last dump of the same range" +
+			" are highlighted.",
 		Usage: "memory dump [<address>] [<bytes>]",
 		Data:  (*Host).cmdMemoryDump,
 	})
-	me.AddCommand(cmd.CommandDescriptor{
+	memorySet := me.AddCommand(cmd.CommandDescriptor{
 		Name:  "set",
 		Brief: "Set memory at address",
 		Description: "Set the contents of memory starting from the specified" +
 			" address. The values to assign should be a series of" +
-			" space-separated byte values. You may use an expression for each" +
-			" byte value.",
-		Usage: "memory set <address> <byte> [<byte> ...]",
+			" space-separated or comma-separated byte values. You may use an" +
+			" expression for each byte value. A value may also be a" +
+			" double-quoted string, which stores the string's ASCII bytes" +
+			" just as the assembler's .DB pseudo-op would.",
+		Usage: "memory set <address> <byte>|<string> [<byte>|<string> ...]",
 		Data:  (*Host).cmdMemorySet,
 	})
+	me.AddCommand(cmd.CommandDescriptor{
+		Name:  "paste",
+		Brief: "Paste hex bytes into memory",
+		Description: "Enter or paste lines of hexadecimal byte values to" +
+			" store in memory starting at the specified address. Input ends" +
+			" with a blank line. A line may begin with an address followed" +
+			" by a colon or dash, as in the output of memory dump or a" +
+			" machine-language monitor, in which case its bytes are stored" +
+			" at that address. Trailing ASCII columns are ignored, so the" +
+			" output of tools like xxd and hexdump -C may also be pasted.",
+		Usage: "memory paste <address>",
+		Data:  (*Host).cmdMemoryPaste,
+	})
 	me.AddCommand(cmd.CommandDescriptor{
 		Name:  "copy",
 		Brief: "Copy memory",
@@ -223,6 +549,29 @@ func init() {
 		Usage: "memory copy <dst addr> <src addr begin> <src addr end>",
 		Data:  (*Host).cmdMemoryCopy,
 	})
+	me.AddCommand(cmd.CommandDescriptor{
+		Name:  "unmap",
+		Brief: "Flag a range of memory as unmapped",
+		Description: "Flag a range of addresses as unmapped. When the OpenBus" +
+			" setting is true, reading an unmapped address returns the last" +
+			" value transferred over the bus, and storing to it has no" +
+			" effect. Use clear instead of an address range to remove all" +
+			" unmapped flags.",
+		Usage: "memory unmap <addr begin> <addr end>|clear",
+		Data:  (*Host).cmdMemoryUnmap,
+	})
+	me.AddCommand(cmd.CommandDescriptor{
+		Name:  "map",
+		Brief: "Display a map of memory usage",
+		Description: "Display a map of the 64K address space, with one" +
+			" character per 256-byte page. Each page is marked as holding" +
+			" code or data (according to the loaded source maps), the most" +
+			" recently loaded binary, a memory-mapped device, the zero" +
+			" page, the stack or the interrupt vectors. Pages with none of" +
+			" these are shown as empty.",
+		Usage: "memory map",
+		Data:  (*Host).cmdMemoryMap,
+	})
 
 	root.AddCommand(cmd.CommandDescriptor{
 		Name:        "quit",
@@ -247,7 +596,10 @@ func init() {
 		Name:  "run",
 		Brief: "Run the CPU",
 		Description: "Run the CPU until a breakpoint is hit or until the" +
-			" user types Ctrl-C.",
+			" user types Ctrl-C. If the RunLimit setting is non-zero, the" +
+			" CPU also stops after executing that many instructions. When" +
+			" run from a script, the CPU always stops after a limited number" +
+			" of instructions so that the script can continue.",
 		Usage: "run",
 		Data:  (*Host).cmdRun,
 	})
@@ -260,6 +612,99 @@ func init() {
 		Usage: "set [<var> <value>]",
 		Data:  (*Host).cmdSet,
 	})
+	root.AddCommand(cmd.CommandDescriptor{
+		Name:  "status",
+		Brief: "Display the processor status byte",
+		Description: "Display the processor status register in hexadecimal" +
+			" and binary form, along with the values pushed onto the stack" +
+			" by PHP or BRK (with the break bit set) and by an IRQ or NMI" +
+			" (with the break bit clear).",
+		Usage: "status",
+		Data:  (*Host).cmdStatus,
+	})
+	root.AddCommand(cmd.CommandDescriptor{
+		Name:  "symbols",
+		Brief: "List symbols",
+		Description: "Display a list of all labels and constants defined by" +
+			" loaded binary files. Symbols are stored in a binary file's" +
+			" associated source map file when the file is assembled by" +
+			" the host. If a filter is specified, only symbols whose names" +
+			" contain the filter text are displayed. If 'save' is" +
+			" specified, the symbols are written to a file that another" +
+			" debugger can load, either as a VICE monitor label file" +
+			" (vice, the default) or as a no$ debugger .sym file (nocash)." +
+			" When no symbols were stored, the exported labels are saved.",
+		Usage: "symbols [<filter>]|save <filename> [vice|nocash]",
+		Data:  (*Host).cmdSymbols,
+	})
+
+	// Theme commands
+	th := root.AddSubtree(cmd.TreeDescriptor{Name: "theme", Brief: "Color theme commands"})
+	th.AddCommand(cmd.CommandDescriptor{
+		Name:  "load",
+		Brief: "Load a color theme",
+		Description: "Load the colors used by the host's output, and the" +
+			" command prompt, from a file. Each line of the file has the" +
+			" form <element> = <value>. The elements addr, code, inst," +
+			" operand, regname, regvalue, regequal, source, annotation and" +
+			" promptcolor take a color: none, black, red, green, yellow," +
+			" blue, magenta, cyan or white, optionally prefixed by bright." +
+			" The prompt element takes the prompt text, which may be" +
+			" quoted. Lines starting with # or ; are comments. Elements" +
+			" not in the file keep their current colors. To disable colors" +
+			" entirely, use 'set color off'. A 'theme load' command in the" +
+			" startup script applies a theme on every run.",
+		Usage: "theme load <filename>",
+		Data:  (*Host).cmdThemeLoad,
+	})
+	th.AddCommand(cmd.CommandDescriptor{
+		Name:        "reset",
+		Brief:       "Restore the default color theme",
+		Description: "Restore the default colors and command prompt.",
+		Usage:       "theme reset",
+		Data:        (*Host).cmdThemeReset,
+	})
+
+	// Vector commands
+	ve := root.AddSubtree(cmd.TreeDescriptor{Name: "vector", Brief: "Interrupt vector commands"})
+	ve.AddCommand(cmd.CommandDescriptor{
+		Name:        "list",
+		Brief:       "List interrupt vectors",
+		Description: "Display the addresses stored in the NMI, reset and IRQ vectors.",
+		Usage:       "vector list",
+		Data:        (*Host).cmdVectorList,
+	})
+	ve.AddCommand(cmd.CommandDescriptor{
+		Name:        "nmi",
+		Brief:       "Set the NMI vector",
+		Description: "Store an address into the NMI vector at $FFFA.",
+		Usage:       "vector nmi <address>",
+		Data:        (*Host).cmdVectorNMI,
+	})
+	ve.AddCommand(cmd.CommandDescriptor{
+		Name:        "reset",
+		Brief:       "Set the reset vector",
+		Description: "Store an address into the reset vector at $FFFC.",
+		Usage:       "vector reset <address>",
+		Data:        (*Host).cmdVectorReset,
+	})
+	ve.AddCommand(cmd.CommandDescriptor{
+		Name:        "irq",
+		Brief:       "Set the IRQ vector",
+		Description: "Store an address into the IRQ/BRK vector at $FFFE.",
+		Usage:       "vector irq <address>",
+		Data:        (*Host).cmdVectorIRQ,
+	})
+
+	root.AddCommand(cmd.CommandDescriptor{
+		Name:  "verify",
+		Brief: "Compare memory against the loaded binary",
+		Description: "Compare the contents of memory against the most" +
+			" recently loaded binary file, and list all addresses whose" +
+			" values have changed since the file was loaded.",
+		Usage: "verify",
+		Data:  (*Host).cmdVerify,
+	})
 
 	// Step commands
 	st := root.AddSubtree(cmd.TreeDescriptor{Name: "step", Brief: "Step the debugger"})
@@ -268,6 +713,7 @@ func init() {
 		Brief: "Step into next instruction",
 		Description: "Step the CPU by a single instruction. If the" +
 			" instruction is a subroutine call, step into the subroutine." +
+			" If an interrupt is due, step into its handler instead." +
 			" The number of steps may be specified as an option.",
 		Usage: "step in [<count>]",
 		Data:  (*Host).cmdStepIn,
@@ -285,12 +731,26 @@ func init() {
 		Name:  "out",
 		Brief: "Step out of the current subroutine",
 		Description: "Step the CPU until it executes an RTS or RTI" +
-			" instruction. This has the effect of stepping until the " +
-			" currently running subroutine has returned.",
+			" instruction that returns from the currently running" +
+			" subroutine. The stack pointer is used to detect the return," +
+			" so RTS instructions executed by nested subroutines are" +
+			" stepped through.",
 		Usage: "step out",
 		Data:  (*Host).cmdStepOut,
 	})
 
+	st.AddCommand(cmd.CommandDescriptor{
+		Name:  "until",
+		Brief: "Step until a status flag changes",
+		Description: "Step the CPU one instruction at a time until the" +
+			" requested status flag changes value, then stop and report" +
+			" the address of the instruction that changed it. Allowed flag" +
+			" names include N (Sign), Z (Zero), C (Carry), I" +
+			" (InterruptDisable), D (Decimal) and V (Overflow).",
+		Usage: "step until flag <name>",
+		Data:  (*Host).cmdStepUntil,
+	})
+
 	// Add command shortcuts.
 	root.AddShortcut("a", "assemble file")
 	root.AddShortcut("ai", "assemble interactive")
@@ -312,9 +772,11 @@ func init() {
 	root.AddShortcut("dbd", "databreakpoint disable")
 	root.AddShortcut("e", "evaluate")
 	root.AddShortcut("l", "list")
+	root.AddShortcut("x", "examine")
 	root.AddShortcut("m", "memory dump")
 	root.AddShortcut("mc", "memory copy")
 	root.AddShortcut("ms", "memory set")
+	root.AddShortcut("memmap", "memory map")
 	root.AddShortcut("r", "register")
 	root.AddShortcut("s", "step over")
 	root.AddShortcut("si", "step in")
@@ -323,4 +785,20 @@ func init() {
 	root.AddShortcut(".", "register")
 
 	cmds = root
+	quotedArgCommands = map[*cmd.Command]bool{memorySet: true}
+
+	actionCommands = make(map[*cmd.Command]bool)
+	for _, name := range []string{
+		"breakpoint list", "calltrace show", "codefind",
+		"databreakpoint list", "databreakpoint log", "disassemble",
+		"evaluate", "examine", "exports", "histogram", "history", "list",
+		"memory dump", "memory map", "register", "status", "symbols",
+		"vector list", "verify",
+	} {
+		if n, _, err := root.Lookup(name); err == nil {
+			if c, ok := n.(*cmd.Command); ok {
+				actionCommands[c] = true
+			}
+		}
+	}
 }
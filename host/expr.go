@@ -45,6 +45,8 @@ const (
 	opUnaryMinus
 	opUnaryPlus
 	opUnaryBinary
+	opPeekByte
+	opPeekWord
 )
 
 type associativity byte
@@ -61,7 +63,7 @@ type op struct {
 	Assoc      associativity
 	Args       byte
 	UnaryOp    opType
-	Eval       func(a, b int64) int64
+	Eval       func(a, b int64) int64 // nil for memory peek ops
 }
 
 var ops = []op{
@@ -80,6 +82,8 @@ var ops = []op{
 	{"-", opUnaryMinus, 7, left, 1, opNil, func(a, b int64) int64 { return -a }},
 	{"+", opUnaryPlus, 7, left, 1, opNil, func(a, b int64) int64 { return a }},
 	{"%", opUnaryBinary, 7, left, 1, opNil, func(a, b int64) int64 { return fromBinary(a) }},
+	{"@", opPeekByte, 7, left, 1, opNil, nil},
+	{"@@", opPeekWord, 7, left, 1, opNil, nil},
 }
 
 // lexeme identifiers
@@ -101,6 +105,7 @@ const (
 	lXor
 	lOra
 	lNot
+	lAt
 )
 
 // A table mapping lexeme identifiers to token data and parsers.
@@ -126,6 +131,7 @@ var lexeme = []struct {
 	/*lXor*/ {TokenType: tokenOp, OpType: opBitwiseXor},
 	/*lOra*/ {TokenType: tokenOp, OpType: opBitwiseOr},
 	/*lNot*/ {TokenType: tokenOp, OpType: opBitwiseNot},
+	/*lAt */ {TokenType: tokenOp, OpType: opNil, Parse: (*exprParser).parsePeekOp},
 }
 
 // A table mapping the first char of a lexeme to a lexeme identifier.
@@ -134,7 +140,7 @@ var lex0 = [96]byte{
 	lLPa, lRPa, lMul, lAdd, lNil, lSub, lIde, lDiv, // 40..47
 	lNum, lNum, lNum, lNum, lNum, lNum, lNum, lNum, // 48..55
 	lNum, lNum, lNil, lNil, lShl, lNil, lShr, lNil, // 56..63
-	lNil, lIde, lIde, lIde, lIde, lIde, lIde, lIde, // 64..71
+	lAt, lIde, lIde, lIde, lIde, lIde, lIde, lIde, // 64..71
 	lIde, lIde, lIde, lIde, lIde, lIde, lIde, lIde, // 72..79
 	lIde, lIde, lIde, lIde, lIde, lIde, lIde, lIde, // 80..87
 	lIde, lIde, lIde, lNil, lNil, lNil, lXor, lIde, // 88..95
@@ -146,6 +152,7 @@ var lex0 = [96]byte{
 
 type resolver interface {
 	resolveIdentifier(s string) (int64, error)
+	resolveMemory(addr uint16, word bool) int64
 }
 
 //
@@ -234,7 +241,7 @@ func (p *exprParser) Parse(expr string, r resolver) (int64, error) {
 		p.output.push(tok)
 	}
 
-	result, err := p.evalOutput()
+	result, err := p.evalOutput(r)
 	if err != nil {
 		return 0, err
 	}
@@ -357,7 +364,14 @@ func (p *exprParser) parseShiftOp(t tstring) (tok token, remain tstring, err err
 	return tok, t.consume(2), nil
 }
 
-func (p *exprParser) evalOutput() (token, error) {
+func (p *exprParser) parsePeekOp(t tstring) (tok token, remain tstring, err error) {
+	if len(t) > 1 && t[1] == '@' {
+		return token{tokenOp, &ops[opPeekWord]}, t.consume(2), nil
+	}
+	return token{tokenOp, &ops[opPeekByte]}, t.consume(1), nil
+}
+
+func (p *exprParser) evalOutput(r resolver) (token, error) {
 	if p.output.isEmpty() {
 		return token{}, errExprParse
 	}
@@ -373,20 +387,26 @@ func (p *exprParser) evalOutput() (token, error) {
 	op := tok.Value.(*op)
 	switch op.Args {
 	case 1:
-		child, err := p.evalOutput()
+		child, err := p.evalOutput(r)
 		if err != nil {
 			return token{}, err
 		}
 		tok.Type = tokenNumber
-		tok.Value = op.Eval(child.Value.(int64), 0)
+		switch op.Type {
+		case opPeekByte, opPeekWord:
+			addr := uint16(child.Value.(int64))
+			tok.Value = r.resolveMemory(addr, op.Type == opPeekWord)
+		default:
+			tok.Value = op.Eval(child.Value.(int64), 0)
+		}
 		return tok, nil
 
 	default:
-		child2, err := p.evalOutput()
+		child2, err := p.evalOutput(r)
 		if err != nil {
 			return token{}, err
 		}
-		child1, err := p.evalOutput()
+		child1, err := p.evalOutput(r)
 		if err != nil {
 			return token{}, err
 		}
@@ -421,7 +441,13 @@ func (p *exprParser) isCollapsible(opToken *token) bool {
 		return false
 	}
 
+	// A prefix unary op has no left operand, so it never collapses the
+	// operators preceding it.
 	currOp := opToken.Value.(*op)
+	if currOp.Args == 1 {
+		return false
+	}
+
 	topOp := top.Value.(*op)
 	if topOp.Precedence > currOp.Precedence {
 		return true
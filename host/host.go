@@ -15,6 +15,7 @@ package host
 
 import (
 	"bufio"
+	"crypto/rand"
 	"errors"
 	"fmt"
 	"hash/crc32"
@@ -22,6 +23,7 @@ import (
 	"os"
 	"path/filepath"
 	"reflect"
+	"sort"
 	"strconv"
 	"strings"
 
@@ -37,11 +39,20 @@ type state byte
 const (
 	stateProcessingCommands state = iota
 	stateMiniAssembler
+	statePasting
 	stateRunning
 	stateInterrupted
 	stateBreakpoint
 )
 
+// The maximum number of instructions executed by the run command when
+// commands are processed from a script and no run limit has been set.
+const defaultRunLimit = 10000000
+
+// The default maximum number of instructions displayed by the disassemble
+// routine command.
+const maxRoutineLines = 1000
+
 // A Host represents a fully emulated 6502 system, 64K of memory, a built-in
 // assembler, a built-in debugger, and other useful tools.
 type Host struct {
@@ -51,9 +62,13 @@ type Host struct {
 	rawTerminal    *term.Terminal
 	rawInputState  *term.State
 	rawOutputState *term.State
-	theme          *disasm.Theme
+	theme          *disasm.Theme // active theme, colored or plain
+	colorTheme     hostTheme     // theme used when color output is enabled
 	prompt         string
-	mem            *cpu.FlatMemory
+	mem            *cpu.MappedMemory
+	keyboard       *keyboard
+	rng            *rng
+	console        *consoleInput
 	cpu            *cpu.CPU
 	debugger       *cpu.Debugger
 	lastCmd        *cmd.Command
@@ -61,12 +76,53 @@ type Host struct {
 	lastLine       string
 	state          state
 	miniAddr       uint16
+	miniText       bool
 	assembly       []string
+	pasteAddr      int
+	pasted         []pasteBlock
 	exprParser     *exprParser
 	sourceCode     map[string][]string
 	sourceMap      *asm.SourceMap
 	settings       *settings
 	annotations    map[uint16]string
+	aliases        map[string]string
+	loadedCode     []byte
+	loadedOrigin   uint16
+	loadedPages    [256]bool
+	memoryChanged  bool         // memory was changed by a host command
+	lastDumps      []memoryDump // most recent dumps, oldest first
+	callTracing    bool
+	calls          []callEvent // ring buffer of call trace events
+	callsNext      int         // index of the next event to overwrite when full
+	memInit        string
+}
+
+// A pasteBlock is a block of contiguous bytes entered with the memory paste
+// command.
+type pasteBlock struct {
+	addr uint16
+	b    []byte
+}
+
+// A callEvent is a subroutine call or return recorded by the call tracer.
+type callEvent struct {
+	name string // name of the instruction or interrupt
+	from uint16 // address of the instruction
+	to   uint16 // address of the next instruction executed
+	call bool   // true for a call, false for a return
+}
+
+// The maximum number of call events retained by the call tracer.
+const maxCallEvents = 10000
+
+// The maximum number of memory dump ranges remembered for highlighting
+// changes.
+const maxMemoryDumps = 8
+
+// A memoryDump holds the bytes displayed by a memory dump.
+type memoryDump struct {
+	start, end uint16
+	mem        []byte
 }
 
 // IoState represents the state of the host's I/O subsystem. It is returned
@@ -79,55 +135,54 @@ type IoState struct {
 
 // New creates a new 6502 host environment.
 func New() *Host {
+	input := &consoleInput{}
 	console := struct {
 		io.Reader
 		io.Writer
 	}{
-		os.Stdin,
+		input,
 		os.Stdout,
 	}
 
-	theme := &disasm.Theme{
-		Addr:       term.BrightWhite,
-		Code:       term.White,
-		Inst:       term.BrightCyan,
-		Operand:    term.Green,
-		RegName:    term.BrightYellow,
-		RegValue:   term.BrightGreen,
-		RegEqual:   term.White,
-		Source:     term.BrightGreen,
-		Annotation: term.BrightYellow,
-		Reset:      term.Reset,
-	}
-
 	h := &Host{
 		rawMode:     false,
 		rawTerminal: term.NewTerminal(console, ""),
-		theme:       theme,
+		colorTheme:  defaultTheme,
 		exprParser:  newExprParser(),
 		sourceCode:  make(map[string][]string),
 		sourceMap:   asm.NewSourceMap(),
 		settings:    newSettings(),
 		annotations: make(map[uint16]string),
+		aliases:     make(map[string]string),
+		keyboard:    &keyboard{},
+		rng:         &rng{},
+		console:     input,
 	}
+	input.h = h
 
 	// Set up raw terminal callbacks.
 	h.rawTerminal.AutoCompleteCallback = h.autocomplete
 	h.rawTerminal.HistoryTestCallback = h.historyTest
 
 	// Initialize host state.
+	h.theme = &h.colorTheme.Theme
 	h.setState(stateProcessingCommands)
 
 	// Create the emulated CPU and memory.
-	h.mem = cpu.NewFlatMemory()
+	h.mem = cpu.NewMappedMemory()
+	h.memInit = "zero"
+	h.rng.reseed(h.settings.RngSeed)
 	h.cpu = cpu.NewCPU(cpu.CMOS, h.mem)
 
 	// Create a CPU debugger and attach it to the CPU.
 	h.debugger = cpu.NewDebugger(h)
 	h.cpu.AttachDebugger(h.debugger)
 
-	// Attach this host as a CPU BRK handler.
+	// Attach this host as a CPU BRK handler, illegal opcode handler and
+	// reset handler.
 	h.cpu.AttachBrkHandler(h)
+	h.cpu.AttachIllegalOpcodeHandler(h)
+	h.cpu.AttachResetHandler(h)
 
 	return h
 }
@@ -151,6 +206,10 @@ func (h *Host) enableRawMode() {
 			panic(err)
 		}
 		h.rawMode = true
+
+		if h.settings.KeyboardAddr != 0 {
+			h.console.startPump()
+		}
 	}
 }
 
@@ -239,7 +298,7 @@ func sharedPrefix(strings []string) string {
 }
 
 func (h *Host) historyTest(line string) bool {
-	if h.state == stateMiniAssembler {
+	if h.state == stateMiniAssembler || h.state == statePasting {
 		return false
 	}
 	return line != "" && line != h.lastLine
@@ -330,6 +389,8 @@ func (h *Host) RunCommands(interactive bool) {
 			err = h.processCommand(line)
 		case stateMiniAssembler:
 			err = h.processMiniAssembler(line)
+		case statePasting:
+			err = h.processPaste(line)
 		default:
 			panic("invalid state")
 		}
@@ -345,18 +406,41 @@ func (h *Host) RunCommands(interactive bool) {
 func (h *Host) setState(s state) {
 	h.state = s
 	switch h.state {
-	case stateMiniAssembler:
-		h.prompt = term.Cyan + "! " + term.Reset
+	case stateMiniAssembler, statePasting:
+		h.prompt = h.colorize(term.Cyan, "! ")
 	default:
-		h.prompt = term.Green + "* " + term.Reset
+		h.prompt = h.colorize(h.colorTheme.PromptColor, h.colorTheme.Prompt)
 	}
 	h.rawTerminal.SetPrompt(h.prompt)
 }
 
+// Return a string wrapped in the escape codes for a color, unless color
+// output is disabled.
+func (h *Host) colorize(color, s string) string {
+	if !h.settings.Color || color == "" {
+		return s
+	}
+	return color + s + term.Reset
+}
+
+// Make the theme selected by the Color setting active.
+func (h *Host) applyTheme() {
+	if h.settings.Color {
+		h.theme = &h.colorTheme.Theme
+	} else {
+		h.theme = &plainTheme
+	}
+	h.setState(h.state)
+}
+
 func (h *Host) processCommand(line string) error {
 	var n cmd.Node
 	var args []string
+	count := 1
 	if line != "" {
+		count, line = splitRepeatCount(line)
+		line = h.expandAlias(line)
+
 		var err error
 		n, args, err = cmds.Lookup(line)
 		switch {
@@ -370,6 +454,14 @@ func (h *Host) processCommand(line string) error {
 			fmt.Fprintf(h, "ERROR: %v.\n", err)
 			return nil
 		}
+
+		// The command parser removes the quotes from quoted arguments, so
+		// take the arguments from the line with their quotes intact.
+		if c, ok := n.(*cmd.Command); ok && quotedArgCommands[c] {
+			if fields := quotedFields(line); len(fields) >= len(args) {
+				args = fields[len(fields)-len(args):]
+			}
+		}
 	} else if h.lastCmd != nil {
 		n = h.lastCmd
 		args = h.lastArgs
@@ -384,20 +476,62 @@ func (h *Host) processCommand(line string) error {
 	if c, ok := n.(*cmd.Command); ok {
 		h.lastCmd, h.lastArgs = c, args
 		handler := c.Data.(func(*Host, *cmd.Command, []string) error)
-		return handler(h, c, args)
+
+		// Each repetition behaves as if the user had entered an empty line,
+		// so commands like disassemble continue where they left off. Stop
+		// repeating if the command can't be repeated.
+		for i := 0; i < count; i++ {
+			if i > 0 && (h.lastCmd != c || h.state != stateProcessingCommands) {
+				break
+			}
+			if err := handler(h, c, h.lastArgs); err != nil {
+				return err
+			}
+		}
 	}
 
 	return nil
 }
 
+// Split a leading decimal repeat count (as in "10 s") from the command
+// line. If there is no count, the count is 1 and the line is unchanged.
+func splitRepeatCount(line string) (count int, rest string) {
+	line = strings.TrimLeft(line, " \t")
+	first, rest, ok := strings.Cut(line, " ")
+	if n, err := strconv.Atoi(first); ok && err == nil && n > 0 {
+		return n, rest
+	}
+	return 1, line
+}
+
+// If the first word of the command line is an alias, replace it with the
+// alias's command string.
+func (h *Host) expandAlias(line string) string {
+	line = strings.TrimLeft(line, " \t")
+	name, rest, _ := strings.Cut(line, " ")
+	if a, ok := h.aliases[strings.ToLower(name)]; ok {
+		if rest == "" {
+			return a
+		}
+		return a + " " + rest
+	}
+	return line
+}
+
 func (h *Host) processMiniAssembler(line string) error {
-	line = strings.ToUpper(line)
+	if h.miniText {
+		if strings.EqualFold(strings.TrimSpace(line), ".END") {
+			return h.assembleInline()
+		}
+		h.assembly = append(h.assembly, line)
+		return nil
+	}
 
 	fields := strings.Fields(line)
 	switch {
 	case len(fields) == 0:
 		return nil
-	case fields[0] == "END":
+	case strings.EqualFold(fields[0], "END"):
 		return h.assembleInline()
 	}
 
@@ -405,10 +539,57 @@ func (h *Host) processMiniAssembler(line string) error {
 	return nil
 }
 
+func (h *Host) processPaste(line string) error {
+	if strings.TrimSpace(line) == "" {
+		h.storePasted()
+		return nil
+	}
+
+	addr, b, err := parseHexLine(line)
+	if err != nil {
+		fmt.Fprintf(h, "%v. Line ignored.\n", err)
+		return nil
+	}
+	if addr == -1 {
+		addr = h.pasteAddr
+	}
+	if addr+len(b) > 64*1024 {
+		fmt.Fprintln(h, "Bytes go beyond 64K. Line ignored.")
+		return nil
+	}
+
+	if n := len(h.pasted); n > 0 && int(h.pasted[n-1].addr)+len(h.pasted[n-1].b) == addr {
+		h.pasted[n-1].b = append(h.pasted[n-1].b, b...)
+	} else if len(b) > 0 {
+		h.pasted = append(h.pasted, pasteBlock{uint16(addr), b})
+	}
+	h.pasteAddr = addr + len(b)
+	return nil
+}
+
+func (h *Host) storePasted() {
+	defer func() {
+		h.pasted = nil
+		h.setState(stateProcessingCommands)
+	}()
+
+	if len(h.pasted) == 0 {
+		fmt.Fprintln(h, "No bytes entered.")
+		return
+	}
+
+	for _, p := range h.pasted {
+		h.mem.StoreBytes(p.addr, p.b)
+		h.memoryChanged = true
+		fmt.Fprintf(h, "Stored %d bytes at $%04X..$%04X.\n", len(p.b), p.addr, int(p.addr)+len(p.b)-1)
+	}
+}
+
 func (h *Host) assembleInline() error {
 	defer func() {
 		h.assembly = nil
 		h.miniAddr = 0
+		h.miniText = false
 		h.setState(stateProcessingCommands)
 	}()
 
@@ -419,7 +600,7 @@ func (h *Host) assembleInline() error {
 
 	fmt.Fprintln(h, "Assembling inline code...")
 	s := strings.Join(h.assembly, "\n")
-	a, sm, err := asm.Assemble(strings.NewReader(s), "inline", h.miniAddr, h, 0)
+	a, sm, err := asm.Assemble(strings.NewReader(s), "inline", h.miniAddr, h, asm.IgnoreCase)
 
 	if err != nil {
 		for _, e := range a.Errors {
@@ -429,16 +610,24 @@ func (h *Host) assembleInline() error {
 		return nil
 	}
 
-	if int(h.miniAddr)+len(a.Code) > 64*1024 {
+	if int(sm.Origin)+len(a.Code) > 64*1024 {
 		fmt.Fprintln(h, "Assembly failed. Code goes beyond 64K.")
 		return nil
 	}
 
-	h.mem.StoreBytes(h.miniAddr, a.Code)
+	h.mem.StoreBytes(sm.Origin, a.Code)
+	h.markLoaded(sm.Origin, len(a.Code))
 	h.sourceMap.Merge(sm)
 
+	// Pasted source text may be long, so don't disassemble it.
+	if h.miniText {
+		fmt.Fprintf(h, "Assembled %d bytes to $%04X..$%04X.\n", len(a.Code),
+			sm.Origin, int(sm.Origin)+len(a.Code)-1)
+		return nil
+	}
+
 	for addr, end := int(h.miniAddr), int(h.miniAddr)+len(a.Code); addr < end; {
-		d, next := disasm.Disassemble(h.cpu, uint16(addr), disasm.ShowBasic, "", h.theme)
+		d, next, _ := h.disassembleLine(uint16(addr), disasm.ShowBasic, "")
 		fmt.Fprintln(h, d)
 		if next < uint16(addr) {
 			break
@@ -461,8 +650,14 @@ func (h *Host) Break() {
 
 	case stateMiniAssembler:
 		h.assembly = nil
+		h.miniText = false
 		h.setState(stateProcessingCommands)
 		fmt.Fprintln(h, "Interactive assembly canceled.")
+
+	case statePasting:
+		h.pasted = nil
+		h.setState(stateProcessingCommands)
+		fmt.Fprintln(h, "Memory paste canceled.")
 	}
 }
 
@@ -486,16 +681,100 @@ func (h *Host) readLine(interactive bool) (string, error) {
 }
 
 func (h *Host) displayPC() {
+	if h.settings.ShowSource {
+		h.displaySourceLine(h.cpu.Reg.PC)
+	}
 	d, _ := disasm.Disassemble(h.cpu, h.cpu.Reg.PC, disasm.ShowFull, "", h.theme)
 	fmt.Fprintln(h, d)
 }
 
+// Display the source code line that generated the instruction at the
+// requested address, if there is one.
+func (h *Host) displaySourceLine(addr uint16) {
+	fn, li, err := h.sourceMap.Find(int(addr))
+	if err != nil {
+		return
+	}
+
+	lines, err := h.getSourceLines(fn)
+	if err != nil || li < 1 || li > len(lines) {
+		return
+	}
+
+	fmt.Fprintf(h, "%s%s:%d%s\t%s%s%s\n",
+		h.theme.Annotation, filepath.Base(fn), li, h.theme.Reset,
+		h.theme.Source, lines[li-1], h.theme.Reset)
+}
+
+func (h *Host) cmdAlias(c *cmd.Command, args []string) error {
+	if len(args) == 0 {
+		if len(h.aliases) == 0 {
+			fmt.Fprintln(h, "No aliases defined.")
+			return nil
+		}
+
+		names := make([]string, 0, len(h.aliases))
+		for name := range h.aliases {
+			names = append(names, name)
+		}
+		sort.Strings(names)
+
+		fmt.Fprintln(h, "Aliases:")
+		for _, name := range names {
+			fmt.Fprintf(h, "   %-12s %s\n", name, h.aliases[name])
+		}
+		return nil
+	}
+
+	name := strings.ToLower(args[0])
+	if len(args) == 1 {
+		if _, ok := h.aliases[name]; !ok {
+			fmt.Fprintf(h, "No alias named '%s'.\n", name)
+			return nil
+		}
+		delete(h.aliases, name)
+		fmt.Fprintf(h, "Alias '%s' removed.\n", name)
+		return nil
+	}
+
+	h.aliases[name] = strings.Join(args[1:], " ")
+	fmt.Fprintf(h, "Alias '%s' added.\n", name)
+	return nil
+}
+
+// Return the annotation displayed when disassembling an address. If the
+// address has no annotation, the comment from the source code line that
+// generated it is used when source comments are enabled.
+func (h *Host) annotation(addr uint16) string {
+	if a, ok := h.annotations[addr]; ok {
+		return a
+	}
+	if h.settings.SourceComments {
+		if c, ok := h.sourceMap.FindComment(int(addr)); ok {
+			return c
+		}
+	}
+	return ""
+}
+
 func (h *Host) cmdAnnotate(c *cmd.Command, args []string) error {
 	if len(args) < 1 {
 		c.DisplayUsage(h)
 		return nil
 	}
 
+	if len(args) == 2 {
+		switch {
+		case strings.EqualFold(args[0], "load"):
+			return h.loadAnnotations(args[1])
+		case strings.EqualFold(args[0], "save"):
+			return h.saveAnnotations(args[1])
+		}
+	}
+	if len(args) == 4 && strings.EqualFold(args[0], "listing") {
+		return h.saveListing(args[1:])
+	}
+
 	addr, err := h.parseExpr(args[0])
 	if err != nil {
 		fmt.Fprintf(h, "%v\n", err)
@@ -518,30 +797,168 @@ func (h *Host) cmdAnnotate(c *cmd.Command, args []string) error {
 	return nil
 }
 
+// Load annotations from a text file, merging them with any annotations
+// already present.
+func (h *Host) loadAnnotations(filename string) error {
+	file, err := os.Open(filename)
+	if err != nil {
+		fmt.Fprintf(h, "%v\n", err)
+		return nil
+	}
+	defer file.Close()
+
+	n := 0
+	scanner := bufio.NewScanner(file)
+	for line := 1; scanner.Scan(); line++ {
+		text := strings.TrimSpace(scanner.Text())
+		if text == "" || text[0] == ';' {
+			continue
+		}
+
+		addrStr, annotation, _ := strings.Cut(text, " ")
+		addr, err := strconv.ParseUint(strings.TrimPrefix(addrStr, "$"), 16, 16)
+		annotation = strings.TrimSpace(annotation)
+		if err != nil || annotation == "" {
+			fmt.Fprintf(h, "%s:%d: invalid annotation.\n", filename, line)
+			return nil
+		}
+
+		h.annotations[uint16(addr)] = annotation
+		n++
+	}
+	if err := scanner.Err(); err != nil {
+		fmt.Fprintf(h, "%v\n", err)
+		return nil
+	}
+
+	fmt.Fprintf(h, "Loaded %d annotations from '%s'.\n", n, filename)
+	return nil
+}
+
+// Write an interleaved listing of the source code and disassembly of the
+// addresses from args[0] through args[1] to the file args[2].
+func (h *Host) saveListing(args []string) error {
+	start, err := h.parseAddr(args[0], 0)
+	if err != nil {
+		fmt.Fprintf(h, "%v\n", err)
+		return nil
+	}
+
+	end, err := h.parseAddr(args[1], 0)
+	if err != nil {
+		fmt.Fprintf(h, "%v\n", err)
+		return nil
+	}
+
+	if end < start {
+		fmt.Fprintln(h, "End address must be greater than start address.")
+		return nil
+	}
+
+	file, err := os.Create(args[2])
+	if err != nil {
+		fmt.Fprintf(h, "%v\n", err)
+		return nil
+	}
+	defer file.Close()
+
+	// Keep track of the last listed line number for each source file.
+	last := make(map[string]int)
+	lastFile := ""
+
+	w := bufio.NewWriter(file)
+	fmt.Fprintf(w, "; Listing of $%04X..$%04X\n", start, end)
+	flags := disasm.ShowBasic
+	for addr := int(start); addr <= int(end); {
+		// List the source lines leading up to the one that generated the
+		// code at this address.
+		if fn, li, err := h.sourceMap.Find(addr); err == nil {
+			if lines, err := h.getSourceLines(fn); err == nil && li > last[fn] {
+				if fn != lastFile {
+					fmt.Fprintf(w, "\n; %s\n", fn)
+					lastFile = fn
+				}
+				l, ok := last[fn]
+				if !ok {
+					l = li - 1
+				}
+				for i := l; i < min(li, len(lines)); i++ {
+					fmt.Fprintf(w, "; %5d  %s\n", i+1, lines[i])
+				}
+				last[fn] = li
+			}
+		}
+
+		var line string
+		var next uint16
+		if r, ok := h.sourceMap.FindData(addr); ok {
+			remain := min(int(r.Address)+int(r.Size), int(end)+1) - addr
+			line, next = disasm.DisassembleData(h.cpu, uint16(addr), remain, r.Unit, flags, h.annotation(uint16(addr)), &plainTheme)
+		} else {
+			line, next = disasm.Disassemble(h.cpu, uint16(addr), flags, h.annotation(uint16(addr)), &plainTheme)
+		}
+		fmt.Fprintln(w, strings.TrimRight(line, " "))
+		addr += int(next - uint16(addr))
+	}
+
+	if err := w.Flush(); err != nil {
+		fmt.Fprintf(h, "%v\n", err)
+		return nil
+	}
+
+	fmt.Fprintf(h, "Saved listing of $%04X..$%04X to '%s'.\n", start, end, args[2])
+	return nil
+}
+
+// Save all annotations to a text file, sorted by address.
+func (h *Host) saveAnnotations(filename string) error {
+	addrs := make([]uint16, 0, len(h.annotations))
+	for addr := range h.annotations {
+		addrs = append(addrs, addr)
+	}
+	sort.Slice(addrs, func(i, j int) bool { return addrs[i] < addrs[j] })
+
+	var sb strings.Builder
+	for _, addr := range addrs {
+		fmt.Fprintf(&sb, "%04X %s\n", addr, h.annotations[addr])
+	}
+
+	err := os.WriteFile(filename, []byte(sb.String()), 0644)
+	if err != nil {
+		fmt.Fprintf(h, "%v\n", err)
+		return nil
+	}
+
+	fmt.Fprintf(h, "Saved %d annotations to '%s'.\n", len(addrs), filename)
+	return nil
+}
+
 func (h *Host) cmdAssembleFile(c *cmd.Command, args []string) error {
 	if len(args) < 1 {
 		c.DisplayUsage(h)
 		return nil
 	}
 
-	path := args[0]
-	if filepath.Ext(path) == "" {
-		path += ".asm"
-	}
-
-	var options asm.Option
+	options := asm.MapSymbols | asm.MapComments
 	if len(args) > 1 {
-		verbose, err := stringToBool(args[1])
-		if err != nil {
-			c.DisplayUsage(h)
-			return nil
+		if verbose, err := stringToBool(args[len(args)-1]); err == nil {
+			if verbose {
+				options |= asm.Verbose
+			}
+			args = args[:len(args)-1]
 		}
-		if verbose {
-			options |= asm.Verbose
+	}
+
+	paths := make([]string, len(args))
+	for i, path := range args {
+		if filepath.Ext(path) == "" {
+			path += ".asm"
 		}
+		paths[i] = path
 	}
 
-	err := asm.AssembleFile(path, options, h)
+	includePaths := filepath.SplitList(h.settings.IncludePaths)
+	_, err := asm.AssembleFiles(paths, "", options, h, includePaths...)
 	if err != nil {
 		fmt.Fprintf(h, "Failed to assemble (%v).\n", err)
 	}
@@ -571,6 +988,29 @@ func (h *Host) cmdAssembleInteractive(c *cmd.Command, args []string) error {
 	return nil
 }
 
+func (h *Host) cmdAssembleText(c *cmd.Command, args []string) error {
+	if len(args) == 0 {
+		c.DisplayUsage(h)
+		return nil
+	}
+
+	addr, err := h.parseAddr(args[0], 0)
+	if err != nil {
+		fmt.Fprintf(h, "%v\n", err)
+		return nil
+	}
+
+	h.setState(stateMiniAssembler)
+	h.miniAddr = addr
+	h.miniText = true
+	h.assembly = nil
+	h.lastCmd = nil
+
+	fmt.Fprintln(h, "Enter or paste assembly language source code.")
+	fmt.Fprintln(h, "Type .END to assemble, Ctrl-C to cancel.")
+	return nil
+}
+
 func (h *Host) cmdAssembleMap(c *cmd.Command, args []string) error {
 	if len(args) < 2 {
 		c.DisplayUsage(h)
@@ -628,6 +1068,61 @@ func (h *Host) cmdAssembleMap(c *cmd.Command, args []string) error {
 	return nil
 }
 
+func (h *Host) cmdBCDAdc(c *cmd.Command, args []string) error {
+	return h.bcd(c, args, 0x69) // ADC #
+}
+
+func (h *Host) cmdBCDSbc(c *cmd.Command, args []string) error {
+	return h.bcd(c, args, 0xe9) // SBC #
+}
+
+// Compute the result of a decimal mode ADC or SBC instruction with
+// immediate addressing on both CPU architectures, and display the results.
+// Scratch CPUs are used, so the state of the host's CPU is unchanged.
+func (h *Host) bcd(c *cmd.Command, args []string, opcode byte) error {
+	if len(args) != 3 {
+		c.DisplayUsage(h)
+		return nil
+	}
+
+	var v [2]uint16
+	for i := range v {
+		var err error
+		v[i], err = h.parseExpr(args[i])
+		if err != nil {
+			fmt.Fprintf(h, "%v\n", err)
+			return nil
+		}
+	}
+	carry, err := stringToBool(args[2])
+	if err != nil {
+		fmt.Fprintf(h, "%v\n", err)
+		return nil
+	}
+
+	inst := h.cpu.InstSet.Lookup(opcode)
+	fmt.Fprintf(h, "%s #$%02X with A=$%02X, C=%d:\n", inst.Name, byte(v[1]), byte(v[0]), boolToInt(carry))
+	for _, arch := range []cpu.Architecture{cpu.NMOS, cpu.CMOS} {
+		sc := cpu.NewCPU(arch, cpu.NewFlatMemory())
+		sc.Mem.StoreBytes(0, []byte{opcode, byte(v[1])})
+		sc.Reg.A = byte(v[0])
+		sc.Reg.Carry = carry
+		sc.Reg.Decimal = true
+		sc.Step()
+
+		name := map[cpu.Architecture]string{cpu.NMOS: "6502", cpu.CMOS: "65C02"}[arch]
+		current := ""
+		if arch == h.cpu.Arch {
+			current = " (current)"
+		}
+		r := &sc.Reg
+		fmt.Fprintf(h, "   %-6s A=$%02X N=%d V=%d Z=%d C=%d Cycles=%d%s\n",
+			name, r.A, boolToInt(r.Sign), boolToInt(r.Overflow),
+			boolToInt(r.Zero), boolToInt(r.Carry), sc.Cycles, current)
+	}
+	return nil
+}
+
 func (h *Host) cmdBreakpointList(c *cmd.Command, args []string) error {
 	bp := h.debugger.GetBreakpoints()
 	if len(bp) == 0 {
@@ -642,9 +1137,20 @@ func (h *Host) cmdBreakpointList(c *cmd.Command, args []string) error {
 		return ""
 	}
 
+	action := func(b *cpu.Breakpoint) string {
+		switch {
+		case b.Command == "":
+			return ""
+		case b.Continue:
+			return fmt.Sprintf("continue: %s ", b.Command)
+		default:
+			return fmt.Sprintf("stop: %s ", b.Command)
+		}
+	}
+
 	fmt.Fprintln(h, "Breakpoints:")
 	for _, b := range bp {
-		fmt.Fprintf(h, "   $%04X %s\n", b.Address, disabled(b))
+		fmt.Fprintf(h, "   $%04X %s%s\n", b.Address, action(b), disabled(b))
 	}
 	return nil
 }
@@ -666,8 +1172,8 @@ func (h *Host) cmdBreakpointAdd(c *cmd.Command, args []string) error {
 	return nil
 }
 
-func (h *Host) cmdBreakpointRemove(c *cmd.Command, args []string) error {
-	if len(args) < 1 {
+func (h *Host) cmdBreakpointAction(c *cmd.Command, args []string) error {
+	if len(args) != 1 && len(args) < 3 {
 		c.DisplayUsage(h)
 		return nil
 	}
@@ -678,31 +1184,88 @@ func (h *Host) cmdBreakpointRemove(c *cmd.Command, args []string) error {
 		return nil
 	}
 
-	if h.debugger.GetBreakpoint(addr) == nil {
-		fmt.Fprintf(h, "No breakpoint was set on $%04X.\n", addr)
+	if len(args) == 1 {
+		b := h.debugger.GetBreakpoint(addr)
+		if b == nil {
+			fmt.Fprintf(h, "No breakpoint was set on $%04X.\n", addr)
+			return nil
+		}
+		b.Command, b.Continue = "", false
+		fmt.Fprintf(h, "Breakpoint action at $%04x removed.\n", addr)
 		return nil
 	}
 
-	h.debugger.RemoveBreakpoint(addr)
-	fmt.Fprintf(h, "Breakpoint at $%04x removed.\n", addr)
-	return nil
-}
-
-func (h *Host) cmdBreakpointEnable(c *cmd.Command, args []string) error {
-	if len(args) < 1 {
+	var cont bool
+	switch strings.ToLower(args[1]) {
+	case "stop":
+	case "continue":
+		cont = true
+	default:
 		c.DisplayUsage(h)
 		return nil
 	}
 
-	addr, err := h.parseExpr(args[0])
-	if err != nil {
-		fmt.Fprintf(h, "%v\n", err)
+	command := strings.Join(args[2:], " ")
+	if !h.isActionCommand(command) {
+		fmt.Fprintf(h, "Command '%s' can't be a breakpoint action.\n", command)
 		return nil
 	}
 
 	b := h.debugger.GetBreakpoint(addr)
 	if b == nil {
-		fmt.Fprintf(h, "No breakpoint was set on $%04X.\n", addr)
+		b = h.debugger.AddBreakpoint(addr)
+	}
+	b.Command, b.Continue = command, cont
+	fmt.Fprintf(h, "Breakpoint action added at $%04x.\n", addr)
+	return nil
+}
+
+func (h *Host) cmdBreakpointRemove(c *cmd.Command, args []string) error {
+	if len(args) < 1 {
+		c.DisplayUsage(h)
+		return nil
+	}
+
+	addr, err := h.parseExpr(args[0])
+	if err != nil {
+		fmt.Fprintf(h, "%v\n", err)
+		return nil
+	}
+
+	if h.debugger.GetBreakpoint(addr) == nil {
+		fmt.Fprintf(h, "No breakpoint was set on $%04X.\n", addr)
+		return nil
+	}
+
+	h.debugger.RemoveBreakpoint(addr)
+	fmt.Fprintf(h, "Breakpoint at $%04x removed.\n", addr)
+	return nil
+}
+
+func (h *Host) cmdBreakpointEnable(c *cmd.Command, args []string) error {
+	if len(args) < 1 {
+		c.DisplayUsage(h)
+		return nil
+	}
+
+	if strings.ToLower(args[0]) == "all" {
+		bp := h.debugger.GetBreakpoints()
+		for _, b := range bp {
+			b.Disabled = false
+		}
+		fmt.Fprintf(h, "%d breakpoint(s) enabled.\n", len(bp))
+		return nil
+	}
+
+	addr, err := h.parseExpr(args[0])
+	if err != nil {
+		fmt.Fprintf(h, "%v\n", err)
+		return nil
+	}
+
+	b := h.debugger.GetBreakpoint(addr)
+	if b == nil {
+		fmt.Fprintf(h, "No breakpoint was set on $%04X.\n", addr)
 		return nil
 	}
 
@@ -717,6 +1280,15 @@ func (h *Host) cmdBreakpointDisable(c *cmd.Command, args []string) error {
 		return nil
 	}
 
+	if strings.ToLower(args[0]) == "all" {
+		bp := h.debugger.GetBreakpoints()
+		for _, b := range bp {
+			b.Disabled = true
+		}
+		fmt.Fprintf(h, "%d breakpoint(s) disabled.\n", len(bp))
+		return nil
+	}
+
 	addr, err := h.parseExpr(args[0])
 	if err != nil {
 		fmt.Fprintf(h, "%v\n", err)
@@ -734,9 +1306,103 @@ func (h *Host) cmdBreakpointDisable(c *cmd.Command, args []string) error {
 	return nil
 }
 
+func (h *Host) cmdCallTraceStart(c *cmd.Command, args []string) error {
+	h.callTracing = true
+	h.calls, h.callsNext = nil, 0
+	fmt.Fprintln(h, "Call tracing started.")
+	return nil
+}
+
+func (h *Host) cmdCallTraceStop(c *cmd.Command, args []string) error {
+	h.callTracing = false
+	fmt.Fprintf(h, "Call tracing stopped. %d events recorded.\n", len(h.calls))
+	return nil
+}
+
+func (h *Host) cmdCallTraceClear(c *cmd.Command, args []string) error {
+	h.calls, h.callsNext = nil, 0
+	fmt.Fprintln(h, "Call trace cleared.")
+	return nil
+}
+
+func (h *Host) cmdCallTraceShow(c *cmd.Command, args []string) error {
+	events := h.callEvents()
+	if len(args) > 0 {
+		n, err := h.parseExpr(args[0])
+		if err != nil {
+			fmt.Fprintf(h, "%v\n", err)
+			return nil
+		}
+		if int(n) < len(events) {
+			events = events[len(events)-int(n):]
+		}
+	}
+
+	if len(events) == 0 {
+		fmt.Fprintln(h, "No calls recorded.")
+		return nil
+	}
+
+	// Tracing may begin or end inside a subroutine, so indent the tree
+	// relative to the shallowest depth reached.
+	depth, minDepth := 0, 0
+	for _, e := range events {
+		if e.call {
+			depth++
+		} else {
+			depth--
+			minDepth = min(minDepth, depth)
+		}
+	}
+
+	depth = -minDepth
+	for _, e := range events {
+		indent := strings.Repeat("  ", depth)
+		fmt.Fprintf(h, "%s%04X%s- %s%s %s$%04X%s%s\n",
+			h.theme.Addr, e.from, h.theme.Reset,
+			indent, e.name, h.theme.Addr, e.to, h.theme.Reset,
+			h.addrLabel(e.to))
+		if e.call {
+			depth++
+		} else {
+			depth--
+		}
+	}
+	return nil
+}
+
+// Return a label naming the address, formatted for display after the
+// address. An empty string is returned if the address has no label.
+func (h *Host) addrLabel(addr uint16) string {
+	for _, e := range h.sourceMap.Exports {
+		if e.Address == addr {
+			return " (" + e.Label + ")"
+		}
+	}
+	for _, e := range h.sourceMap.Symbols {
+		if e.Address == addr {
+			return " (" + e.Label + ")"
+		}
+	}
+	return ""
+}
+
+func (h *Host) cmdColdStart(c *cmd.Command, args []string) error {
+	h.cpu.Reg.Init()
+	h.cpu.Reg.SP = 0xfd
+	h.cpu.Cycles = 0
+	h.cpu.Reset()
+
+	fmt.Fprintf(h, "CPU cold started at $%04X.\n", h.cpu.Reg.PC)
+	h.settings.NextDisasmAddr = h.cpu.Reg.PC
+	h.displayPC()
+	return nil
+}
+
 func (h *Host) cmdDataBreakpointList(c *cmd.Command, args []string) error {
 	bp := h.debugger.GetDataBreakpoints()
-	if len(bp) == 0 {
+	stack := h.debugger.GetStackDataBreakpoint()
+	if len(bp) == 0 && stack == nil {
 		fmt.Fprintln(h, "No data breakpoints set.")
 		return nil
 	}
@@ -749,10 +1415,18 @@ func (h *Host) cmdDataBreakpointList(c *cmd.Command, args []string) error {
 	}
 
 	fmt.Fprintln(h, "Data breakpoints:")
-	for _, b := range h.debugger.GetDataBreakpoints() {
-		if b.Conditional {
+	if stack != nil {
+		fmt.Fprintf(h, "   stack %s\n", disabled(stack))
+	}
+	for _, b := range bp {
+		switch {
+		case b.LogOnly:
+			fmt.Fprintf(h, "   $%04X watch %s\n", b.Address, disabled(b))
+		case b.Conditional && b.Mask != 0 && b.Mask != 0xff:
+			fmt.Fprintf(h, "   $%04X on value & $%02X = $%02X %s\n", b.Address, b.Mask, b.Value, disabled(b))
+		case b.Conditional:
 			fmt.Fprintf(h, "   $%04X on value $%02X %s\n", b.Address, b.Value, disabled(b))
-		} else {
+		default:
 			fmt.Fprintf(h, "   $%04X %s\n", b.Address, disabled(b))
 		}
 	}
@@ -771,7 +1445,30 @@ func (h *Host) cmdDataBreakpointAdd(c *cmd.Command, args []string) error {
 		return nil
 	}
 
-	if len(args) > 1 {
+	switch {
+	case len(args) > 1 && strings.EqualFold(args[1], "mask"):
+		if len(args) != 4 {
+			c.DisplayUsage(h)
+			return nil
+		}
+		mask, err := h.parseExpr(args[2])
+		if err != nil {
+			fmt.Fprintf(h, "%v\n", err)
+			return nil
+		}
+		if byte(mask) == 0 {
+			fmt.Fprintln(h, "Mask must be non-zero.")
+			return nil
+		}
+		value, err := h.parseExpr(args[3])
+		if err != nil {
+			fmt.Fprintf(h, "%v\n", err)
+			return nil
+		}
+		b := h.debugger.AddMaskedDataBreakpoint(addr, byte(mask), byte(value))
+		fmt.Fprintf(h, "Conditional data breakpoint added at $%04x for value & $%02X = $%02X.\n", addr, b.Mask, b.Value)
+
+	case len(args) > 1:
 		value, err := h.parseExpr(args[1])
 		if err != nil {
 			fmt.Fprintf(h, "%v\n", err)
@@ -779,7 +1476,8 @@ func (h *Host) cmdDataBreakpointAdd(c *cmd.Command, args []string) error {
 		}
 		h.debugger.AddConditionalDataBreakpoint(addr, byte(value))
 		fmt.Fprintf(h, "Conditional data Breakpoint added at $%04x for value $%02X.\n", addr, value)
-	} else {
+
+	default:
 		h.debugger.AddDataBreakpoint(addr)
 		fmt.Fprintf(h, "Data breakpoint added at $%04x.\n", addr)
 	}
@@ -787,12 +1485,74 @@ func (h *Host) cmdDataBreakpointAdd(c *cmd.Command, args []string) error {
 	return nil
 }
 
+func (h *Host) cmdDataBreakpointStack(c *cmd.Command, args []string) error {
+	if len(args) != 0 {
+		c.DisplayUsage(h)
+		return nil
+	}
+
+	h.debugger.AddStackDataBreakpoint()
+	fmt.Fprintln(h, "Stack data breakpoint added.")
+	return nil
+}
+
+func (h *Host) cmdDataBreakpointWatch(c *cmd.Command, args []string) error {
+	if len(args) != 1 {
+		c.DisplayUsage(h)
+		return nil
+	}
+
+	addr, err := h.parseExpr(args[0])
+	if err != nil {
+		fmt.Fprintf(h, "%v\n", err)
+		return nil
+	}
+
+	h.debugger.AddLogDataBreakpoint(addr)
+	fmt.Fprintf(h, "Watching stores to $%04X.\n", addr)
+	return nil
+}
+
+func (h *Host) cmdDataBreakpointLog(c *cmd.Command, args []string) error {
+	switch {
+	case len(args) == 1 && strings.EqualFold(args[0], "clear"):
+		h.debugger.ClearStoreLog()
+		fmt.Fprintln(h, "Store log cleared.")
+		return nil
+	case len(args) > 0:
+		c.DisplayUsage(h)
+		return nil
+	}
+
+	log := h.debugger.GetStoreLog()
+	if len(log) == 0 {
+		fmt.Fprintln(h, "No stores logged.")
+		return nil
+	}
+
+	fmt.Fprintln(h, "Logged stores:")
+	for _, r := range log {
+		fmt.Fprintf(h, "   $%04X <- $%02X by $%04X (C=%d)\n", r.Address, r.Value, r.PC, r.Cycles)
+	}
+	return nil
+}
+
 func (h *Host) cmdDataBreakpointRemove(c *cmd.Command, args []string) error {
 	if len(args) < 1 {
 		c.DisplayUsage(h)
 		return nil
 	}
 
+	if strings.EqualFold(args[0], "stack") {
+		if h.debugger.GetStackDataBreakpoint() == nil {
+			fmt.Fprintln(h, "No stack data breakpoint was set.")
+			return nil
+		}
+		h.debugger.RemoveStackDataBreakpoint()
+		fmt.Fprintln(h, "Stack data breakpoint removed.")
+		return nil
+	}
+
 	addr, err := h.parseExpr(args[0])
 	if err != nil {
 		fmt.Fprintf(h, "%v\n", err)
@@ -815,6 +1575,29 @@ func (h *Host) cmdDataBreakpointEnable(c *cmd.Command, args []string) error {
 		return nil
 	}
 
+	if strings.ToLower(args[0]) == "all" {
+		bp := h.debugger.GetDataBreakpoints()
+		if b := h.debugger.GetStackDataBreakpoint(); b != nil {
+			bp = append(bp, b)
+		}
+		for _, b := range bp {
+			b.Disabled = false
+		}
+		fmt.Fprintf(h, "%d data breakpoint(s) enabled.\n", len(bp))
+		return nil
+	}
+
+	if strings.EqualFold(args[0], "stack") {
+		b := h.debugger.GetStackDataBreakpoint()
+		if b == nil {
+			fmt.Fprintln(h, "No stack data breakpoint was set.")
+			return nil
+		}
+		b.Disabled = false
+		fmt.Fprintln(h, "Stack data breakpoint enabled.")
+		return nil
+	}
+
 	addr, err := h.parseExpr(args[0])
 	if err != nil {
 		fmt.Fprintf(h, "%v\n", err)
@@ -838,6 +1621,29 @@ func (h *Host) cmdDataBreakpointDisable(c *cmd.Command, args []string) error {
 		return nil
 	}
 
+	if strings.ToLower(args[0]) == "all" {
+		bp := h.debugger.GetDataBreakpoints()
+		if b := h.debugger.GetStackDataBreakpoint(); b != nil {
+			bp = append(bp, b)
+		}
+		for _, b := range bp {
+			b.Disabled = true
+		}
+		fmt.Fprintf(h, "%d data breakpoint(s) disabled.\n", len(bp))
+		return nil
+	}
+
+	if strings.EqualFold(args[0], "stack") {
+		b := h.debugger.GetStackDataBreakpoint()
+		if b == nil {
+			fmt.Fprintln(h, "No stack data breakpoint was set.")
+			return nil
+		}
+		b.Disabled = true
+		fmt.Fprintln(h, "Stack data breakpoint disabled.")
+		return nil
+	}
+
 	addr, err := h.parseExpr(args[0])
 	if err != nil {
 		fmt.Fprintf(h, "%v\n", err)
@@ -856,6 +1662,16 @@ func (h *Host) cmdDataBreakpointDisable(c *cmd.Command, args []string) error {
 }
 
 func (h *Host) cmdDisassemble(c *cmd.Command, args []string) error {
+	if len(args) > 0 && strings.EqualFold(args[0], "routine") {
+		return h.disassembleRoutine(c, args[1:])
+	}
+	if len(args) > 0 && strings.EqualFold(args[0], "source") {
+		return h.disassembleSource(c, args[1:])
+	}
+	if len(args) > 0 && strings.EqualFold(args[0], "labels") {
+		return h.disassembleLabels(c, args[1:])
+	}
+
 	if len(args) == 0 {
 		args = []string{"$"}
 	}
@@ -876,8 +1692,9 @@ func (h *Host) cmdDisassemble(c *cmd.Command, args []string) error {
 		count = int(l)
 	}
 
+	flags := h.disasmFlags()
 	for i := 0; i < count; i++ {
-		d, next := disasm.Disassemble(h.cpu, addr, disasm.ShowBasic, h.annotations[addr], h.theme)
+		d, next, _ := h.disassembleLine(addr, flags, h.annotation(addr))
 		fmt.Fprintln(h, d)
 		addr = next
 	}
@@ -887,88 +1704,790 @@ func (h *Host) cmdDisassemble(c *cmd.Command, args []string) error {
 	return nil
 }
 
-func (h *Host) cmdExports(c *cmd.Command, args []string) error {
-	if len(h.sourceMap.Exports) == 0 {
-		fmt.Fprintln(h, "No active exports.")
-		return nil
-	}
-
-	fmt.Fprintln(h, "Exported addresses:")
-	for _, e := range h.sourceMap.Exports {
-		fmt.Fprintf(h, "   %-16s $%04X\n", e.Label, e.Address)
-	}
-	return nil
-}
-
-func (h *Host) cmdEvaluate(c *cmd.Command, args []string) error {
-	if len(args) < 1 {
-		c.DisplayUsage(h)
-		return nil
-	}
-
-	expr := strings.Join(args, " ")
-	v, err := h.parseExpr(expr)
-	if err != nil {
-		fmt.Fprintf(h, "%v\n", err)
-		return nil
-	}
-
-	fmt.Fprintf(h, "$%04X\n", v)
-	return nil
-}
-
-func (h *Host) cmdExecute(c *cmd.Command, args []string) error {
-	if len(args) < 1 {
-		c.DisplayUsage(h)
-		return nil
+// Disassemble a single routine, stopping after the first instruction that
+// unconditionally leaves it (RTS, RTI or JMP).
+func (h *Host) disassembleRoutine(c *cmd.Command, args []string) error {
+	if len(args) == 0 {
+		args = []string{"$"}
 	}
 
-	file, err := os.Open(args[0])
+	addr, err := h.parseAddr(args[0], h.settings.NextDisasmAddr)
 	if err != nil {
 		fmt.Fprintf(h, "%v\n", err)
 		return nil
 	}
-	defer file.Close()
-
-	ioState := h.EnableProcessedMode(file, os.Stdout)
-	h.RunCommands(false)
-	h.RestoreIoState(ioState)
-
-	return nil
-}
 
-func (h *Host) cmdHelp(c *cmd.Command, args []string) error {
-	if len(args) == 0 {
-		cmds.DisplayHelp(h)
-		return nil
+	limit := maxRoutineLines
+	if len(args) > 1 {
+		l, err := h.parseExpr(args[1])
+		if err != nil {
+			fmt.Fprintf(h, "%v\n", err)
+			return nil
+		}
+		limit = int(l)
 	}
 
-	n, _, err := cmds.Lookup(strings.Join(args, " "))
-	if err != nil {
-		fmt.Fprintf(h, "%v.\n\n", err)
-		return nil
+	flags := h.disasmFlags()
+	for i := 0; i < limit; i++ {
+		inst := h.cpu.GetInstruction(addr)
+		d, next, data := h.disassembleLine(addr, flags, h.annotation(addr))
+		fmt.Fprintln(h, d)
+		addr = next
+		if data {
+			continue
+		}
+		if inst.Name == "RTS" || inst.Name == "RTI" || inst.Name == "JMP" {
+			break
+		}
 	}
 
-	n.DisplayHelp(h)
+	h.settings.NextDisasmAddr = addr
+	h.lastArgs = []string{"routine", "$"}
 	return nil
 }
 
-func (h *Host) cmdList(c *cmd.Command, args []string) error {
+// Disassemble lines of code, displaying generated labels for the targets
+// of branches, jumps and subroutine calls.
+func (h *Host) disassembleLabels(c *cmd.Command, args []string) error {
 	if len(args) == 0 {
 		args = []string{"$"}
 	}
 
-	// Parse the address.
-	addr, err := h.parseAddr(args[0], h.settings.NextSourceAddr)
+	addr, err := h.parseAddr(args[0], h.settings.NextDisasmAddr)
 	if err != nil {
 		fmt.Fprintf(h, "%v\n", err)
 		return nil
 	}
 
-	// Parse the number of lines to display.
-	count := h.settings.SourceLines
+	count := h.settings.DisasmLines
 	if len(args) > 1 {
-		v, err := h.parseExpr(strings.Join(args[1:], " "))
+		l, err := h.parseExpr(args[1])
+		if err != nil {
+			fmt.Fprintf(h, "%v\n", err)
+			return nil
+		}
+		count = int(l)
+	}
+
+	// Find the address of each line to be displayed.
+	starts := make(map[uint16]bool)
+	end := addr
+	for a, i := addr, 0; i < count; i++ {
+		starts[a] = true
+		_, next, _ := h.disassembleLine(a, 0, "")
+		if next <= a {
+			end = 0xffff
+			break
+		}
+		a, end = next, next-1
+	}
+
+	// Label the targets of branches, jumps and subroutine calls the way
+	// disassembled source code does, keeping only the labels that are
+	// placed on a displayed line.
+	labels := disasm.TargetLabels(h.cpu, addr, end, h.sourceOptions())
+	for a := range labels {
+		if !starts[a] {
+			delete(labels, a)
+		}
+	}
+
+	flags := h.disasmFlags()
+	for i := 0; i < count; i++ {
+		if name, ok := labels[addr]; ok {
+			fmt.Fprintf(h, "%s%s:%s\n", h.theme.Operand, name, h.theme.Reset)
+		}
+
+		d, next, data := h.disassembleLine(addr, flags, h.annotation(addr))
+		if !data {
+			d, _ = disasm.DisassembleLabels(h.cpu, addr, flags, h.annotation(addr), labels, h.theme)
+		}
+		fmt.Fprintln(h, d)
+		addr = next
+	}
+
+	h.settings.NextDisasmAddr = addr
+	h.lastArgs = []string{"labels", "$", strconv.Itoa(count)}
+	return nil
+}
+
+// Write the disassembly of a range of memory to a file as source code that
+// reassembles to the same bytes. Exported labels and data ranges from the
+// loaded source maps are used to produce the source.
+func (h *Host) disassembleSource(c *cmd.Command, args []string) error {
+	if len(args) != 3 {
+		c.DisplayUsage(h)
+		return nil
+	}
+
+	start, err := h.parseAddr(args[0], 0)
+	if err != nil {
+		fmt.Fprintf(h, "%v\n", err)
+		return nil
+	}
+
+	end, err := h.parseAddr(args[1], 0)
+	if err != nil {
+		fmt.Fprintf(h, "%v\n", err)
+		return nil
+	}
+
+	if end < start {
+		fmt.Fprintln(h, "End address must be greater than start address.")
+		return nil
+	}
+
+	file, err := os.Create(args[2])
+	if err != nil {
+		fmt.Fprintf(h, "%v\n", err)
+		return nil
+	}
+	defer file.Close()
+
+	err = disasm.FprintSource(file, h.cpu, start, end, h.sourceOptions())
+	if err != nil {
+		fmt.Fprintf(h, "%v\n", err)
+		return nil
+	}
+
+	fmt.Fprintf(h, "Saved source for $%04X..$%04X to '%s'.\n", start, end, args[2])
+	h.lastCmd = nil
+	return nil
+}
+
+// Return the options used to disassemble source code, which describe the
+// exported labels and data ranges of the loaded source maps.
+func (h *Host) sourceOptions() *disasm.SourceOptions {
+	opts := &disasm.SourceOptions{
+		Labels: make(map[uint16]string),
+		Data: func(addr uint16) (remain, unit int) {
+			if r, ok := h.sourceMap.FindData(int(addr)); ok {
+				return int(r.Address) + int(r.Size) - int(addr), r.Unit
+			}
+			return 0, 0
+		},
+	}
+	for _, e := range h.sourceMap.Exports {
+		opts.Labels[e.Address] = e.Label
+	}
+	return opts
+}
+
+// Disassemble a single line of a code listing. If the loaded source map
+// marks the address as data, the line is displayed as a data pseudo-op
+// instead of an instruction.
+func (h *Host) disassembleLine(addr uint16, flags disasm.Flags, anno string) (line string, next uint16, data bool) {
+	if r, ok := h.sourceMap.FindData(int(addr)); ok {
+		remain := int(r.Address) + int(r.Size) - int(addr)
+		line, next = disasm.DisassembleData(h.cpu, addr, remain, r.Unit, flags, anno, h.theme)
+		return line, next, true
+	}
+	line, next = disasm.Disassemble(h.cpu, addr, flags, anno, h.theme)
+	return line, next, false
+}
+
+// Return the disassembler flags used to display code listings.
+func (h *Host) disasmFlags() disasm.Flags {
+	flags := disasm.ShowBasic
+	if h.settings.DisasmTiming {
+		flags |= disasm.ShowTiming
+	}
+	if !h.settings.DisasmCode {
+		flags &^= disasm.ShowCode
+	}
+	return flags
+}
+
+func (h *Host) cmdExports(c *cmd.Command, args []string) error {
+	if len(h.sourceMap.Exports) == 0 {
+		fmt.Fprintln(h, "No active exports.")
+		return nil
+	}
+
+	fmt.Fprintln(h, "Exported addresses:")
+	for _, e := range h.sourceMap.Exports {
+		fmt.Fprintf(h, "   %-16s $%04X\n", e.Label, e.Address)
+	}
+	return nil
+}
+
+func (h *Host) cmdSymbols(c *cmd.Command, args []string) error {
+	if len(args) > 0 && strings.EqualFold(args[0], "save") {
+		return h.saveSymbols(c, args[1:])
+	}
+	if len(args) > 1 {
+		c.DisplayUsage(h)
+		return nil
+	}
+
+	var filter string
+	if len(args) > 0 {
+		filter = strings.ToLower(args[0])
+	}
+
+	count := 0
+	for _, e := range h.sourceMap.Symbols {
+		if !strings.Contains(strings.ToLower(e.Label), filter) {
+			continue
+		}
+		if count == 0 {
+			fmt.Fprintln(h, "Symbols:")
+		}
+		fmt.Fprintf(h, "   %-16s $%04X\n", e.Label, e.Address)
+		count++
+	}
+
+	if count == 0 {
+		fmt.Fprintln(h, "No matching symbols.")
+	}
+	return nil
+}
+
+// Save the loaded symbols to a file in a format read by another debugger.
+func (h *Host) saveSymbols(c *cmd.Command, args []string) error {
+	if len(args) < 1 || len(args) > 2 {
+		c.DisplayUsage(h)
+		return nil
+	}
+
+	write := h.sourceMap.WriteSymbolsVICE
+	if len(args) > 1 {
+		switch strings.ToLower(args[1]) {
+		case "vice":
+		case "nocash":
+			write = h.sourceMap.WriteSymbolsNoCash
+		default:
+			fmt.Fprintf(h, "Unknown symbol file format '%s'.\n", args[1])
+			return nil
+		}
+	}
+
+	if len(h.sourceMap.Symbols) == 0 && len(h.sourceMap.Exports) == 0 {
+		fmt.Fprintln(h, "No symbols to save.")
+		return nil
+	}
+
+	file, err := os.Create(args[0])
+	if err != nil {
+		fmt.Fprintf(h, "%v\n", err)
+		return nil
+	}
+	defer file.Close()
+
+	_, err = write(file)
+	if err != nil {
+		fmt.Fprintf(h, "%v\n", err)
+		return nil
+	}
+
+	fmt.Fprintf(h, "Saved symbols to '%s'.\n", args[0])
+	return nil
+}
+
+func (h *Host) cmdEvaluate(c *cmd.Command, args []string) error {
+	if len(args) < 1 {
+		c.DisplayUsage(h)
+		return nil
+	}
+
+	expr := strings.Join(args, " ")
+	v, err := h.parseExpr(expr)
+	if err != nil {
+		fmt.Fprintf(h, "%v\n", err)
+		return nil
+	}
+
+	// Show the value's unsigned, signed and binary interpretations. Values
+	// that fit in a byte are interpreted as signed bytes, all others as
+	// signed words. The interpretation in the display base comes first.
+	var forms []string
+	if v < 0x100 {
+		forms = []string{
+			fmt.Sprintf("$%04X", v),
+			fmt.Sprintf("%d", v),
+			fmt.Sprintf("%d (signed byte)", int8(v)),
+			fmt.Sprintf("%%%08b", v),
+		}
+	} else {
+		forms = []string{
+			fmt.Sprintf("$%04X", v),
+			fmt.Sprintf("%d", v),
+			fmt.Sprintf("%d (signed word)", int16(v)),
+			fmt.Sprintf("%%%016b", v),
+		}
+	}
+	switch h.settings.Base {
+	case 10:
+		forms[0], forms[1] = forms[1], forms[0]
+	case 2:
+		forms = append(forms[3:], forms[:3]...)
+	}
+	fmt.Fprintln(h, strings.Join(forms, " = "))
+	return nil
+}
+
+func (h *Host) cmdExamine(c *cmd.Command, args []string) error {
+	if len(args) > 1 {
+		c.DisplayUsage(h)
+		return nil
+	}
+
+	addr := h.cpu.Reg.PC
+	if len(args) > 0 {
+		var err error
+		addr, err = h.parseExpr(args[0])
+		if err != nil {
+			fmt.Fprintf(h, "%v\n", err)
+			return nil
+		}
+	}
+
+	flags := disasm.ShowAddress | disasm.ShowCode | disasm.ShowInstruction
+	d, _ := disasm.Disassemble(h.cpu, addr, flags, "", h.theme)
+
+	inst := h.cpu.GetInstruction(addr)
+	var desc []string
+	switch inst.Mode {
+	case cpu.ACC:
+		desc = append(desc, fmt.Sprintf("A=$%02X", h.cpu.Reg.A))
+	case cpu.ZPX, cpu.ABX, cpu.IDX:
+		desc = append(desc, fmt.Sprintf("X=$%02X", h.cpu.Reg.X))
+	case cpu.ZPY, cpu.ABY, cpu.IDY:
+		desc = append(desc, fmt.Sprintf("Y=$%02X", h.cpu.Reg.Y))
+	}
+
+	var buf [2]byte
+	operand := buf[:inst.Length-1]
+	h.cpu.PeekBytes(addr+1, operand)
+	ea, ok := h.cpu.EffectiveAddress(inst, operand)
+	if inst.Mode == cpu.REL {
+		ea, ok = addr+uint16(inst.Length)+uint16(int8(operand[0])), true
+	}
+
+	// Jumps and branches don't access the data at their targets.
+	if ok {
+		switch {
+		case inst.Mode == cpu.REL || inst.Name == "JMP" || inst.Name == "JSR":
+			desc = append(desc, fmt.Sprintf("-> $%04X", ea))
+		default:
+			desc = append(desc, fmt.Sprintf("-> $%04X = $%02X", ea, h.cpu.PeekByte(ea)))
+		}
+	}
+
+	if len(desc) > 0 {
+		d += fmt.Sprintf(" ; %s%s%s", h.theme.Annotation, strings.Join(desc, " "), h.theme.Reset)
+	}
+	fmt.Fprintln(h, d)
+	return nil
+}
+
+func (h *Host) cmdExecute(c *cmd.Command, args []string) error {
+	if len(args) < 1 {
+		c.DisplayUsage(h)
+		return nil
+	}
+
+	file, err := os.Open(args[0])
+	if err != nil {
+		fmt.Fprintf(h, "%v\n", err)
+		return nil
+	}
+	defer file.Close()
+
+	ioState := h.EnableProcessedMode(file, os.Stdout)
+	h.RunCommands(false)
+	h.RestoreIoState(ioState)
+
+	return nil
+}
+
+func (h *Host) cmdHelp(c *cmd.Command, args []string) error {
+	if len(args) == 0 {
+		cmds.DisplayHelp(h)
+		return nil
+	}
+
+	n, _, err := cmds.Lookup(strings.Join(args, " "))
+	if err != nil {
+		fmt.Fprintf(h, "%v.\n\n", err)
+		return nil
+	}
+
+	n.DisplayHelp(h)
+	return nil
+}
+
+func (h *Host) cmdFile(c *cmd.Command, args []string) error {
+	if len(args) > 1 {
+		c.DisplayUsage(h)
+		return nil
+	}
+
+	if len(args) == 0 {
+		if len(h.sourceMap.Files) == 0 {
+			fmt.Fprintln(h, "No source files loaded.")
+			return nil
+		}
+		fmt.Fprintln(h, "Source files:")
+		for _, f := range h.sourceMap.Files {
+			current := ""
+			if f == h.settings.SourceFile {
+				current = "(current)"
+			}
+			fmt.Fprintf(h, "   %s %s\n", f, current)
+		}
+		return nil
+	}
+
+	filename, err := h.findSourceFile(args[0])
+	if err != nil {
+		fmt.Fprintf(h, "%v\n", err)
+		return nil
+	}
+
+	h.settings.SourceFile = filename
+	fmt.Fprintf(h, "Current source file is '%s'.\n", filename)
+	return nil
+}
+
+func (h *Host) cmdFinish(c *cmd.Command, args []string) error {
+	// Run until the stack pointer is at least the target value.
+	target := int(h.cpu.Reg.SP) + 1
+	if len(args) > 0 {
+		v, err := h.parseExpr(args[0])
+		if err != nil {
+			fmt.Fprintf(h, "%v\n", err)
+			return nil
+		}
+		if v > 0xff {
+			fmt.Fprintf(h, "Invalid stack pointer value $%X.\n", v)
+			return nil
+		}
+		target = int(v)
+	}
+	if target > 0xff {
+		fmt.Fprintln(h, "The stack is empty.")
+		return nil
+	}
+	if int(h.cpu.Reg.SP) >= target {
+		fmt.Fprintf(h, "Stack pointer is already $%02X.\n", h.cpu.Reg.SP)
+		return nil
+	}
+
+	// Stop after a maximum number of instructions when ctrl-C can't be
+	// used to break.
+	limit := h.settings.RunLimit
+	if limit <= 0 && !h.rawMode {
+		limit = defaultRunLimit
+	}
+
+	h.setState(stateRunning)
+	for step := 0; h.state == stateRunning; step++ {
+		if limit > 0 && step >= limit {
+			fmt.Fprintf(h, "Run limit of %d instructions reached.\n", limit)
+			break
+		}
+		h.step()
+		if int(h.cpu.Reg.SP) >= target {
+			fmt.Fprintf(h, "Stack pointer reached $%02X at $%04X.\n",
+				h.cpu.Reg.SP, h.cpu.LastPC)
+			break
+		}
+		h.breakCheck(step)
+	}
+
+	if h.state != stateBreakpoint {
+		h.displayPC()
+	}
+
+	h.setState(stateProcessingCommands)
+	h.settings.NextDisasmAddr = h.cpu.Reg.PC
+	return nil
+}
+
+func (h *Host) cmdHistogram(c *cmd.Command, args []string) error {
+	var start, end uint16
+	switch len(args) {
+	case 0:
+		if h.loadedCode == nil {
+			fmt.Fprintln(h, "No binary file has been loaded.")
+			return nil
+		}
+		start = h.loadedOrigin
+		end = uint16(int(h.loadedOrigin) + len(h.loadedCode) - 1)
+
+	case 2:
+		var err error
+		start, err = h.parseAddr(args[0], 0)
+		if err != nil {
+			fmt.Fprintf(h, "%v\n", err)
+			return nil
+		}
+		end, err = h.parseAddr(args[1], 0)
+		if err != nil {
+			fmt.Fprintf(h, "%v\n", err)
+			return nil
+		}
+		if end < start {
+			fmt.Fprintln(h, "End address must be greater than start address.")
+			return nil
+		}
+
+	default:
+		c.DisplayUsage(h)
+		return nil
+	}
+
+	// Tally the instructions in the range, skipping data regions and
+	// invalid opcodes.
+	names := make(map[string]int)
+	modes := make(map[cpu.Mode]int)
+	total, invalid := 0, 0
+	for addr := int(start); addr <= int(end); {
+		if r, ok := h.sourceMap.FindData(addr); ok {
+			addr = int(r.Address) + int(r.Size)
+			continue
+		}
+		inst := h.cpu.GetInstruction(uint16(addr))
+		if inst.Name == "???" || addr+int(inst.Length) > int(end)+1 {
+			invalid++
+			addr++
+			continue
+		}
+		names[inst.Name]++
+		modes[inst.Mode]++
+		total++
+		addr += int(inst.Length)
+	}
+
+	if total == 0 {
+		fmt.Fprintf(h, "No instructions found at $%04X..$%04X.\n", start, end)
+		return nil
+	}
+
+	fmt.Fprintf(h, "%d instructions at $%04X..$%04X", total, start, end)
+	if invalid > 0 {
+		fmt.Fprintf(h, " (%d invalid bytes skipped)", invalid)
+	}
+	fmt.Fprintln(h, ".")
+
+	keys := make([]string, 0, len(names))
+	for k := range names {
+		keys = append(keys, k)
+	}
+	sort.Slice(keys, func(i, j int) bool {
+		if names[keys[i]] != names[keys[j]] {
+			return names[keys[i]] > names[keys[j]]
+		}
+		return keys[i] < keys[j]
+	})
+	fmt.Fprintln(h, "Instructions:")
+	for _, k := range keys {
+		fmt.Fprintf(h, "    %-12s %6d %5.1f%%\n", k, names[k], 100*float64(names[k])/float64(total))
+	}
+
+	ms := make([]cpu.Mode, 0, len(modes))
+	for m := range modes {
+		ms = append(ms, m)
+	}
+	sort.Slice(ms, func(i, j int) bool {
+		if modes[ms[i]] != modes[ms[j]] {
+			return modes[ms[i]] > modes[ms[j]]
+		}
+		return ms[i] < ms[j]
+	})
+	fmt.Fprintln(h, "Addressing modes:")
+	for _, m := range ms {
+		fmt.Fprintf(h, "    %-12s %6d %5.1f%%\n", m, modes[m], 100*float64(modes[m])/float64(total))
+	}
+
+	h.lastCmd = nil
+	return nil
+}
+
+func (h *Host) cmdCodeFind(c *cmd.Command, args []string) error {
+	if len(args) == 0 {
+		c.DisplayUsage(h)
+		return nil
+	}
+
+	if h.loadedCode == nil {
+		fmt.Fprintln(h, "No binary file has been loaded.")
+		return nil
+	}
+
+	pattern := make([]string, len(args))
+	for i, a := range args {
+		if a != "*" && len(h.cpu.InstSet.GetInstructions(a)) == 0 {
+			fmt.Fprintf(h, "Unknown instruction '%s'.\n", a)
+			return nil
+		}
+		pattern[i] = strings.ToUpper(a)
+	}
+
+	// Disassemble the loaded binary into a sequence of instruction
+	// addresses. Data regions and invalid opcodes break the sequence.
+	type run []uint16
+	var runs []run
+	var cur run
+	start, end := int(h.loadedOrigin), int(h.loadedOrigin)+len(h.loadedCode)
+	for addr := start; addr < end; {
+		if r, ok := h.sourceMap.FindData(addr); ok {
+			runs, cur = append(runs, cur), nil
+			addr = int(r.Address) + int(r.Size)
+			continue
+		}
+		inst := h.cpu.GetInstruction(uint16(addr))
+		if inst.Name == "???" || addr+int(inst.Length) > end {
+			runs, cur = append(runs, cur), nil
+			addr++
+			continue
+		}
+		cur = append(cur, uint16(addr))
+		addr += int(inst.Length)
+	}
+	runs = append(runs, cur)
+
+	matches := 0
+	flags := h.disasmFlags()
+	for _, r := range runs {
+	search:
+		for i := 0; i+len(pattern) <= len(r); i++ {
+			for j, name := range pattern {
+				if name != "*" && h.cpu.GetInstruction(r[i+j]).Name != name {
+					continue search
+				}
+			}
+			if matches > 0 {
+				fmt.Fprintln(h)
+			}
+			for _, addr := range r[i : i+len(pattern)] {
+				d, _, _ := h.disassembleLine(addr, flags, h.annotation(addr))
+				fmt.Fprintln(h, d)
+			}
+			matches++
+		}
+	}
+
+	switch matches {
+	case 0:
+		fmt.Fprintln(h, "No matches found.")
+	case 1:
+		fmt.Fprintln(h, "1 match found.")
+	default:
+		fmt.Fprintf(h, "%d matches found.\n", matches)
+	}
+
+	h.lastCmd = nil
+	return nil
+}
+
+func (h *Host) cmdHistory(c *cmd.Command, args []string) error {
+	if len(args) > 0 && strings.EqualFold(args[0], "clear") {
+		h.debugger.ClearHistory()
+		fmt.Fprintln(h, "History cleared.")
+		return nil
+	}
+
+	history := h.debugger.GetHistory()
+	if len(args) > 0 {
+		n, err := h.parseExpr(args[0])
+		if err != nil {
+			fmt.Fprintf(h, "%v\n", err)
+			return nil
+		}
+		if int(n) < len(history) {
+			history = history[len(history)-int(n):]
+		}
+	}
+
+	if len(history) == 0 {
+		fmt.Fprintln(h, "No instructions executed.")
+		return nil
+	}
+
+	flags := disasm.ShowAddress | disasm.ShowCode | disasm.ShowInstruction
+	for _, r := range history {
+		if r.Interrupt {
+			fmt.Fprintf(h, "%s%04X%s- %-25s%s%s",
+				h.theme.Addr, r.PC, h.theme.Reset, "<interrupt>",
+				disasm.GetRegisterString(&r.Reg, h.theme), h.cyclesString(r.Cycles))
+		} else {
+			d, _ := disasm.Disassemble(h.cpu, r.PC, flags, "", h.theme)
+			fmt.Fprintf(h, "%s%s%s", d,
+				disasm.GetRegisterString(&r.Reg, h.theme), h.cyclesString(r.Cycles))
+		}
+		fmt.Fprintln(h)
+	}
+
+	h.lastCmd = nil
+	return nil
+}
+
+// Return a string describing a CPU cycle count in the same form as the
+// disassembler.
+func (h *Host) cyclesString(cycles uint64) string {
+	return fmt.Sprintf("%sC%s=%s%d%s", h.theme.RegName, h.theme.RegEqual,
+		h.theme.RegValue, cycles, h.theme.Reset)
+}
+
+func (h *Host) cmdInterruptIRQ(c *cmd.Command, args []string) error {
+	h.cpu.IRQ()
+	if h.cpu.InterruptDue() {
+		fmt.Fprintln(h, "IRQ requested.")
+	} else {
+		fmt.Fprintln(h, "IRQ requested. It stays pending while interrupts are disabled.")
+	}
+	return nil
+}
+
+func (h *Host) cmdInterruptNMI(c *cmd.Command, args []string) error {
+	h.cpu.NMI()
+	fmt.Fprintln(h, "NMI requested.")
+	return nil
+}
+
+func (h *Host) cmdThemeLoad(c *cmd.Command, args []string) error {
+	if len(args) != 1 {
+		c.DisplayUsage(h)
+		return nil
+	}
+
+	t, err := loadTheme(args[0], h.colorTheme)
+	if err != nil {
+		fmt.Fprintf(h, "%v\n", err)
+		return nil
+	}
+
+	h.colorTheme = t
+	h.applyTheme()
+	fmt.Fprintf(h, "Loaded theme from '%s'.\n", args[0])
+	return nil
+}
+
+func (h *Host) cmdThemeReset(c *cmd.Command, args []string) error {
+	h.colorTheme = defaultTheme
+	h.applyTheme()
+	fmt.Fprintln(h, "Theme reset to the default.")
+	return nil
+}
+
+func (h *Host) cmdList(c *cmd.Command, args []string) error {
+	if len(args) == 0 {
+		args = []string{"$"}
+	}
+
+	// Parse the address.
+	addr, err := h.parseAddr(args[0], h.settings.NextSourceAddr)
+	if err != nil {
+		fmt.Fprintf(h, "%v\n", err)
+		return nil
+	}
+
+	// Parse the number of lines to display.
+	count := h.settings.SourceLines
+	if len(args) > 1 {
+		v, err := h.parseExpr(strings.Join(args[1:], " "))
 		if err != nil {
 			fmt.Fprintf(h, "%v\n", err)
 			return nil
@@ -997,12 +2516,9 @@ func (h *Host) cmdList(c *cmd.Command, args []string) error {
 
 		addr = h.cpu.NextAddr(orig)
 		cn := addr - orig
-		h.cpu.Mem.LoadBytes(orig, buf[:cn])
+		h.cpu.PeekBytes(orig, buf[:cn])
 		cs := codeString(buf[:cn])
-		fmt.Fprintf(h, "%s%04X%s- %s%-8s%s\t%s%s%s\n",
-			h.theme.Addr, orig, h.theme.Reset,
-			h.theme.Code, cs, h.theme.Reset,
-			h.theme.Source, lines[li-1], h.theme.Source)
+		h.displayListLine(orig, cs, lines[li-1])
 
 		last[fn] = li
 		break
@@ -1037,7 +2553,7 @@ func (h *Host) cmdList(c *cmd.Command, args []string) error {
 
 		addr = h.cpu.NextAddr(orig)
 		cn := addr - orig
-		h.cpu.Mem.LoadBytes(orig, buf[:cn])
+		h.cpu.PeekBytes(orig, buf[:cn])
 		cs := codeString(buf[:cn])
 
 		l, ok := last[fn]
@@ -1050,10 +2566,7 @@ func (h *Host) cmdList(c *cmd.Command, args []string) error {
 			if i == j-1 {
 				c = cs
 			}
-			fmt.Fprintf(h, "%s%04X%s- %s%-8s%s\t%s%s%s\n",
-				h.theme.Addr, orig, h.theme.Reset,
-				h.theme.Code, c, h.theme.Reset,
-				h.theme.Source, lines[i], h.theme.Reset)
+			h.displayListLine(orig, c, lines[i])
 		}
 
 		last[fn] = li
@@ -1064,12 +2577,31 @@ func (h *Host) cmdList(c *cmd.Command, args []string) error {
 	return nil
 }
 
+// Display a line of a source listing, consisting of an address, the code
+// bytes generated by the line, and the line's source text. The layout is
+// controlled by the ListWidth and ListTabs settings.
+func (h *Host) displayListLine(addr uint16, code, source string) {
+	sep := "\t"
+	if h.settings.ListTabs > 0 {
+		source = expandTabs(source, h.settings.ListTabs)
+		sep = " "
+	}
+	fmt.Fprintf(h, "%s%04X%s- %s%-*s%s%s%s%s%s\n",
+		h.theme.Addr, addr, h.theme.Reset,
+		h.theme.Code, h.settings.ListWidth, code, h.theme.Reset,
+		sep, h.theme.Source, source, h.theme.Reset)
+}
+
 func (h *Host) cmdLoad(c *cmd.Command, args []string) error {
 	if len(args) < 1 {
 		c.DisplayUsage(h)
 		return nil
 	}
 
+	if strings.EqualFold(args[0], "raw") {
+		return h.loadRaw(c, args[1:])
+	}
+
 	filename := args[0]
 
 	loadAddr := -1
@@ -1082,8 +2614,138 @@ func (h *Host) cmdLoad(c *cmd.Command, args []string) error {
 		loadAddr = int(addr)
 	}
 
-	_, err := h.load(filename, loadAddr)
-	return err
+	h.load(filename, loadAddr)
+	return nil
+}
+
+// Load a file's contents into memory without looking for a source map.
+// The loaded source maps and the binary used by commands like verify are
+// left unchanged.
+func (h *Host) loadRaw(c *cmd.Command, args []string) error {
+	if len(args) != 2 {
+		c.DisplayUsage(h)
+		return nil
+	}
+
+	addr, err := h.parseExpr(args[1])
+	if err != nil {
+		fmt.Fprintf(h, "%v\n", err)
+		return nil
+	}
+
+	b, err := os.ReadFile(args[0])
+	if err != nil {
+		fmt.Fprintf(h, "%v\n", err)
+		return nil
+	}
+	if int(addr)+len(b) > 0x10000 {
+		fmt.Fprintf(h, "File '%s' doesn't fit in memory at $%04X.\n", filepath.Base(args[0]), addr)
+		return nil
+	}
+
+	h.cpu.Mem.StoreBytes(addr, b)
+	h.markLoaded(addr, len(b))
+	fmt.Fprintf(h, "Loaded '%s' to $%04X..$%04X.\n", filepath.Base(args[0]), addr, int(addr)+len(b)-1)
+	return nil
+}
+
+func (h *Host) cmdLoadRun(c *cmd.Command, args []string) error {
+	if len(args) < 1 {
+		c.DisplayUsage(h)
+		return nil
+	}
+
+	loadAddr := -1
+	if len(args) >= 2 {
+		addr, err := h.parseExpr(args[1])
+		if err != nil {
+			fmt.Fprintf(h, "%v\n", err)
+			return nil
+		}
+		loadAddr = int(addr)
+	}
+
+	origin, ok := h.load(args[0], loadAddr)
+	if !ok {
+		return nil
+	}
+
+	h.cpu.SetPC(origin)
+	return h.cmdRun(c, nil)
+}
+
+// Interrupt vector addresses.
+const (
+	vectorNMI   = 0xfffa
+	vectorReset = 0xfffc
+	vectorIRQ   = 0xfffe
+)
+
+func (h *Host) cmdVectorList(c *cmd.Command, args []string) error {
+	fmt.Fprintln(h, "Vectors:")
+	fmt.Fprintf(h, "   NMI   $%04X\n", h.cpu.PeekAddress(vectorNMI))
+	fmt.Fprintf(h, "   RESET $%04X\n", h.cpu.PeekAddress(vectorReset))
+	fmt.Fprintf(h, "   IRQ   $%04X\n", h.cpu.PeekAddress(vectorIRQ))
+	return nil
+}
+
+func (h *Host) cmdVectorNMI(c *cmd.Command, args []string) error {
+	return h.setVector(c, args, "NMI", vectorNMI)
+}
+
+func (h *Host) cmdVectorReset(c *cmd.Command, args []string) error {
+	return h.setVector(c, args, "Reset", vectorReset)
+}
+
+func (h *Host) cmdVectorIRQ(c *cmd.Command, args []string) error {
+	return h.setVector(c, args, "IRQ", vectorIRQ)
+}
+
+func (h *Host) setVector(c *cmd.Command, args []string, name string, vector uint16) error {
+	if len(args) < 1 {
+		c.DisplayUsage(h)
+		return nil
+	}
+
+	addr, err := h.parseExpr(args[0])
+	if err != nil {
+		fmt.Fprintf(h, "%v\n", err)
+		return nil
+	}
+
+	h.cpu.Mem.StoreBytes(vector, []byte{byte(addr), byte(addr >> 8)})
+	h.memoryChanged = true
+	fmt.Fprintf(h, "%s vector at $%04X set to $%04X.\n", name, vector, addr)
+	return nil
+}
+
+func (h *Host) cmdVerify(c *cmd.Command, args []string) error {
+	if h.loadedCode == nil {
+		fmt.Fprintln(h, "No binary file has been loaded.")
+		return nil
+	}
+
+	count := 0
+	b := make([]byte, len(h.loadedCode))
+	h.cpu.PeekBytes(h.loadedOrigin, b)
+	for i, v := range h.loadedCode {
+		if b[i] == v {
+			continue
+		}
+		if count == 0 {
+			fmt.Fprintln(h, "Changed addresses:")
+		}
+		fmt.Fprintf(h, "   $%04X: $%02X -> $%02X\n", int(h.loadedOrigin)+i, v, b[i])
+		count++
+	}
+
+	end := int(h.loadedOrigin) + len(h.loadedCode) - 1
+	if count == 0 {
+		fmt.Fprintf(h, "Memory at $%04X..$%04X matches the loaded binary.\n", h.loadedOrigin, end)
+	} else {
+		fmt.Fprintf(h, "%d byte(s) changed at $%04X..$%04X.\n", count, h.loadedOrigin, end)
+	}
+	return nil
 }
 
 func (h *Host) cmdMemoryDump(c *cmd.Command, args []string) error {
@@ -1118,64 +2780,357 @@ func (h *Host) cmdMemoryDump(c *cmd.Command, args []string) error {
 	return nil
 }
 
-func (h *Host) cmdMemorySet(c *cmd.Command, args []string) error {
-	if len(args) < 2 {
-		c.DisplayUsage(h)
-		return nil
+func (h *Host) cmdMemorySet(c *cmd.Command, args []string) error {
+	if len(args) < 2 {
+		c.DisplayUsage(h)
+		return nil
+	}
+
+	addr, err := h.parseAddr(args[0], h.settings.NextMemDumpAddr)
+	if err != nil {
+		fmt.Fprintf(h, "%v\n", err)
+		return nil
+	}
+
+	var b []byte
+	for _, arg := range args[1:] {
+		if len(arg) > 0 && arg[0] == '"' {
+			s, err := stringBytes(arg)
+			if err != nil {
+				fmt.Fprintf(h, "%v\n", err)
+				return nil
+			}
+			b = append(b, s...)
+			continue
+		}
+		for _, e := range strings.Split(arg, ",") {
+			if e == "" {
+				continue
+			}
+			v, err := h.parseExpr(e)
+			if err != nil {
+				fmt.Fprintf(h, "%v\n", err)
+				return nil
+			}
+			b = append(b, byte(v))
+		}
+	}
+
+	for _, v := range b {
+		h.mem.StoreByte(addr, v)
+		addr++
+	}
+	h.memoryChanged = true
+	return nil
+}
+
+func (h *Host) cmdMemoryPaste(c *cmd.Command, args []string) error {
+	if len(args) == 0 {
+		c.DisplayUsage(h)
+		return nil
+	}
+
+	addr, err := h.parseAddr(args[0], h.settings.NextMemDumpAddr)
+	if err != nil {
+		fmt.Fprintf(h, "%v\n", err)
+		return nil
+	}
+
+	h.setState(statePasting)
+	h.pasteAddr = int(addr)
+	h.pasted = nil
+	h.lastCmd = nil
+
+	fmt.Fprintln(h, "Enter or paste lines of hex bytes.")
+	fmt.Fprintln(h, "Enter a blank line to store them, Ctrl-C to cancel.")
+	return nil
+}
+
+func (h *Host) cmdMemoryCopy(c *cmd.Command, args []string) error {
+	if len(args) < 3 {
+		c.DisplayUsage(h)
+		return nil
+	}
+
+	dst, err := h.parseAddr(args[0], 0)
+	if err != nil {
+		fmt.Fprintf(h, "%v\n", err)
+		return nil
+	}
+
+	src0, err := h.parseAddr(args[1], 0)
+	if err != nil {
+		fmt.Fprintf(h, "%v\n", err)
+		return nil
+	}
+
+	src1, err := h.parseAddr(args[2], 0)
+	if err != nil {
+		fmt.Fprintf(h, "%v\n", err)
+		return nil
+	}
+
+	if src1 < src0 {
+		fmt.Fprintln(h, "Source-end address must be greater than source-begin address.")
+		return nil
+	}
+
+	b := make([]byte, src1-src0+1)
+	h.cpu.Mem.LoadBytes(src0, b)
+	h.cpu.Mem.StoreBytes(dst, b)
+	h.memoryChanged = true
+	fmt.Fprintf(h, "%d bytes copied from $%04X to $%04X.\n", len(b), src0, dst)
+	return nil
+}
+
+func (h *Host) cmdMapDiff(c *cmd.Command, args []string) error {
+	if len(args) != 2 {
+		c.DisplayUsage(h)
+		return nil
+	}
+
+	var maps [2]*asm.SourceMap
+	for i, filename := range args {
+		sm, err := readSourceMap(filename)
+		if err != nil {
+			fmt.Fprintf(h, "%v\n", err)
+			return nil
+		}
+		maps[i] = sm
+	}
+	m1, m2 := maps[0], maps[1]
+
+	diffs := 0
+	if m1.Origin != m2.Origin || m1.Size != m2.Size {
+		fmt.Fprintf(h, "Code range changed from $%04X..$%04X to $%04X..$%04X.\n",
+			m1.Origin, int(m1.Origin)+int(m1.Size)-1,
+			m2.Origin, int(m2.Origin)+int(m2.Size)-1)
+		diffs++
+	}
+
+	// Compare source files by name.
+	files1, files2 := make(map[string]bool), make(map[string]bool)
+	for _, f := range m1.Files {
+		files1[f] = true
+	}
+	for _, f := range m2.Files {
+		files2[f] = true
+	}
+	for _, f := range m1.Files {
+		if !files2[f] {
+			fmt.Fprintf(h, "File removed: %s\n", f)
+			diffs++
+		}
+	}
+	for _, f := range m2.Files {
+		if !files1[f] {
+			fmt.Fprintf(h, "File added: %s\n", f)
+			diffs++
+		}
+	}
+
+	diffs += h.diffLabels("Exports", m1.Exports, m2.Exports)
+	if len(m1.Symbols) > 0 && len(m2.Symbols) > 0 {
+		diffs += h.diffLabels("Symbols", m1.Symbols, m2.Symbols)
+	}
+	diffs += h.diffLines(m1, m2)
+
+	if diffs == 0 {
+		fmt.Fprintln(h, "No differences found.")
+	}
+	return nil
+}
+
+// Display the labels that were added, removed or moved between two lists
+// of exports. Return the number of differences displayed.
+func (h *Host) diffLabels(title string, e1, e2 []asm.Export) int {
+	addr1, addr2 := make(map[string]uint16), make(map[string]uint16)
+	for _, e := range e1 {
+		addr1[e.Label] = e.Address
+	}
+	for _, e := range e2 {
+		addr2[e.Label] = e.Address
+	}
+
+	var lines []string
+	for _, e := range e1 {
+		a2, ok := addr2[e.Label]
+		switch {
+		case !ok:
+			lines = append(lines, fmt.Sprintf("   %-16s $%04X removed", e.Label, e.Address))
+		case a2 != e.Address:
+			lines = append(lines, fmt.Sprintf("   %-16s $%04X -> $%04X", e.Label, e.Address, a2))
+		}
+	}
+	for _, e := range e2 {
+		if _, ok := addr1[e.Label]; !ok {
+			lines = append(lines, fmt.Sprintf("   %-16s $%04X added", e.Label, e.Address))
+		}
+	}
+
+	if len(lines) > 0 {
+		fmt.Fprintf(h, "%s:\n", title)
+		for _, l := range lines {
+			fmt.Fprintln(h, l)
+		}
+	}
+	return len(lines)
+}
+
+// Display the ranges of source lines whose addresses differ between two
+// source maps. Consecutive lines that moved by the same amount are grouped
+// into a single range. Return the number of ranges displayed.
+func (h *Host) diffLines(m1, m2 *asm.SourceMap) int {
+	type fileLine struct {
+		file string
+		line int
+	}
+	addrs := make(map[fileLine]int)
+	for _, l := range m2.Lines {
+		k := fileLine{m2.Files[l.FileIndex], l.Line}
+		if _, ok := addrs[k]; !ok {
+			addrs[k] = l.Address
+		}
+	}
+
+	type shift struct {
+		file       string
+		start, end int // first and last source lines
+		addr       int // address of the first line in the first map
+		delta      int // address change
+	}
+	var shifts []shift
+	seen := make(map[fileLine]bool)
+	for _, l := range m1.Lines {
+		k := fileLine{m1.Files[l.FileIndex], l.Line}
+		if seen[k] {
+			continue
+		}
+		seen[k] = true
+		a2, ok := addrs[k]
+		if !ok || a2 == l.Address {
+			continue
+		}
+		delta := a2 - l.Address
+		if n := len(shifts); n > 0 {
+			last := &shifts[n-1]
+			if last.file == k.file && last.delta == delta && l.Line > last.end {
+				last.end = l.Line
+				continue
+			}
+		}
+		shifts = append(shifts, shift{k.file, l.Line, l.Line, l.Address, delta})
+	}
+
+	if len(shifts) > 0 {
+		fmt.Fprintln(h, "Lines:")
+		for _, s := range shifts {
+			lines := fmt.Sprintf("%s:%d", filepath.Base(s.file), s.start)
+			if s.end != s.start {
+				lines += fmt.Sprintf("-%d", s.end)
+			}
+			fmt.Fprintf(h, "   %-24s $%04X moved %+d\n", lines, s.addr, s.delta)
+		}
+	}
+	return len(shifts)
+}
+
+// Read a source map from a file.
+func readSourceMap(filename string) (*asm.SourceMap, error) {
+	file, err := os.Open(filename)
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+
+	sm := asm.NewSourceMap()
+	if _, err := sm.ReadFrom(file); err != nil {
+		return nil, fmt.Errorf("failed to read source map '%s': %v", filepath.Base(filename), err)
+	}
+	return sm, nil
+}
+
+func (h *Host) cmdMemoryMap(c *cmd.Command, args []string) error {
+	var pages [256]byte
+	for i := range pages {
+		pages[i] = '.'
 	}
 
-	addr, err := h.parseAddr(args[0], h.settings.NextMemDumpAddr)
-	if err != nil {
-		fmt.Fprintf(h, "%v\n", err)
-		return nil
+	// Mark the loaded pages covering the addresses from start (inclusive)
+	// to end (exclusive). Unloaded pages are skipped, because a source map
+	// also maps the address following its code.
+	mark := func(start, end int, ch byte) {
+		for p := start >> 8; p <= (end-1)>>8 && p < len(pages); p++ {
+			if h.loadedPages[p] {
+				pages[p] = ch
+			}
+		}
 	}
 
-	for i := 1; i < len(args); i++ {
-		v, err := h.parseExpr(args[i])
-		if err != nil {
-			fmt.Fprintf(h, "%v\n", err)
-			return nil
+	// Later marks take priority over earlier ones.
+	pages[0x00] = 'Z'
+	pages[h.cpu.StackPage] = 'S'
+	pages[0xff] = 'V'
+	mark(0, 0x10000, 'L')
+	for _, r := range h.sourceMap.Data {
+		mark(int(r.Address), int(r.Address)+int(r.Size), 'D')
+	}
+	for _, l := range h.sourceMap.Lines {
+		mark(l.Address, l.Address+1, 'C')
+	}
+	for a := 0; a < 0x10000; a++ {
+		if h.mem.IsMapped(uint16(a)) {
+			pages[a>>8] = 'I'
 		}
-		h.mem.StoreByte(addr, byte(v))
-		addr++
 	}
 
+	fmt.Fprintln(h, "      0123456789ABCDEF")
+	for row := 0; row < 16; row++ {
+		fmt.Fprintf(h, "%s%04X%s- %s\n", h.theme.Addr, row<<12, h.theme.Reset, pages[row*16:row*16+16])
+	}
+	fmt.Fprintln(h, "C=code D=data L=loaded I=device Z=zero page S=stack V=vectors .=empty")
 	return nil
 }
 
-func (h *Host) cmdMemoryCopy(c *cmd.Command, args []string) error {
-	if len(args) < 3 {
-		c.DisplayUsage(h)
+// Record the pages of memory populated by loaded code, for use by the
+// memory map.
+func (h *Host) markLoaded(origin uint16, n int) {
+	for a := int(origin); a < int(origin)+n && a < 0x10000; a += 0x100 - a&0xff {
+		h.loadedPages[a>>8] = true
+	}
+}
+
+func (h *Host) cmdMemoryUnmap(c *cmd.Command, args []string) error {
+	if len(args) == 1 && strings.ToLower(args[0]) == "clear" {
+		h.mem.ClearUnmapped()
+		fmt.Fprintln(h, "All unmapped address ranges cleared.")
 		return nil
 	}
 
-	dst, err := h.parseAddr(args[0], 0)
-	if err != nil {
-		fmt.Fprintf(h, "%v\n", err)
+	if len(args) < 2 {
+		c.DisplayUsage(h)
 		return nil
 	}
 
-	src0, err := h.parseAddr(args[1], 0)
+	addr0, err := h.parseAddr(args[0], 0)
 	if err != nil {
 		fmt.Fprintf(h, "%v\n", err)
 		return nil
 	}
 
-	src1, err := h.parseAddr(args[2], 0)
+	addr1, err := h.parseAddr(args[1], 0)
 	if err != nil {
 		fmt.Fprintf(h, "%v\n", err)
 		return nil
 	}
 
-	if src1 < src0 {
-		fmt.Fprintln(h, "Source-end address must be greater than source-begin address.")
+	if addr1 < addr0 {
+		fmt.Fprintln(h, "End address must be greater than begin address.")
 		return nil
 	}
 
-	b := make([]byte, src1-src0+1)
-	h.cpu.Mem.LoadBytes(src0, b)
-	h.cpu.Mem.StoreBytes(dst, b)
-	fmt.Fprintf(h, "%d bytes copied from $%04X to $%04X.\n", len(b), src0, dst)
+	h.mem.SetUnmapped(addr0, addr1)
+	fmt.Fprintf(h, "Addresses $%04X..$%04X flagged as unmapped.\n", addr0, addr1)
 	return nil
 }
 
@@ -1185,7 +3140,7 @@ func (h *Host) cmdQuit(c *cmd.Command, args []string) error {
 
 func (h *Host) cmdRegister(c *cmd.Command, args []string) error {
 	if len(args) == 0 {
-		fmt.Fprintf(h, disasm.GetRegisterString(&h.cpu.Reg, h.theme)+
+		fmt.Fprintf(h, disasm.GetRegisterStringBase(&h.cpu.Reg, h.settings.Base, h.theme)+
 			disasm.GetCyclesString(h.cpu, h.theme)+"\n")
 		return nil
 	}
@@ -1197,23 +3152,7 @@ func (h *Host) cmdRegister(c *cmd.Command, args []string) error {
 
 	key, value := strings.ToUpper(args[0]), strings.Join(args[1:], " ")
 
-	var flag *bool
-	var flagName string
-	switch {
-	case key == "N" || key == "SIGN":
-		flag, flagName = &h.cpu.Reg.Sign, "SIGN"
-	case key == "Z" || key == "ZERO":
-		flag, flagName = &h.cpu.Reg.Zero, "ZERO"
-	case key == "C" || key == "CARRY":
-		flag, flagName = &h.cpu.Reg.Carry, "CARRY"
-	case key == "I" || key == "INTERRUPT_DISABLE":
-		flag, flagName = &h.cpu.Reg.InterruptDisable, "INTERRUPT_DISABLE"
-	case key == "D" || key == "DECIMAL":
-		flag, flagName = &h.cpu.Reg.Decimal, "DECIMAL"
-	case key == "V" || key == "OVERFLOW":
-		flag, flagName = &h.cpu.Reg.Overflow, "OVERFLOW"
-	}
-
+	flag, flagName := h.statusFlag(key)
 	if flag != nil {
 		v, err := stringToBool(value)
 		if err != nil {
@@ -1253,20 +3192,42 @@ func (h *Host) cmdRegister(c *cmd.Command, args []string) error {
 
 		switch sz {
 		case 1:
-			fmt.Fprintf(h, "Register %s set to $%02X.\n", strings.ToUpper(key), byte(v))
+			fmt.Fprintf(h, "Register %s set to %s.\n", strings.ToUpper(key), h.formatByte(byte(v)))
 		case 2:
-			fmt.Fprintf(h, "Register %s set to $%04X.\n", strings.ToUpper(key), uint16(v))
+			fmt.Fprintf(h, "Register %s set to %s.\n", strings.ToUpper(key), h.formatWord(uint16(v)))
 		}
 	}
 
 	if h.rawMode {
-		fmt.Fprintf(h, disasm.GetRegisterString(&h.cpu.Reg, h.theme)+
+		fmt.Fprintf(h, disasm.GetRegisterStringBase(&h.cpu.Reg, h.settings.Base, h.theme)+
 			disasm.GetCyclesString(h.cpu, h.theme)+"\n")
 	}
 
 	return nil
 }
 
+// Return a pointer to the CPU status flag with the requested name, along
+// with the flag's full name. Flags may be named by their single-letter
+// abbreviation. If the name is not a status flag, nil is returned.
+func (h *Host) statusFlag(name string) (flag *bool, flagName string) {
+	switch strings.ToUpper(name) {
+	case "N", "SIGN":
+		return &h.cpu.Reg.Sign, "SIGN"
+	case "Z", "ZERO":
+		return &h.cpu.Reg.Zero, "ZERO"
+	case "C", "CARRY":
+		return &h.cpu.Reg.Carry, "CARRY"
+	case "I", "INTERRUPT_DISABLE":
+		return &h.cpu.Reg.InterruptDisable, "INTERRUPT_DISABLE"
+	case "D", "DECIMAL":
+		return &h.cpu.Reg.Decimal, "DECIMAL"
+	case "V", "OVERFLOW":
+		return &h.cpu.Reg.Overflow, "OVERFLOW"
+	default:
+		return nil, ""
+	}
+}
+
 func (h *Host) cmdRun(c *cmd.Command, args []string) error {
 	if len(args) > 0 {
 		pc, err := h.parseExpr(args[0])
@@ -1277,10 +3238,32 @@ func (h *Host) cmdRun(c *cmd.Command, args []string) error {
 		h.cpu.SetPC(pc)
 	}
 
-	fmt.Fprintf(h, "Running from $%04X. Press ctrl-C to break.\n", h.cpu.Reg.PC)
+	// When commands are being processed from a script, ctrl-C can't be used
+	// to break, so stop after a maximum number of instructions instead.
+	limit := h.settings.RunLimit
+	if limit <= 0 && !h.rawMode {
+		limit = defaultRunLimit
+	}
+
+	if h.rawMode {
+		fmt.Fprintf(h, "Running from $%04X. Press ctrl-C to break.\n", h.cpu.Reg.PC)
+	} else {
+		fmt.Fprintf(h, "Running from $%04X.\n", h.cpu.Reg.PC)
+	}
+
+	// Route console keystrokes to the keyboard device while running.
+	if h.rawMode && h.settings.KeyboardAddr != 0 {
+		h.keyboard.capturing.Store(true)
+		defer h.keyboard.capturing.Store(false)
+	}
 
 	h.state = stateRunning
 	for step := 0; h.state == stateRunning; step++ {
+		if limit > 0 && step >= limit {
+			fmt.Fprintf(h, "Run limit of %d instructions reached.\n", limit)
+			h.state = stateInterrupted
+			break
+		}
 		h.step()
 		h.breakCheck(step)
 	}
@@ -1352,6 +3335,12 @@ func (h *Host) cmdSet(c *cmd.Command, args []string) error {
 
 		if err == nil {
 			fmt.Fprintln(h, "Setting updated.")
+
+			// Assigning the seed restarts the random number sequence, even
+			// when the seed is unchanged.
+			if h.settings.Name(key) == "RngSeed" {
+				h.rng.reseed(h.settings.RngSeed)
+			}
 		} else {
 			fmt.Fprintf(h, "%v\n", err)
 		}
@@ -1362,6 +3351,17 @@ func (h *Host) cmdSet(c *cmd.Command, args []string) error {
 	return nil
 }
 
+func (h *Host) cmdStatus(c *cmd.Command, args []string) error {
+	ps := h.cpu.Reg.SavePS(false)
+	fmt.Fprintf(h, "             NV-BDIZC\n")
+	fmt.Fprintf(h, "P       $%02X  %08b\n", ps, ps)
+	ps = h.cpu.Reg.SavePS(true)
+	fmt.Fprintf(h, "PHP/BRK $%02X  %08b\n", ps, ps)
+	ps = h.cpu.Reg.SavePS(false)
+	fmt.Fprintf(h, "IRQ/NMI $%02X  %08b\n", ps, ps)
+	return nil
+}
+
 func (h *Host) cmdStepIn(c *cmd.Command, args []string) error {
 	// Parse the number of steps.
 	count := 1
@@ -1377,11 +3377,15 @@ func (h *Host) cmdStepIn(c *cmd.Command, args []string) error {
 	} else {
 		h.setState(stateRunning)
 		for i := count - 1; i >= 0 && h.state == stateRunning; i-- {
+			interrupt := h.dueInterrupt()
 			h.step()
 			switch {
 			case i == h.settings.MaxStepLines:
 				fmt.Fprintln(h, "...")
 			case i < h.settings.MaxStepLines:
+				if interrupt != "" {
+					fmt.Fprintf(h, "%s serviced, entering handler at $%04X.\n", interrupt, h.cpu.Reg.PC)
+				}
 				h.displayPC()
 			}
 		}
@@ -1441,11 +3445,59 @@ func (h *Host) cmdStepOut(c *cmd.Command, args []string) error {
 	return nil
 }
 
-func (h *Host) load(binFilename string, addr int) (origin uint16, err error) {
+func (h *Host) cmdStepUntil(c *cmd.Command, args []string) error {
+	if len(args) != 2 || !strings.EqualFold(args[0], "flag") {
+		c.DisplayUsage(h)
+		return nil
+	}
+
+	flag, flagName := h.statusFlag(args[1])
+	if flag == nil {
+		fmt.Fprintf(h, "Unknown status flag '%s'.\n", args[1])
+		return nil
+	}
+
+	// Stop after a maximum number of instructions when ctrl-C can't be
+	// used to break.
+	limit := h.settings.RunLimit
+	if limit <= 0 && !h.rawMode {
+		limit = defaultRunLimit
+	}
+
+	h.setState(stateRunning)
+	initial := *flag
+	for step := 0; h.state == stateRunning; step++ {
+		if limit > 0 && step >= limit {
+			fmt.Fprintf(h, "Run limit of %d instructions reached.\n", limit)
+			break
+		}
+		h.step()
+		if *flag != initial {
+			fmt.Fprintf(h, "Status flag %s changed from %v to %v at $%04X.\n",
+				flagName, initial, *flag, h.cpu.LastPC)
+			break
+		}
+		h.breakCheck(step)
+	}
+
+	if h.state != stateBreakpoint {
+		h.displayPC()
+	}
+
+	h.setState(stateProcessingCommands)
+	h.settings.NextDisasmAddr = h.cpu.Reg.PC
+	return nil
+}
+
+// Load a binary file and its source map into memory. If addr is -1, the
+// binary is loaded at the origin stored in its source map. Return the
+// address at which the binary was loaded and true if successful.
+func (h *Host) load(binFilename string, addr int) (origin uint16, ok bool) {
+	var err error
 	binFilename, err = filepath.Abs(binFilename)
 	if err != nil {
 		fmt.Fprintf(h, "%v\n", err)
-		return 0, nil
+		return 0, false
 	}
 
 	ext := filepath.Ext(binFilename)
@@ -1458,7 +3510,7 @@ func (h *Host) load(binFilename string, addr int) (origin uint16, err error) {
 		}
 		if err != nil {
 			fmt.Fprintf(h, "%v\n", err)
-			return 0, nil
+			return 0, false
 		}
 	}
 	defer binFile.Close()
@@ -1467,7 +3519,7 @@ func (h *Host) load(binFilename string, addr int) (origin uint16, err error) {
 	_, err = a.ReadFrom(binFile)
 	if err != nil {
 		fmt.Fprintf(h, "%v\n", err)
-		return 0, nil
+		return 0, false
 	}
 
 	// Try loading a source map file if it exists.
@@ -1507,45 +3559,126 @@ func (h *Host) load(binFilename string, addr int) (origin uint16, err error) {
 	}
 	if !originSet {
 		fmt.Fprintf(h, "File '%s' has no source map and requires an origin address.\n", filepath.Base(binFilename))
-		return 0, nil
+		return 0, false
 	}
 
 	// Copy the code to the CPU memory and adjust the program counter.
 	h.cpu.Mem.StoreBytes(origin, a.Code)
 	fmt.Fprintf(h, "Loaded '%s' to $%04X..$%04X.\n", filepath.Base(binFilename), origin, int(origin)+len(a.Code)-1)
 
+	// Retain the loaded code so it can be verified later.
+	h.loadedCode = a.Code
+	h.loadedOrigin = origin
+	h.markLoaded(origin, len(a.Code))
+
 	h.settings.NextDisasmAddr = origin
-	return origin, nil
+	return origin, true
 }
 
 func (h *Host) step() {
-	h.cpu.Step()
+	if !h.callTracing {
+		h.cpu.Step()
+		return
+	}
+
+	cpu := h.cpu
+	pc := cpu.Reg.PC
+	inst := cpu.GetInstruction(pc)
+	irq, nmi := cpu.PendingIRQ(), cpu.PendingNMI()
+	cpu.Step()
+
+	// A pending interrupt serviced by the step takes the place of the
+	// instruction.
+	switch {
+	case nmi && !cpu.PendingNMI():
+		h.recordCall(callEvent{"NMI", pc, cpu.Reg.PC, true})
+	case irq && !cpu.PendingIRQ():
+		h.recordCall(callEvent{"IRQ", pc, cpu.Reg.PC, true})
+	case inst.Name == "JSR" || (inst.Name == "BRK" && h.settings.BrkTrap):
+		h.recordCall(callEvent{inst.Name, pc, cpu.Reg.PC, true})
+	case inst.Name == "RTS" || inst.Name == "RTI":
+		h.recordCall(callEvent{inst.Name, pc, cpu.Reg.PC, false})
+	}
+}
+
+// Add an event to the call trace, discarding the oldest event if the trace
+// is full.
+func (h *Host) recordCall(e callEvent) {
+	if len(h.calls) < maxCallEvents {
+		h.calls = append(h.calls, e)
+	} else {
+		h.calls[h.callsNext] = e
+		h.callsNext = (h.callsNext + 1) % maxCallEvents
+	}
+}
+
+// Return the events in the call trace, oldest first.
+func (h *Host) callEvents() []callEvent {
+	events := make([]callEvent, 0, len(h.calls))
+	events = append(events, h.calls[h.callsNext:]...)
+	return append(events, h.calls[:h.callsNext]...)
+}
+
+// Return the name of the interrupt the next step will service, or an empty
+// string if no interrupt is due.
+func (h *Host) dueInterrupt() string {
+	switch {
+	case !h.cpu.InterruptDue():
+		return ""
+	case h.cpu.PendingNMI():
+		return "NMI"
+	default:
+		return "IRQ"
+	}
 }
 
 func (h *Host) stepOver() {
 	cpu := h.cpu
 
+	// A due interrupt takes the place of the instruction at the program
+	// counter, and its handler returns to the same address.
+	interrupt := cpu.InterruptDue()
 	inst := cpu.GetInstruction(cpu.Reg.PC)
 	next := cpu.Reg.PC + uint16(inst.Length)
-	cpu.Step()
+	if interrupt {
+		next = cpu.Reg.PC
+	}
+	h.step()
+
+	// When BRK is trapped, it behaves like a system call. Its return
+	// address skips the signature byte following the opcode.
+	trap := !interrupt && inst.Name == "BRK" && h.settings.BrkTrap
+	if trap {
+		next++
+	}
 
-	// If a JSR was just stepped, keep stepping until the return address
-	// is hit or a corresponding RTS is stepped.
-	if inst.Name == "JSR" {
-		count := 1
-	loop:
+	// If a JSR (or trapped BRK or interrupt) was just stepped, keep
+	// stepping until the return address is hit or a corresponding RTS (or
+	// RTI) is stepped. The returns stack records, for each call entered,
+	// whether it returns with an RTI.
+	if interrupt || inst.Name == "JSR" || trap {
+		returns := []bool{interrupt || trap}
 		for step := 0; h.state == stateRunning && cpu.Reg.PC != next; step++ {
+			// A due interrupt is serviced instead of the instruction at the
+			// program counter.
+			due := cpu.InterruptDue()
 			inst := cpu.GetInstruction(cpu.Reg.PC)
-			cpu.Step()
-			switch inst.Name {
-			case "JSR":
-				count++
-			case "RTS":
-				count--
-				if count == 0 {
-					break loop
+			h.step()
+			switch {
+			case due:
+				returns = append(returns, true)
+			case inst.Name == "JSR":
+				returns = append(returns, false)
+			case inst.Name == "BRK" && h.settings.BrkTrap:
+				returns = append(returns, true)
+			case inst.Name == "RTS" || inst.Name == "RTI":
+				if returns[len(returns)-1] == (inst.Name == "RTI") {
+					returns = returns[:len(returns)-1]
 				}
 			}
+			if len(returns) == 0 {
+				break
+			}
 			h.breakCheck(step)
 		}
 	}
@@ -1554,10 +3687,17 @@ func (h *Host) stepOver() {
 func (h *Host) stepOut() {
 	cpu := h.cpu
 
+	// Record the stack pointer on entry. Nested subroutine calls push
+	// return addresses below it, so an RTS or RTI that leaves the stack
+	// pointer above the entry value must have returned from the current
+	// subroutine. The stack pointer may wrap past $FF when it returns, so
+	// compare its signed distance from the entry value.
+	entrySP := cpu.Reg.SP
+
 	for step := 0; h.state == stateRunning; step++ {
 		inst := cpu.GetInstruction(cpu.Reg.PC)
-		cpu.Step()
-		if inst.Name == "RTS" || inst.Name == "RTI" {
+		h.step()
+		if (inst.Name == "RTS" || inst.Name == "RTI") && int8(cpu.Reg.SP-entrySP) > 0 {
 			break
 		}
 		h.breakCheck(step)
@@ -1566,6 +3706,138 @@ func (h *Host) stepOut() {
 
 func (h *Host) onSettingsUpdate() {
 	h.exprParser.hexMode = h.settings.HexMode
+
+	if h.settings.StackCheck {
+		h.debugger.AttachStackHandler(h)
+	} else {
+		h.debugger.AttachStackHandler(nil)
+	}
+
+	if h.settings.BrkTrap {
+		h.cpu.AttachBrkHandler(nil)
+	} else {
+		h.cpu.AttachBrkHandler(h)
+	}
+
+	switch h.settings.Base {
+	case 2, 10, 16:
+	default:
+		fmt.Fprintf(h, "Invalid display base %d.\n", h.settings.Base)
+		h.settings.Base = 16
+	}
+
+	if h.settings.ListWidth < 0 {
+		fmt.Fprintf(h, "Invalid list width %d.\n", h.settings.ListWidth)
+		h.settings.ListWidth = 8
+	}
+	switch h.settings.DumpWidth {
+	case 8, 16:
+	default:
+		fmt.Fprintf(h, "Invalid dump width %d.\n", h.settings.DumpWidth)
+		h.settings.DumpWidth = 8
+	}
+
+	if h.settings.ListTabs < 0 {
+		fmt.Fprintf(h, "Invalid list tab width %d.\n", h.settings.ListTabs)
+		h.settings.ListTabs = 0
+	}
+
+	h.mem.OpenBus = h.settings.OpenBus
+	h.applyTheme()
+
+	// Memory is initialized only at startup, before anything has been
+	// loaded or run, so that loaded code is never overwritten.
+	if init := strings.ToLower(h.settings.MemInit); init != h.memInit {
+		switch {
+		case !validMemInit(init):
+			fmt.Fprintf(h, "Invalid memory init mode '%s'.\n", h.settings.MemInit)
+		case h.memoryInUse():
+			fmt.Fprintln(h, "Memory is in use, so it can only be initialized at startup.")
+		default:
+			h.initMemory(init)
+			h.memInit = init
+		}
+		h.settings.MemInit = h.memInit
+	}
+
+	h.mem.Unmap(h.keyboard)
+	if addr := h.settings.KeyboardAddr; addr != 0 {
+		err := h.mem.Map(addr, addr+1, h.keyboard)
+		if err != nil {
+			fmt.Fprintf(h, "Unable to map keyboard at $%04X (%v).\n", addr, err)
+			h.settings.KeyboardAddr = 0
+		} else if h.rawMode {
+			h.console.startPump()
+		}
+	}
+
+	h.mem.Unmap(h.rng)
+	if addr := h.settings.RngAddr; addr != 0 {
+		err := h.mem.Map(addr, addr, h.rng)
+		if err != nil {
+			fmt.Fprintf(h, "Unable to map random number register at $%04X (%v).\n", addr, err)
+			h.settings.RngAddr = 0
+		}
+	}
+}
+
+// Return true if the mode is a recognized memory init mode.
+func validMemInit(mode string) bool {
+	return mode == "zero" || mode == "pattern" || mode == "random"
+}
+
+// Return true if code has been loaded into memory, memory has been changed
+// by a host command, or the CPU has run.
+func (h *Host) memoryInUse() bool {
+	if h.loadedCode != nil || h.cpu.Cycles > 0 || h.memoryChanged {
+		return true
+	}
+	for _, loaded := range h.loadedPages {
+		if loaded {
+			return true
+		}
+	}
+	return false
+}
+
+// Initialize the contents of memory according to the requested mode:
+// "zero" clears all bytes, "pattern" fills them with $A5, and "random"
+// fills them with random values. Memory-mapped devices are bypassed.
+func (h *Host) initMemory(mode string) {
+	switch mode {
+	case "zero":
+		h.mem.FlatMemory.Fill(0, 0xffff, 0)
+	case "pattern":
+		h.mem.FlatMemory.Fill(0, 0xffff, 0xa5)
+	case "random":
+		b := make([]byte, 0x10000)
+		rand.Read(b)
+		h.mem.FlatMemory.StoreBytes(0, b)
+	}
+}
+
+// Format a byte value using the display base.
+func (h *Host) formatByte(v byte) string {
+	switch h.settings.Base {
+	case 2:
+		return fmt.Sprintf("%%%08b", v)
+	case 10:
+		return fmt.Sprintf("%d", v)
+	default:
+		return fmt.Sprintf("$%02X", v)
+	}
+}
+
+// Format a word value using the display base.
+func (h *Host) formatWord(v uint16) string {
+	switch h.settings.Base {
+	case 2:
+		return fmt.Sprintf("%%%016b", v)
+	case 10:
+		return fmt.Sprintf("%d", v)
+	default:
+		return fmt.Sprintf("$%04X", v)
+	}
 }
 
 func (h *Host) parseAddr(s string, next uint16) (uint16, error) {
@@ -1585,6 +3857,10 @@ func (h *Host) parseAddr(s string, next uint16) (uint16, error) {
 }
 
 func (h *Host) parseExpr(expr string) (uint16, error) {
+	if i := strings.LastIndexByte(expr, ':'); i >= 0 {
+		return h.parseLineSpec(expr[:i], expr[i+1:])
+	}
+
 	v, err := h.exprParser.Parse(expr, h)
 	if err != nil {
 		return 0, err
@@ -1596,49 +3872,154 @@ func (h *Host) parseExpr(expr string) (uint16, error) {
 	return uint16(v), nil
 }
 
+// Parse a source code line specification of the form [<file>]:<line> into
+// the address of the code generated by the line. If the file is omitted, the
+// current source file is used.
+func (h *Host) parseLineSpec(file, line string) (uint16, error) {
+	if file == "" {
+		file = h.settings.SourceFile
+		if file == "" {
+			return 0, errors.New("no current source file")
+		}
+	}
+
+	filename, err := h.findSourceFile(file)
+	if err != nil {
+		return 0, err
+	}
+
+	n, err := strconv.Atoi(strings.TrimSpace(line))
+	if err != nil || n < 1 {
+		return 0, fmt.Errorf("invalid line number '%s'", line)
+	}
+
+	addr, err := h.sourceMap.FindByLine(filename, n)
+	if err != nil {
+		return 0, err
+	}
+	return uint16(addr), nil
+}
+
+// Return the name of the source map file matching the requested file name.
+// The requested name may omit the file's directory.
+func (h *Host) findSourceFile(name string) (string, error) {
+	for _, f := range h.sourceMap.Files {
+		if f == name {
+			return f, nil
+		}
+	}
+
+	var match string
+	for _, f := range h.sourceMap.Files {
+		if strings.EqualFold(filepath.Base(f), name) {
+			if match != "" {
+				return "", fmt.Errorf("source file '%s' is ambiguous", name)
+			}
+			match = f
+		}
+	}
+	if match == "" {
+		return "", fmt.Errorf("source file '%s' not found", name)
+	}
+	return match, nil
+}
+
+// Remember the bytes displayed by a memory dump, returning the bytes
+// displayed by the previous dump of the same range, if it is one of the most
+// recent dumps.
+func (h *Host) rememberDump(d memoryDump) (prev []byte) {
+	for i, l := range h.lastDumps {
+		if l.start == d.start && l.end == d.end {
+			prev = l.mem
+			h.lastDumps = append(h.lastDumps[:i], h.lastDumps[i+1:]...)
+			break
+		}
+	}
+	if len(h.lastDumps) == maxMemoryDumps {
+		h.lastDumps = h.lastDumps[1:]
+	}
+	h.lastDumps = append(h.lastDumps, d)
+	return prev
+}
+
+// Display the contents of memory from addr0 through addr0+bytes-1. Byte
+// values that changed since the last dump of the same range are highlighted.
 func (h *Host) dumpMemory(addr0, bytes uint16) {
 	addr1 := addr0 + bytes - 1
 	if addr1 < addr0 {
 		addr1 = 0xffff
 	}
 
-	buf := []byte("    -" + strings.Repeat(" ", 35))
+	mem := make([]byte, int(addr1)-int(addr0)+1)
+	for i := range mem {
+		mem[i] = h.cpu.PeekByte(addr0 + uint16(i))
+	}
+	prev := h.rememberDump(memoryDump{addr0, addr1, mem})
+
+	// Each row holds an address, n byte values in the display base, and
+	// the n characters the byte values represent.
+	n := h.settings.DumpWidth
+	base := h.settings.Base
+	w := byteWidth(base)
+	chars := 6 + n*(w+1) + 2
+	buf := []byte("    -" + strings.Repeat(" ", chars+n-5))
+	changed := make([]bool, n)
 
 	// Don't align display for short dumps.
-	if addr1-addr0 < 8 {
+	if int(addr1-addr0) < n {
 		addrToBuf(addr0, buf[0:4])
-		for a, c1, c2 := uint32(addr0), 6, 32; a <= uint32(addr1); a, c1, c2 = a+1, c1+3, c2+1 {
-			m := h.cpu.Mem.LoadByte(uint16(a))
-			byteToBuf(m, buf[c1:c1+2])
-			buf[c2] = toPrintableChar(m)
+		for i, c1, c2 := 0, 6, chars; i < len(mem); i, c1, c2 = i+1, c1+w+1, c2+1 {
+			byteToBufBase(mem[i], base, buf[c1:c1+w])
+			buf[c2] = toPrintableChar(mem[i])
+			changed[i] = prev != nil && prev[i] != mem[i]
 		}
-		fmt.Fprintln(h, string(buf))
+		fmt.Fprintln(h, h.highlightCells(buf, w, changed))
 		return
 	}
 
-	// Align addr0 and addr1 to 8-byte boundaries.
-	start := uint32(addr0) & 0xfff8
-	stop := (uint32(addr1) + 8) & 0xffff8
+	// Align addr0 and addr1 to n-byte boundaries.
+	mask := ^uint32(n - 1)
+	start := uint32(addr0) & mask
+	stop := (uint32(addr1) + uint32(n)) & mask
 	if stop > 0x10000 {
 		stop = 0x10000
 	}
 
 	a := uint16(start)
-	for r := start; r < stop; r += 8 {
+	for r := start; r < stop; r += uint32(n) {
 		addrToBuf(a, buf[0:4])
-		for c1, c2 := 6, 32; c1 < 29; c1, c2, a = c1+3, c2+1, a+1 {
+		for i, c1, c2 := 0, 6, chars; i < n; i, c1, c2, a = i+1, c1+w+1, c2+1, a+1 {
 			if a >= addr0 && a <= addr1 {
-				m := h.cpu.Mem.LoadByte(a)
-				byteToBuf(m, buf[c1:c1+2])
+				m := mem[a-addr0]
+				byteToBufBase(m, base, buf[c1:c1+w])
 				buf[c2] = toPrintableChar(m)
+				changed[i] = prev != nil && prev[a-addr0] != m
 			} else {
-				buf[c1] = ' '
-				buf[c1+1] = ' '
+				copy(buf[c1:c1+w], strings.Repeat(" ", w))
 				buf[c2] = ' '
+				changed[i] = false
 			}
 		}
-		fmt.Fprintln(h, string(buf))
+		fmt.Fprintln(h, h.highlightCells(buf, w, changed))
+	}
+}
+
+// Return a memory dump row with the changed byte value cells colorized.
+func (h *Host) highlightCells(buf []byte, w int, changed []bool) string {
+	var sb strings.Builder
+	sb.Write(buf[:6])
+	for i, c1 := 0, 6; i < len(changed); i, c1 = i+1, c1+w+1 {
+		if changed[i] {
+			sb.WriteString(h.theme.Annotation)
+			sb.Write(buf[c1 : c1+w])
+			sb.WriteString(h.theme.Reset)
+		} else {
+			sb.Write(buf[c1 : c1+w])
+		}
+		sb.WriteByte(buf[c1+w])
 	}
+	sb.Write(buf[6+len(changed)*(w+1):])
+	return sb.String()
 }
 
 func (h *Host) getSourceLines(filename string) (lines []string, err error) {
@@ -1666,6 +4047,16 @@ func (h *Host) getSourceLines(filename string) (lines []string, err error) {
 	return lines, nil
 }
 
+// Load the byte or little-endian word stored at the address, for use by
+// the expression peek operators.
+func (h *Host) resolveMemory(addr uint16, word bool) int64 {
+	v := int64(h.cpu.PeekByte(addr))
+	if word {
+		v |= int64(h.cpu.PeekByte(addr+1)) << 8
+	}
+	return v
+}
+
 func (h *Host) resolveIdentifier(s string) (int64, error) {
 	s = strings.ToLower(s)
 
@@ -1677,7 +4068,7 @@ func (h *Host) resolveIdentifier(s string) (int64, error) {
 	case "y":
 		return int64(h.cpu.Reg.Y), nil
 	case "sp":
-		return int64(h.cpu.Reg.SP) | 0x0100, nil
+		return int64(h.cpu.StackPage)<<8 | int64(h.cpu.Reg.SP), nil
 	case ".":
 		fallthrough
 	case "pc":
@@ -1689,26 +4080,132 @@ func (h *Host) resolveIdentifier(s string) (int64, error) {
 			return int64(e.Address), nil
 		}
 	}
+	for _, e := range h.sourceMap.Symbols {
+		if strings.ToLower(e.Label) == s {
+			return int64(e.Address), nil
+		}
+	}
 
+	if near := h.nearSymbols(s); len(near) > 0 {
+		return 0, fmt.Errorf("identifier '%s' not found (did you mean %s?)", s, strings.Join(near, ", "))
+	}
 	return 0, fmt.Errorf("identifier '%s' not found", s)
 }
 
+// The maximum number of near-matching symbol names suggested when an
+// identifier isn't found.
+const maxNearSymbols = 5
+
+// Return the names of exported and other symbols that nearly match the
+// lowercase name s. A symbol nearly matches if one name contains the other
+// or if they differ by no more than two character edits.
+func (h *Host) nearSymbols(s string) []string {
+	var near []string
+	seen := make(map[string]bool)
+	for _, list := range [][]asm.Export{h.sourceMap.Exports, h.sourceMap.Symbols} {
+		for _, e := range list {
+			l := strings.ToLower(e.Label)
+			if seen[l] || len(near) == maxNearSymbols {
+				continue
+			}
+			if strings.Contains(l, s) || strings.Contains(s, l) || editDistance(l, s) <= 2 {
+				near = append(near, e.Label)
+				seen[l] = true
+			}
+		}
+	}
+	return near
+}
+
 // OnBrk is called when the CPU is about to execute a BRK instruction.
 func (h *Host) OnBrk(cpu *cpu.CPU) {
 	h.setState(stateInterrupted)
 	fmt.Fprintf(h, "BRK encountered at $%04X.\n", cpu.Reg.PC)
 }
 
+// OnIllegalOpcode is called when the CPU is about to execute an opcode that
+// is undefined on its architecture.
+func (h *Host) OnIllegalOpcode(cpu *cpu.CPU) {
+	h.setState(stateInterrupted)
+	opcode := cpu.PeekByte(cpu.Reg.PC)
+	fmt.Fprintf(h, "Illegal opcode $%02X encountered at $%04X.\n", opcode, cpu.Reg.PC)
+}
+
+// OnReset is called when the CPU resets itself.
+func (h *Host) OnReset(cpu *cpu.CPU) {
+	h.setState(stateInterrupted)
+	fmt.Fprintf(h, "CPU reset to $%04X.\n", cpu.Reg.PC)
+}
+
 // OnBreakpoint is called when the debugger encounters a code breakpoint.
 func (h *Host) OnBreakpoint(cpu *cpu.CPU, b *cpu.Breakpoint) {
-	h.setState(stateBreakpoint)
-	fmt.Fprintf(h, "Breakpoint hit at $%04X.\n", b.Address)
-	h.displayPC()
+	if !b.Continue {
+		h.setState(stateBreakpoint)
+		fmt.Fprintf(h, "Breakpoint hit at $%04X.\n", b.Address)
+		h.displayPC()
+	}
+	if b.Command != "" {
+		h.runBreakpointAction(b)
+	}
+}
+
+// Run the command attached to a breakpoint. The command doesn't become the
+// command repeated by an empty line.
+func (h *Host) runBreakpointAction(b *cpu.Breakpoint) {
+	// An alias may have been redefined since the action was attached.
+	if !h.isActionCommand(b.Command) {
+		fmt.Fprintf(h, "Command '%s' can't be a breakpoint action.\n", b.Command)
+		return
+	}
+
+	lastCmd, lastArgs := h.lastCmd, h.lastArgs
+	if err := h.processCommand(b.Command); err != nil {
+		fmt.Fprintf(h, "%v\n", err)
+	}
+	h.lastCmd, h.lastArgs = lastCmd, lastArgs
+}
+
+// Return true if the command line may be run as a breakpoint action.
+func (h *Host) isActionCommand(command string) bool {
+	_, line := splitRepeatCount(command)
+	n, _, err := cmds.Lookup(h.expandAlias(line))
+	if err != nil {
+		return false
+	}
+	c, ok := n.(*cmd.Command)
+	return ok && actionCommands[c]
 }
 
 // OnDataBreakpoint is called when the debugger encounters a data breakpoint.
 func (h *Host) OnDataBreakpoint(cpu *cpu.CPU, b *cpu.DataBreakpoint) {
-	fmt.Fprintf(h, "Data breakpoint hit on address $%04X.\n", b.Address)
+	if b.Stack {
+		fmt.Fprintf(h, "Stack data breakpoint hit on address $%04X (SP=$%02X).\n", b.Address, cpu.Reg.SP)
+	} else {
+		fmt.Fprintf(h, "Data breakpoint hit on address $%04X.\n", b.Address)
+	}
+
+	h.setState(stateBreakpoint)
+
+	if cpu.LastPC != cpu.Reg.PC {
+		d, _ := disasm.Disassemble(h.cpu, cpu.LastPC, disasm.ShowFull, "", h.theme)
+		fmt.Fprintln(h, d)
+	}
+
+	h.displayPC()
+}
+
+// OnStackOverflow is called when a push wraps the stack pointer.
+func (h *Host) OnStackOverflow(cpu *cpu.CPU) {
+	h.onStackWrap(cpu, "overflow")
+}
+
+// OnStackUnderflow is called when a pull wraps the stack pointer.
+func (h *Host) OnStackUnderflow(cpu *cpu.CPU) {
+	h.onStackWrap(cpu, "underflow")
+}
+
+func (h *Host) onStackWrap(cpu *cpu.CPU, kind string) {
+	fmt.Fprintf(h, "Stack %s at $%04X.\n", kind, cpu.LastPC)
 
 	h.setState(stateBreakpoint)
 
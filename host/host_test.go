@@ -0,0 +1,302 @@
+// Copyright 2018 Brett Vickers. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package host
+
+import (
+	"os"
+	"strings"
+	"testing"
+
+	"github.com/beevik/go6502/asm"
+)
+
+// Create a host with the assembled code loaded into memory. The IRQ vector
+// points to the IRQ label, if any.
+func newTestHost(t *testing.T, code string) *Host {
+	a, sm, err := asm.Assemble(strings.NewReader(code), "test.asm", 0x1000, os.Stdout, asm.ExportAll)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	h := New()
+	h.EnableProcessedMode(strings.NewReader(""), nil)
+	h.mem.StoreBytes(sm.Origin, a.Code)
+	for _, e := range sm.Exports {
+		if e.Label == "IRQ" {
+			h.mem.StoreWord(0xfffe, e.Address)
+		}
+	}
+	h.cpu.SetPC(sm.Origin)
+	return h
+}
+
+func expectPC(t *testing.T, h *Host, pc uint16) {
+	t.Helper()
+	if h.cpu.Reg.PC != pc {
+		t.Errorf("PC incorrect. exp: $%04X, got: $%04X", pc, h.cpu.Reg.PC)
+	}
+}
+
+func TestStepOverInterrupt(t *testing.T) {
+	code := `
+	.ORG $1000
+	SEI
+	NOP
+	JSR SUB
+	NOP
+	BRK
+SUB	CLI
+	NOP
+	NOP
+	RTS
+IRQ	RTI`
+
+	// An interrupt serviced inside the subroutine doesn't end the step
+	// over early.
+	h := newTestHost(t, code)
+	h.cpu.Step()
+	h.cpu.Step()
+	h.cpu.IRQ()
+	h.processCommand("step over")
+	expectPC(t, h, 0x1005)
+
+	// Stepping over a due interrupt runs its handler.
+	h = newTestHost(t, code)
+	h.cpu.Step()
+	h.cpu.Step()
+	h.processCommand("step in 2")
+	h.cpu.IRQ()
+	h.processCommand("step in")
+	h.processCommand("step over")
+	expectPC(t, h, 0x1009)
+}
+
+func TestMiniAssemblerCase(t *testing.T) {
+	h := newTestHost(t, "\t.ORG $1000\n\tNOP")
+	h.processCommand("assemble interactive $1000")
+	for _, line := range []string{
+		"loop lda #'a'",
+		"\t.db \"Hello\", 0",
+		"\tjmp LOOP",
+		"end",
+	} {
+		h.processMiniAssembler(line)
+	}
+
+	exp := []byte{0xa9, 'a', 'H', 'e', 'l', 'l', 'o', 0x00, 0x4c, 0x00, 0x10}
+	got := make([]byte, len(exp))
+	h.mem.LoadBytes(0x1000, got)
+	if string(got) != string(exp) {
+		t.Errorf("code incorrect. exp: % X, got: % X", exp, got)
+	}
+}
+
+func TestStepOutStackWrap(t *testing.T) {
+	code := `
+	.ORG $1000
+	JSR SUB
+	NOP
+	BRK
+SUB	NOP
+	RTS`
+
+	// The return pops the stack pointer past $FF.
+	h := newTestHost(t, code)
+	h.cpu.Reg.SP = 0x00
+	h.processCommand("step in")
+	if h.cpu.Reg.SP != 0xfe {
+		t.Fatalf("SP incorrect. exp: $FE, got: $%02X", h.cpu.Reg.SP)
+	}
+	h.processCommand("step out")
+	expectPC(t, h, 0x1003)
+}
+
+func TestRngSeed(t *testing.T) {
+	code := `
+	.ORG $1000
+	LDA $C080
+	STA $0200
+	LDA $C080
+	STA $0201
+	LDA $C080
+	STA $0202
+	BRK`
+
+	run := func(examine bool) []byte {
+		h := newTestHost(t, code)
+		h.processCommand("set rngaddr $C080")
+		h.processCommand("set rngseed 42")
+
+		// Examining the register in the debugger doesn't advance the
+		// generator.
+		if examine {
+			h.processCommand("memory dump $C080 $C080")
+			h.processCommand("evaluate @$C080")
+			h.processCommand("disassemble $1000 6")
+		}
+
+		h.processCommand("step in 6")
+		b := make([]byte, 3)
+		h.mem.LoadBytes(0x0200, b)
+		return b
+	}
+
+	exp := run(false)
+	if got := run(false); string(got) != string(exp) {
+		t.Errorf("sequence not reproducible. exp: % X, got: % X", exp, got)
+	}
+	if got := run(true); string(got) != string(exp) {
+		t.Errorf("sequence changed by examining it. exp: % X, got: % X", exp, got)
+	}
+	if exp[0] == exp[1] && exp[1] == exp[2] {
+		t.Errorf("sequence not random: % X", exp)
+	}
+}
+
+func TestKeyboardExamine(t *testing.T) {
+	code := `
+	.ORG $1000
+	LDA $C001
+	STA $0200
+	LDA $C001
+	STA $0201
+	BRK`
+
+	h := newTestHost(t, code)
+	h.processCommand("set keyboardaddr $C000")
+	h.keyboard.push([]byte("ab"))
+
+	// Examining the keyboard registers in the debugger doesn't consume the
+	// queued keys.
+	h.processCommand("memory dump $C000 $C001")
+	h.processCommand("evaluate @$C001")
+
+	h.processCommand("step in 4")
+	b := make([]byte, 2)
+	h.mem.LoadBytes(0x0200, b)
+	if string(b) != "ab" {
+		t.Errorf("keys incorrect. exp: 61 62, got: % X", b)
+	}
+}
+
+func TestMiniAssemblerTextCase(t *testing.T) {
+	h := newTestHost(t, "\t.ORG $1000\n\tNOP")
+	h.processCommand("assemble text $1000")
+	for _, line := range []string{
+		"Loop\tlda #'a' ; Comment",
+		"\tjmp LOOP",
+		".end",
+	} {
+		h.processMiniAssembler(line)
+	}
+
+	exp := []byte{0xa9, 'a', 0x4c, 0x00, 0x10}
+	got := make([]byte, len(exp))
+	h.mem.LoadBytes(0x1000, got)
+	if string(got) != string(exp) {
+		t.Errorf("code incorrect. exp: % X, got: % X", exp, got)
+	}
+}
+
+func TestBreakpointAction(t *testing.T) {
+	code := `
+	.ORG $1000
+	LDX #3
+LOOP	DEX
+	BNE LOOP
+	BRK`
+
+	h := newTestHost(t, code)
+	var out strings.Builder
+	h.EnableProcessedMode(strings.NewReader(""), &out)
+
+	// Commands that change the host's state can't be actions.
+	for _, c := range []string{"coldstart", "load test.bin", "assemble interactive $2000", "memory paste", "step in"} {
+		h.processCommand("breakpoint action $1002 continue " + c)
+		if h.debugger.GetBreakpoint(0x1002) != nil {
+			t.Fatalf("'%s' accepted as a breakpoint action", c)
+		}
+	}
+
+	// A continue action runs each time the breakpoint is hit, without
+	// stopping the CPU.
+	h.processCommand("breakpoint action $1002 continue evaluate x")
+	out.Reset()
+	h.processCommand("run")
+	expectPC(t, h, 0x1005)
+	for _, v := range []string{"$0003 = 3", "$0002 = 2", "$0001 = 1"} {
+		if !strings.Contains(out.String(), v) {
+			t.Errorf("action output '%s' missing:\n%s", v, out.String())
+		}
+	}
+}
+
+func TestDisassembleLabels(t *testing.T) {
+	code := `
+	.ORG $1000
+START	LDX #3
+LOOP	DEX
+	BNE LOOP
+	BEQ START+1
+	JMP $2000
+	JMP START`
+
+	h := newTestHost(t, code)
+	var out strings.Builder
+	h.EnableProcessedMode(strings.NewReader(""), &out)
+	h.processCommand("set color false")
+	h.processCommand("set disasmcode false")
+	out.Reset()
+	h.processCommand("disassemble labels $1000 6")
+
+	// Only targets that start a displayed line are labeled.
+	for _, s := range []string{"L1000:", "L1002:", "BNE   L1002", "BEQ   $1001", "JMP   $2000", "JMP   L1000"} {
+		if !strings.Contains(out.String(), s) {
+			t.Errorf("'%s' missing from disassembly:\n%s", s, out.String())
+		}
+	}
+	for _, s := range []string{"L1001", "L2000"} {
+		if strings.Contains(out.String(), s) {
+			t.Errorf("unexpected '%s' in disassembly:\n%s", s, out.String())
+		}
+	}
+}
+
+func TestMemInitAfterMemorySet(t *testing.T) {
+	h := New()
+	h.EnableProcessedMode(strings.NewReader(""), nil)
+
+	h.processCommand("set meminit pattern")
+	if v := h.mem.LoadByte(0x0300); v != 0xa5 {
+		t.Errorf("memory not initialized. exp: $A5, got: $%02X", v)
+	}
+
+	// Memory changed by a command is not overwritten.
+	h.processCommand("memory set $0300 1")
+	h.processCommand("set meminit zero")
+	if v := h.mem.LoadByte(0x0300); v != 0x01 {
+		t.Errorf("memory overwritten. exp: $01, got: $%02X", v)
+	}
+}
+
+func TestRememberDump(t *testing.T) {
+	h := New()
+	for i := 0; i < maxMemoryDumps+4; i++ {
+		a := uint16(i * 0x100)
+		h.rememberDump(memoryDump{a, a + 0xff, []byte{byte(i)}})
+	}
+	if len(h.lastDumps) != maxMemoryDumps {
+		t.Errorf("dumps remembered. exp: %d, got: %d", maxMemoryDumps, len(h.lastDumps))
+	}
+
+	// The oldest ranges are forgotten.
+	if prev := h.rememberDump(memoryDump{0, 0xff, nil}); prev != nil {
+		t.Errorf("oldest dump not forgotten")
+	}
+	a := uint16((maxMemoryDumps + 3) * 0x100)
+	if prev := h.rememberDump(memoryDump{a, a + 0xff, nil}); len(prev) != 1 || prev[0] != maxMemoryDumps+3 {
+		t.Errorf("latest dump not remembered, got %v", prev)
+	}
+}
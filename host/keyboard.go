@@ -0,0 +1,138 @@
+// Copyright 2018 Brett Vickers. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package host
+
+import (
+	"os"
+	"sync"
+	"sync/atomic"
+)
+
+// Keyboard register offsets.
+const (
+	keyboardStatus = 0 // bit 7 set when a key is available
+	keyboardData   = 1 // reading returns the key and clears the status
+)
+
+// A keyboard is a memory-mapped input device that queues keystrokes typed
+// on the console while the CPU is running.
+type keyboard struct {
+	mu        sync.Mutex
+	keys      []byte
+	capturing atomic.Bool // true when keystrokes go to the keyboard
+}
+
+// LoadByte reads one of the keyboard's registers.
+func (k *keyboard) LoadByte(offset uint16) byte {
+	k.mu.Lock()
+	defer k.mu.Unlock()
+
+	switch offset {
+	case keyboardStatus:
+		if len(k.keys) > 0 {
+			return 0x80
+		}
+	case keyboardData:
+		if len(k.keys) > 0 {
+			key := k.keys[0]
+			k.keys = k.keys[1:]
+			return key
+		}
+	}
+	return 0
+}
+
+// PeekByte returns the value a read of one of the keyboard's registers would
+// return, without removing a key from the queue.
+func (k *keyboard) PeekByte(offset uint16) byte {
+	k.mu.Lock()
+	defer k.mu.Unlock()
+
+	if len(k.keys) > 0 {
+		switch offset {
+		case keyboardStatus:
+			return 0x80
+		case keyboardData:
+			return k.keys[0]
+		}
+	}
+	return 0
+}
+
+// StoreByte writes one of the keyboard's registers. Keyboard registers are
+// read-only, so stores are ignored.
+func (k *keyboard) StoreByte(offset uint16, v byte) {
+}
+
+// Add keystrokes to the keyboard's queue.
+func (k *keyboard) push(keys []byte) {
+	k.mu.Lock()
+	k.keys = append(k.keys, keys...)
+	k.mu.Unlock()
+}
+
+// A consoleInput is the reader used by the raw-mode terminal. Initially it
+// reads directly from stdin. Once the keyboard device is in use, a goroutine
+// takes over all stdin reads, so that keystrokes typed while the CPU is
+// running can be routed to the keyboard instead of the terminal.
+type consoleInput struct {
+	h       *Host
+	pump    chan []byte
+	pending []byte
+}
+
+// Read reads console input for the terminal.
+func (c *consoleInput) Read(p []byte) (n int, err error) {
+	if c.pump == nil {
+		return os.Stdin.Read(p)
+	}
+
+	if len(c.pending) == 0 {
+		b, ok := <-c.pump
+		if !ok {
+			return 0, os.ErrClosed
+		}
+		c.pending = b
+	}
+	n = copy(p, c.pending)
+	c.pending = c.pending[n:]
+	return n, nil
+}
+
+// Start the goroutine that pumps stdin input to the terminal or keyboard.
+func (c *consoleInput) startPump() {
+	if c.pump != nil {
+		return
+	}
+
+	c.pump = make(chan []byte, 16)
+	go func() {
+		const CtrlC = 3
+		for {
+			buf := make([]byte, 256)
+			n, err := os.Stdin.Read(buf)
+			if err != nil {
+				close(c.pump)
+				return
+			}
+
+			buf = buf[:n]
+			if !c.h.keyboard.capturing.Load() {
+				c.pump <- buf
+				continue
+			}
+
+			for i, b := range buf {
+				if b == CtrlC {
+					c.h.keyboard.push(buf[:i])
+					c.h.Break()
+					buf = nil
+					break
+				}
+			}
+			c.h.keyboard.push(buf)
+		}
+	}()
+}
@@ -0,0 +1,66 @@
+// Copyright 2018 Brett Vickers. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package host
+
+import "sync"
+
+// An rng is a memory-mapped random number generator. Each read of its
+// single register returns the next byte of a pseudo-random sequence
+// determined entirely by the generator's seed, so programs that consume
+// randomness behave identically from one run to the next.
+type rng struct {
+	mu    sync.Mutex
+	state uint32
+}
+
+// Restart the generator's sequence using the seed.
+func (r *rng) reseed(seed int) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	// Mix the seed so that similar seeds produce unrelated sequences.
+	x := uint32(seed)
+	x = (x ^ x>>16) * 0x85ebca6b
+	x = (x ^ x>>13) * 0xc2b2ae35
+	x ^= x >> 16
+
+	// Xorshift never leaves the all-zero state.
+	if x == 0 {
+		x = 0x9e3779b9
+	}
+	r.state = x
+}
+
+// LoadByte reads the generator's register, returning the next byte in its
+// sequence.
+func (r *rng) LoadByte(offset uint16) byte {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	r.state = xorshift(r.state)
+	return byte(r.state >> 24)
+}
+
+// PeekByte returns the next byte in the generator's sequence without
+// advancing the sequence.
+func (r *rng) PeekByte(offset uint16) byte {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	return byte(xorshift(r.state) >> 24)
+}
+
+// Return the 32-bit xorshift generator state following x.
+func xorshift(x uint32) uint32 {
+	x ^= x << 13
+	x ^= x >> 17
+	x ^= x << 5
+	return x
+}
+
+// StoreByte writes the generator's register. The register is read-only, so
+// stores are ignored.
+func (r *rng) StoreByte(offset uint16, v byte) {
+}
@@ -16,26 +16,64 @@ import (
 
 type settings struct {
 	HexMode         bool   `doc:"hexadecimal input mode"`
+	Base            int    `doc:"numeric display base (2, 10 or 16)"`
+	IncludePaths    string `doc:"list of paths searched for included files"`
 	CompactMode     bool   `doc:"compact disassembly output"`
+	Color           bool   `doc:"colorize output with ANSI escape codes"`
+	DisasmTiming    bool   `doc:"show instruction cycle costs in disassembly"`
+	DisasmCode      bool   `doc:"show machine code bytes in disassembly"`
 	MemDumpBytes    int    `doc:"default number of memory bytes to dump"`
+	DumpWidth       int    `doc:"number of bytes per memory dump line (8 or 16)"`
 	DisasmLines     int    `doc:"default number of lines to disassemble"`
 	SourceLines     int    `doc:"default number of source lines to display"`
+	ListWidth       int    `doc:"width of the code column in source listings"`
+	ListTabs        int    `doc:"expand source tabs to this width (0 = keep tabs)"`
 	MaxStepLines    int    `doc:"max lines to disassemble when stepping"`
+	RunLimit        int    `doc:"max instructions executed by run (0 = none)"`
+	ShowSource      bool   `doc:"show source code lines when stepping"`
+	SourceComments  bool   `doc:"annotate disassembly with source comments"`
+	StackCheck      bool   `doc:"stop when the stack pointer wraps"`
+	BrkTrap         bool   `doc:"execute BRK through its vector instead of stopping"`
+	KeyboardAddr    uint16 `doc:"keyboard status address, data at +1 (0 = none)"`
+	RngAddr         uint16 `doc:"random number register address (0 = none)"`
+	RngSeed         int    `doc:"seed of the random number register"`
+	OpenBus         bool   `doc:"unmapped addresses read the last bus value"`
+	MemInit         string `doc:"memory contents at startup: zero, pattern or random"`
 	NextDisasmAddr  uint16 `doc:"address of next disassembly"`
 	NextSourceAddr  uint16 `doc:"address of next source line display"`
 	NextMemDumpAddr uint16 `doc:"address of next memory dump"`
+	SourceFile      string `doc:"default source file for line numbers"`
 }
 
 func newSettings() *settings {
 	return &settings{
 		HexMode:         false,
+		Base:            16,
+		IncludePaths:    "",
 		CompactMode:     false,
+		Color:           true,
+		DisasmTiming:    false,
+		DisasmCode:      true,
 		MemDumpBytes:    64,
+		DumpWidth:       8,
 		DisasmLines:     10,
 		SourceLines:     10,
+		ListWidth:       8,
+		ListTabs:        0,
 		MaxStepLines:    20,
+		RunLimit:        0,
+		ShowSource:      false,
+		SourceComments:  false,
+		StackCheck:      false,
+		BrkTrap:         false,
+		KeyboardAddr:    0,
+		RngAddr:         0,
+		RngSeed:         0,
+		OpenBus:         false,
+		MemInit:         "zero",
 		NextDisasmAddr:  0,
 		NextMemDumpAddr: 0,
+		SourceFile:      "",
 	}
 }
 
@@ -96,6 +134,16 @@ func (s *settings) Kind(key string) reflect.Kind {
 	return f.kind
 }
 
+// Return the name of the setting matching the key, or an empty string if
+// there is no such setting.
+func (s *settings) Name(key string) string {
+	f, err := settingsTree.FindValue(strings.ToLower(key))
+	if err != nil {
+		return ""
+	}
+	return f.name
+}
+
 func (s *settings) Set(key string, value any) error {
 	f, err := settingsTree.FindValue(strings.ToLower(key))
 	if err != nil {
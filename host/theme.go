@@ -0,0 +1,142 @@
+// Copyright 2018 Brett Vickers. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package host
+
+import (
+	"bufio"
+	"fmt"
+	"os"
+	"strconv"
+	"strings"
+
+	"github.com/beevik/go6502/disasm"
+	"github.com/beevik/go6502/term"
+)
+
+// Colors that may be assigned to theme elements, by name. The "none" color
+// leaves an element uncolored.
+var themeColors = map[string]string{
+	"none":          "",
+	"black":         term.Black,
+	"red":           term.Red,
+	"green":         term.Green,
+	"yellow":        term.Yellow,
+	"blue":          term.Blue,
+	"magenta":       term.Magenta,
+	"cyan":          term.Cyan,
+	"white":         term.White,
+	"brightblack":   term.BrightBlack,
+	"brightred":     term.BrightRed,
+	"brightgreen":   term.BrightGreen,
+	"brightyellow":  term.BrightYellow,
+	"brightblue":    term.BrightBlue,
+	"brightmagenta": term.BrightMagenta,
+	"brightcyan":    term.BrightCyan,
+	"brightwhite":   term.BrightWhite,
+}
+
+// A hostTheme describes the colors used by the host's output along with
+// the command prompt.
+type hostTheme struct {
+	disasm.Theme
+	Prompt      string // text of the command prompt
+	PromptColor string // color of the command prompt
+}
+
+// The theme used when the host starts.
+var defaultTheme = hostTheme{
+	Theme: disasm.Theme{
+		Addr:       term.BrightWhite,
+		Code:       term.White,
+		Inst:       term.BrightCyan,
+		Operand:    term.Green,
+		RegName:    term.BrightYellow,
+		RegValue:   term.BrightGreen,
+		RegEqual:   term.White,
+		Source:     term.BrightGreen,
+		Annotation: term.BrightYellow,
+		Reset:      term.Reset,
+	},
+	Prompt:      "* ",
+	PromptColor: term.Green,
+}
+
+// A theme with no colors, used when color output is disabled.
+var plainTheme disasm.Theme
+
+// Return a pointer to the theme element with the requested name, or nil if
+// there is no such element.
+func (t *hostTheme) element(name string) *string {
+	switch strings.ToLower(name) {
+	case "addr":
+		return &t.Addr
+	case "code":
+		return &t.Code
+	case "inst":
+		return &t.Inst
+	case "operand":
+		return &t.Operand
+	case "regname":
+		return &t.RegName
+	case "regvalue":
+		return &t.RegValue
+	case "regequal":
+		return &t.RegEqual
+	case "source":
+		return &t.Source
+	case "annotation":
+		return &t.Annotation
+	case "promptcolor":
+		return &t.PromptColor
+	default:
+		return nil
+	}
+}
+
+// Load a theme from a file. Each line of the file has the form
+// "<element> = <value>". Elements are colored by giving their value as a
+// color name, and the "prompt" element sets the prompt text, which may be
+// quoted. Blank lines and lines starting with '#' or ';' are ignored.
+// Elements not mentioned in the file keep their values from the theme t.
+func loadTheme(filename string, t hostTheme) (hostTheme, error) {
+	file, err := os.Open(filename)
+	if err != nil {
+		return t, err
+	}
+	defer file.Close()
+
+	scanner := bufio.NewScanner(file)
+	for row := 1; scanner.Scan(); row++ {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || line[0] == '#' || line[0] == ';' {
+			continue
+		}
+
+		name, value, ok := strings.Cut(line, "=")
+		if !ok {
+			return t, fmt.Errorf("%s:%d: expected <element> = <value>", filename, row)
+		}
+		name, value = strings.TrimSpace(name), strings.TrimSpace(value)
+
+		if strings.EqualFold(name, "prompt") {
+			if s, err := strconv.Unquote(value); err == nil {
+				value = s
+			}
+			t.Prompt = value
+			continue
+		}
+
+		e := t.element(name)
+		if e == nil {
+			return t, fmt.Errorf("%s:%d: unknown theme element '%s'", filename, row, name)
+		}
+		color, ok := themeColors[strings.ToLower(value)]
+		if !ok {
+			return t, fmt.Errorf("%s:%d: unknown color '%s'", filename, row, value)
+		}
+		*e = color
+	}
+	return t, scanner.Err()
+}
@@ -5,8 +5,14 @@
 package host
 
 import (
+	"encoding/hex"
+	"errors"
 	"fmt"
+	"io"
+	"strconv"
 	"strings"
+
+	"github.com/beevik/go6502/asm"
 )
 
 func codeString(b []byte) string {
@@ -25,15 +31,57 @@ func codeString(b []byte) string {
 func stringToBool(s string) (bool, error) {
 	s = strings.ToLower(s)
 	switch s {
-	case "0", "false":
+	case "0", "false", "off":
 		return false, nil
-	case "1", "true":
+	case "1", "true", "on":
 		return true, nil
 	default:
 		return false, fmt.Errorf("invalid bool value '%s'", s)
 	}
 }
 
+// Return the bytes stored by the assembler for a quoted string literal.
+func stringBytes(s string) ([]byte, error) {
+	a, _, err := asm.Assemble(strings.NewReader("\t.DB "+s), "string", 0, io.Discard, 0)
+	if err != nil {
+		return nil, fmt.Errorf("invalid string %s", s)
+	}
+	return a.Code, nil
+}
+
+// Split a command line into fields the way the command parser does, but
+// keep the quotes around quoted fields.
+func quotedFields(line string) []string {
+	var fields []string
+	for {
+		line = strings.TrimLeft(line, " \t")
+		if line == "" {
+			return fields
+		}
+		var n int
+		if line[0] == '"' {
+			n = strings.IndexByte(line[1:], '"') + 2
+			if n == 1 {
+				n = len(line)
+			}
+		} else {
+			n = strings.IndexAny(line, " \t")
+			if n < 0 {
+				n = len(line)
+			}
+		}
+		fields = append(fields, line[:n])
+		line = line[n:]
+	}
+}
+
+func boolToInt(b bool) int {
+	if b {
+		return 1
+	}
+	return 0
+}
+
 var hexString = "0123456789ABCDEF"
 
 func addrToBuf(addr uint16, b []byte) {
@@ -48,6 +96,33 @@ func byteToBuf(v byte, b []byte) {
 	b[1] = hexString[v&0xf]
 }
 
+// Return the number of characters used to display a byte in the requested
+// numeric base.
+func byteWidth(base int) int {
+	switch base {
+	case 2:
+		return 8
+	case 10:
+		return 3
+	default:
+		return 2
+	}
+}
+
+// Write a byte value into the buffer using the requested numeric base. The
+// buffer must hold byteWidth(base) characters.
+func byteToBufBase(v byte, base int, b []byte) {
+	switch base {
+	case 2:
+		s := strconv.FormatUint(uint64(v)|0x100, 2)
+		copy(b, s[1:])
+	case 10:
+		copy(b, fmt.Sprintf("%3d", v))
+	default:
+		byteToBuf(v, b)
+	}
+}
+
 func toPrintableChar(v byte) byte {
 	switch {
 	case v >= 32 && v < 127:
@@ -59,6 +134,120 @@ func toPrintableChar(v byte) byte {
 	}
 }
 
+// Return the Levenshtein edit distance between two strings: the number of
+// single-byte insertions, deletions and substitutions that change one into
+// the other.
+func editDistance(a, b string) int {
+	prev := make([]int, len(b)+1)
+	curr := make([]int, len(b)+1)
+	for j := range prev {
+		prev[j] = j
+	}
+	for i := 1; i <= len(a); i++ {
+		curr[0] = i
+		for j := 1; j <= len(b); j++ {
+			cost := 1
+			if a[i-1] == b[j-1] {
+				cost = 0
+			}
+			curr[j] = min(min(prev[j]+1, curr[j-1]+1), prev[j-1]+cost)
+		}
+		prev, curr = curr, prev
+	}
+	return prev[len(b)]
+}
+
+// Parse a line of hexadecimal byte values, as pasted from a monitor or hex
+// dump listing. The line may begin with an address followed by a colon or
+// dash, as in "1000: A9 01" or "1000- A9 01". Text following a '|', or
+// following two consecutive spaces after the bytes of an addressed line, is
+// treated as an ASCII column and ignored. A line in the format of
+// "hexdump -C" may omit the separator after its address. The returned
+// address is -1 if the line has none.
+func parseHexLine(line string) (addr int, b []byte, err error) {
+	line = strings.TrimRight(line, " \t")
+	ascii := false
+	if i := strings.IndexByte(line, '|'); i >= 0 {
+		line, ascii = strings.TrimRight(line[:i], " \t"), true
+	}
+
+	addr = -1
+	line = strings.TrimLeft(line, " \t")
+	if i := strings.IndexAny(line, ":-"); i >= 0 || ascii {
+		var a, rest string
+		if i >= 0 {
+			a, rest = line[:i], line[i+1:]
+		} else {
+			a, rest, _ = strings.Cut(line, " ")
+		}
+		v, err := parseHexValue(strings.TrimSpace(a))
+		if err != nil || v > 0xffff {
+			return -1, nil, fmt.Errorf("invalid address '%s'", strings.TrimSpace(a))
+		}
+		addr = int(v)
+
+		// A dump row beginning at an unaligned address has blank byte
+		// columns, each three characters wide, before its first byte.
+		line = strings.TrimLeft(rest, " \t")
+		if skip := (len(rest) - len(line) - 1) / 3; skip > 0 && !ascii {
+			addr += skip
+		}
+		if i := strings.Index(line, "  "); i >= 0 && !ascii {
+			line = line[:i]
+		}
+	}
+
+	for _, f := range strings.Fields(line) {
+		v, err := hex.DecodeString(trimHexPrefix(f))
+		if err != nil || len(v) == 0 {
+			return -1, nil, fmt.Errorf("invalid hex byte value '%s'", f)
+		}
+		b = append(b, v...)
+	}
+	if addr > 0xffff {
+		return -1, nil, errors.New("address out of range")
+	}
+	return addr, b, nil
+}
+
+// Parse a hexadecimal value with an optional '$' or '0x' prefix.
+func parseHexValue(s string) (uint64, error) {
+	return strconv.ParseUint(trimHexPrefix(s), 16, 32)
+}
+
+// Remove a '$' or '0x' prefix from a hexadecimal string.
+func trimHexPrefix(s string) string {
+	switch {
+	case strings.HasPrefix(s, "$"):
+		return s[1:]
+	case strings.HasPrefix(s, "0x") || strings.HasPrefix(s, "0X"):
+		return s[2:]
+	default:
+		return s
+	}
+}
+
+// Replace the tabs in a string with spaces, using tab stops every 'width'
+// columns.
+func expandTabs(s string, width int) string {
+	if !strings.Contains(s, "\t") {
+		return s
+	}
+	var b strings.Builder
+	col := 0
+	for _, c := range s {
+		if c == '\t' {
+			n := width - col%width
+			b.WriteString(strings.Repeat(" ", n))
+			col += n
+			continue
+		}
+		b.WriteRune(c)
+		col++
+	}
+	return b.String()
+}
+
 func min(a, b int) int {
 	if a < b {
 		return a
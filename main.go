@@ -7,19 +7,62 @@ package main
 import (
 	"flag"
 	"fmt"
+	"io"
 	"os"
 	"os/signal"
+	"path/filepath"
+	"strings"
 
 	"github.com/beevik/go6502/asm"
 	"github.com/beevik/go6502/host"
 )
 
 var (
-	assemble string
+	assemble     pathList
+	outPath      string
+	longBranches bool
+	mapSymbols   bool
+	mapComments  bool
+	strict       bool
+	extLabels    bool
+	allErrors    bool
+	exportAll    bool
+	ignoreCase   bool
+	errorsOnly   bool
+	noRC         bool
+	includePaths pathList
 )
 
+// The name of the startup script run before any other commands.
+const rcFilename = ".go6502rc"
+
+// A pathList is a command-line flag that may be specified more than once.
+type pathList []string
+
+func (p *pathList) String() string {
+	return strings.Join(*p, string(filepath.ListSeparator))
+}
+
+func (p *pathList) Set(value string) error {
+	*p = append(*p, value)
+	return nil
+}
+
 func init() {
-	flag.StringVar(&assemble, "a", "", "assemble file")
+	flag.Var(&assemble, "a", "assemble file (may be repeated to link several files)")
+	flag.StringVar(&outPath, "o", "", "output path of the assembled .bin and .map files")
+	flag.BoolVar(&longBranches, "l", false, "rewrite out-of-range branches as jumps when assembling")
+	flag.BoolVar(&mapSymbols, "s", false, "store all symbols in the source map when assembling")
+	flag.BoolVar(&mapComments, "c", false, "store source code comments in the source map when assembling")
+	flag.BoolVar(&strict, "strict", false, "recognize only pseudo-ops with a leading dot when assembling")
+	flag.BoolVar(&extLabels, "extlabels", false, "allow '?' and '!' in labels when assembling")
+	flag.BoolVar(&allErrors, "e", false, "report all errors instead of stopping at the first when assembling")
+	flag.BoolVar(&exportAll, "x", false, "export every global label when assembling")
+	flag.BoolVar(&ignoreCase, "i", false, "treat labels as case-insensitive when assembling")
+	flag.BoolVar(&errorsOnly, "q", false, "when assembling, print only errors as file:line:col: message")
+	flag.BoolVar(&errorsOnly, "errors-only", false, "same as -q")
+	flag.BoolVar(&noRC, "norc", false, "don't run the "+rcFilename+" startup script")
+	flag.Var(&includePaths, "I", "add a path searched for included files (may be repeated)")
 	flag.CommandLine.Usage = func() {
 		fmt.Println("Usage: go6502 [script] ..\nOptions:")
 		flag.PrintDefaults()
@@ -30,31 +73,53 @@ func main() {
 	flag.Parse()
 
 	// Initiate assembly from the command line if requested.
-	if assemble != "" {
-		err := asm.AssembleFile(assemble, 0, os.Stdout)
-		if err != nil {
-			fmt.Fprintf(os.Stderr, "Failed to assemble (%v).\n", err)
+	if len(assemble) > 0 {
+		var options asm.Option
+		if longBranches {
+			options |= asm.LongBranches
+		}
+		if mapSymbols {
+			options |= asm.MapSymbols
+		}
+		if mapComments {
+			options |= asm.MapComments
 		}
-		os.Exit(0)
+		if strict {
+			options |= asm.StrictPseudoOps
+		}
+		if extLabels {
+			options |= asm.ExtendedLabels
+		}
+		if allErrors {
+			options |= asm.AllErrors
+		}
+		if exportAll {
+			options |= asm.ExportAll
+		}
+		if ignoreCase {
+			options |= asm.IgnoreCase
+		}
+		os.Exit(assembleFile(options))
 	}
 
 	// Create the host
 	h := host.New()
 	defer h.Cleanup()
 
-	// Run commands contained in command-line files.
-	args := flag.Args()
-	if len(args) > 0 {
-		for _, filename := range args {
-			file, err := os.Open(filename)
-			if err != nil {
+	// Run the startup script if there is one.
+	if !noRC {
+		if filename := findRC(); filename != "" {
+			if err := runScript(h, filename); err != nil {
 				fmt.Fprintf(os.Stderr, "ERROR: %v\n", err)
-				os.Exit(1)
 			}
-			ioState := h.EnableProcessedMode(file, os.Stdout)
-			h.RunCommands(false)
-			h.RestoreIoState(ioState)
-			file.Close()
+		}
+	}
+
+	// Run commands contained in command-line files.
+	for _, filename := range flag.Args() {
+		if err := runScript(h, filename); err != nil {
+			fmt.Fprintf(os.Stderr, "ERROR: %v\n", err)
+			os.Exit(1)
 		}
 	}
 
@@ -68,6 +133,64 @@ func main() {
 	h.RunCommands(true)
 }
 
+// Assemble the files requested on the command line, returning the process
+// exit status. In errors-only mode, nothing but the errors is output.
+func assembleFile(options asm.Option) int {
+	if !errorsOnly {
+		_, err := asm.AssembleFiles(assemble, outPath, options, os.Stdout, includePaths...)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "Failed to assemble (%v).\n", err)
+			return 1
+		}
+		return 0
+	}
+
+	result, err := asm.AssembleFiles(assemble, outPath, options, io.Discard, includePaths...)
+	if err == nil {
+		return 0
+	}
+	if result == nil || len(result.Assembly.Diagnostics) == 0 {
+		fmt.Fprintf(os.Stderr, "%s: %v\n", assemble[0], err)
+		return 1
+	}
+	for _, d := range result.Assembly.Diagnostics {
+		fmt.Fprintln(os.Stderr, d)
+	}
+	return 1
+}
+
+// Return the path of the startup script. A script in the current directory
+// takes precedence over one in the user's home directory. An empty string is
+// returned if neither exists.
+func findRC() string {
+	dirs := []string{"."}
+	if home, err := os.UserHomeDir(); err == nil {
+		dirs = append(dirs, home)
+	}
+
+	for _, dir := range dirs {
+		filename := filepath.Join(dir, rcFilename)
+		if fi, err := os.Stat(filename); err == nil && !fi.IsDir() {
+			return filename
+		}
+	}
+	return ""
+}
+
+// Run the host commands contained in a script file.
+func runScript(h *host.Host, filename string) error {
+	file, err := os.Open(filename)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+
+	ioState := h.EnableProcessedMode(file, os.Stdout)
+	h.RunCommands(false)
+	h.RestoreIoState(ioState)
+	return nil
+}
+
 func handleInterrupt(h *host.Host, c chan os.Signal) {
 	for {
 		<-c